@@ -17,6 +17,9 @@ type (
 		Params  []Param              // (必填)参数说明列表(应该只声明当前中间件用到的参数)，path参数类型的先后顺序与url中保持一致
 		HTTP200 []Result             // (可选)HTTP Status Code 为200时的响应结果
 		Handler func(*Context) error // (必填)操作
+		// (可选)返回状态码与响应内容的简化操作，未设置Handler时使用，响应内容按请求的Accept协商序列化；
+		// 若返回的内容为error，则交由错误处理流程，非*HTTPError且状态码>=400时以该状态码包装为*HTTPError
+		StatusHandler func(*Context) (int, interface{})
 
 		id      string   // 操作的唯一标识符
 		methods []string // 真实的请求方法列表
@@ -99,6 +102,7 @@ func (a *ApiHandler) init() *ApiHandler {
 	a.initMethod()
 	a.initParamsAndSuffix()
 	a.initId()
+	a.initStatusHandler()
 	a.inited = true
 	if h := getApiHandler(a.id); h != nil {
 		return h
@@ -190,7 +194,12 @@ func (a *ApiHandler) initMethod() {
 
 func (a *ApiHandler) initId() {
 	add := "[" + a.suffix + "]" + "[" + a.Desc + "]" + "[" + a.Method + "]"
-	v := reflect.ValueOf(a.Handler)
+	var v reflect.Value
+	if a.Handler == nil && a.StatusHandler != nil {
+		v = reflect.ValueOf(a.StatusHandler)
+	} else {
+		v = reflect.ValueOf(a.Handler)
+	}
 	t := v.Type()
 	if t.Kind() == reflect.Func {
 		a.id = runtime.FuncForPC(v.Pointer()).Name() + add
@@ -199,3 +208,34 @@ func (a *ApiHandler) initId() {
 	}
 	a.id = utils.MakeHash(a.id)
 }
+
+// 将StatusHandler包装为Handler
+func (a *ApiHandler) initStatusHandler() {
+	if a.Handler != nil || a.StatusHandler == nil {
+		return
+	}
+	fn := a.StatusHandler
+	a.Handler = func(c *Context) error {
+		code, body := fn(c)
+		switch b := body.(type) {
+		case nil:
+			return c.NoContent(code)
+		case *HTTPError:
+			return b
+		case error:
+			if code >= 400 {
+				return NewHTTPError(code, b.Error())
+			}
+			return b
+		case string:
+			return c.String(code, b)
+		case []byte:
+			c.response.Header().Set(HeaderContentType, MIMEOctetStream)
+			c.WriteHeader(code)
+			_, err := c.response.Write(b)
+			return err
+		default:
+			return c.Negotiate(code, b)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package lessgo
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"path"
 	"reflect"
@@ -325,7 +326,9 @@ func isExistMiddlewares(middlewareConfigs ...*MiddlewareConfig) error {
 func getMiddlewareFuncs(configs []*MiddlewareConfig) []MiddlewareFunc {
 	mws := make([]MiddlewareFunc, len(configs))
 	for i, mw := range configs {
-		mws[i] = mw.middlewareFunc()
+		if fn := mw.middlewareFunc(); fn != nil {
+			mws[i] = namedMiddleware(mw.Name, fn)
+		}
 	}
 	return mws
 }
@@ -360,41 +363,208 @@ var CheckHome = ApiMiddleware{
 	},
 }.Reg()
 
+// 访问日志的采样配置
+type RequestLoggerConfig struct {
+	SampleRate       int64            `json:"sample_rate"`        // 每N个请求记录1个，0或1表示全部记录
+	RouteSampleRates map[string]int64 `json:"route_sample_rates"` // 按路由(如"/home/:id")单独设置的采样率，优先于SampleRate
+	AlwaysLogErrors  bool             `json:"always_log_errors"`  // 状态码>=400的请求总是记录，不参与采样
+}
+
+// 访问日志的采样函数(可选)
+var accessLogSampler func(c *Context, latency time.Duration, sampled bool) bool
+
+// 设置访问日志的采样函数，sampled为按配置得出的采样结果，返回是否记录该请求，
+// 可用于如慢请求无论是否被采样都总是记录等场景
+func SetAccessLogSampler(fn func(c *Context, latency time.Duration, sampled bool) bool) {
+	accessLogSampler = fn
+}
+
 var RequestLogger = ApiMiddleware{
-	Name: "系统运行日志打印",
-	Desc: "RequestLogger returns a middleware that logs HTTP requests.",
-	Middleware: func(next HandlerFunc) HandlerFunc {
-		return func(c *Context) error {
-			var u = c.request.URL.String()
-			start := time.Now()
-			if err := next(c); err != nil {
-				c.Failure(500, err)
+	Name:   "系统运行日志打印",
+	Desc:   "RequestLogger returns a middleware that logs HTTP requests, successful requests can be sampled 1-in-N (per route optional).",
+	Config: RequestLoggerConfig{SampleRate: 1, AlwaysLogErrors: true},
+	Middleware: func(confObject interface{}) MiddlewareFunc {
+		conf := confObject.(RequestLoggerConfig)
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				var u = c.request.URL.String()
+				start := time.Now()
+				if err := next(c); err != nil {
+					app.handleError(c, err)
+				}
+				stop := time.Now()
+
+				n := c.response.Status()
+				sampled := conf.AlwaysLogErrors && n >= 400
+				if !sampled {
+					rate, ok := conf.RouteSampleRates[c.path]
+					if !ok {
+						rate = conf.SampleRate
+					}
+					sampled = rate <= 1 || rand.Int63n(rate) == 0
+				}
+				if accessLogSampler != nil {
+					sampled = accessLogSampler(c, stop.Sub(start), sampled)
+				}
+				if !sampled {
+					return nil
+				}
+
+				method := c.request.Method
+				if u == "" {
+					u = "/"
+				}
+
+				var code string
+				if runtime.GOOS == "linux" {
+					code = strconv.Itoa(n)
+				} else {
+					code = color.Green(n)
+					switch {
+					case n >= 500:
+						code = color.Red(n)
+					case n >= 400:
+						code = color.Magenta(n)
+					case n >= 300:
+						code = color.Cyan(n)
+					}
+				}
+
+				Log.Debug("%15s | %7s | %s | %8d | %10s | %s", c.RealRemoteAddr(), method, code, c.response.Size(), stop.Sub(start), u)
+				return nil
 			}
-			stop := time.Now()
+		}
+	},
+}.Reg()
 
-			method := c.request.Method
-			if u == "" {
-				u = "/"
+// 请求体缓存的配置
+type BodyBufferConfig struct {
+	Limit int64 `json:"limit"` // 缓存的最大字节数，超出时返回413，0表示不限制
+}
+
+var BodyBuffer = ApiMiddleware{
+	Name: "请求体缓存",
+	Desc: "一次性读取并缓存请求体，供签名校验等中间件与Bind()等多次读取，各消费者应通过Context.BodyReader()获取新的读取器；" +
+		"请求体在请求结束前常驻内存，应设置较小的上限；multipart/form-data的流式上传不做缓存",
+	Config: BodyBufferConfig{Limit: 4 * MB},
+	Middleware: func(confObject interface{}) MiddlewareFunc {
+		limit := confObject.(BodyBufferConfig).Limit
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				if !strings.HasPrefix(c.request.Header.Get(HeaderContentType), MIMEMultipartForm) {
+					if err := c.BufferBody(limit); err != nil {
+						return err
+					}
+				}
+				return next(c)
 			}
+		}
+	},
+}.Reg()
 
-			n := c.response.Status()
-			var code string
-			if runtime.GOOS == "linux" {
-				code = strconv.Itoa(n)
-			} else {
-				code = color.Green(n)
-				switch {
-				case n >= 500:
-					code = color.Red(n)
-				case n >= 400:
-					code = color.Magenta(n)
-				case n >= 300:
-					code = color.Cyan(n)
+// 请求体必填校验的配置
+type RequireBodyConfig struct {
+	Methods []string `json:"methods"` // 要求请求体非空的请求方法
+}
+
+var RequireBody = ApiMiddleware{
+	Name:   "请求体必填",
+	Desc:   "要求指定方法(默认POST、PUT、PATCH)的请求携带非空的请求体，否则返回400，避免客户端误发空请求体时绑定出零值结构体；按路由或分组选用",
+	Config: RequireBodyConfig{Methods: []string{POST, PUT, PATCH}},
+	Middleware: func(confObject interface{}) MiddlewareFunc {
+		methods := confObject.(RequireBodyConfig).Methods
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				for _, method := range methods {
+					if strings.EqualFold(method, c.request.Method) {
+						if c.bodyEmpty() {
+							return NewHTTPError(http.StatusBadRequest, "request body is required for "+c.request.Method)
+						}
+						break
+					}
 				}
+				return next(c)
 			}
+		}
+	},
+}.Reg()
+
+// 查询参数数量限制的配置
+type MaxQueryParamsConfig struct {
+	Max int `json:"max"` // 允许的最大查询参数数量(按键值对计，重复的键分别计数)
+}
+
+var MaxQueryParams = ApiMiddleware{
+	Name:   "查询参数数量限制",
+	Desc:   "查询参数数量超出上限时返回400，在解析前扫描原始查询串计数，防止大量参数导致的解析与绑定开销(参数洪泛攻击)",
+	Config: MaxQueryParamsConfig{Max: 1000},
+	Middleware: func(confObject interface{}) MiddlewareFunc {
+		limit := confObject.(MaxQueryParamsConfig).Max
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				if n := countQueryParams(c.request.URL.RawQuery); n > limit {
+					return NewHTTPError(http.StatusBadRequest, fmt.Sprintf("too many query parameters: %d, the max is %d", n, limit))
+				}
+				return next(c)
+			}
+		}
+	},
+}.Reg()
+
+// 统计原始查询串中非空的键值对数量，与url.ParseQuery的计数一致
+func countQueryParams(rawQuery string) int {
+	var n int
+	for len(rawQuery) > 0 {
+		i := strings.IndexByte(rawQuery, '&')
+		if i < 0 {
+			n++
+			break
+		}
+		if i > 0 {
+			n++
+		}
+		rawQuery = rawQuery[i+1:]
+	}
+	return n
+}
+
+// 慢请求告警的配置
+type SlowRequestConfig struct {
+	Threshold int64 `json:"threshold"` // 耗时阈值，单位毫秒
+}
+
+// 慢请求的回调函数(可选)
+var slowRequestFunc func(c *Context, latency time.Duration)
 
-			Log.Debug("%15s | %7s | %s | %8d | %10s | %s", c.RealRemoteAddr(), method, code, c.response.Size(), stop.Sub(start), u)
-			return nil
+// 设置慢请求的回调函数，可用于上报监控指标或告警
+func SetSlowRequestFunc(fn func(c *Context, latency time.Duration)) {
+	slowRequestFunc = fn
+}
+
+var SlowRequest = ApiMiddleware{
+	Name:   "慢请求告警",
+	Desc:   "请求耗时超过阈值时打印Warn日志(含路由、参数与耗时)，并调用慢请求回调函数",
+	Config: SlowRequestConfig{Threshold: 500},
+	Middleware: func(confObject interface{}) MiddlewareFunc {
+		threshold := time.Duration(confObject.(SlowRequestConfig).Threshold) * time.Millisecond
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				start := time.Now()
+				err := next(c)
+				latency := time.Since(start)
+				if latency < threshold {
+					return err
+				}
+				params := make([]string, len(c.pkeys))
+				for i, k := range c.pkeys {
+					params[i] = k + "=" + c.PathParamByIndex(i)
+				}
+				Log.Warn("[%s] %7s | %s | %v | %10s | %s", color.Yellow("SLOW"), c.request.Method, c.path, params, latency, c.request.URL.String())
+				if slowRequestFunc != nil {
+					slowRequestFunc(c, latency)
+				}
+				return err
+			}
 		}
 	},
 }.Reg()
@@ -2,21 +2,31 @@ package lessgo
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/textproto"
 	"os"
 	"path"
 	"reflect"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/facebookgo/grace/gracehttp"
+	"github.com/facebookgo/grace/gracenet"
 	"github.com/henrylee2cn/lessgo/logs"
 	"github.com/henrylee2cn/lessgo/logs/color"
 	"github.com/henrylee2cn/lessgo/session"
@@ -33,18 +43,104 @@ type (
 		chainNodes     []MiddlewareFunc
 		chainHandler   HandlerFunc
 		failureHandler FailureHandlerFunc
+		groupFailures  []groupFailureHandler // sorted by the prefix length in descending order
+		errorHooks     []ErrorHookFunc
 		panicStackFunc PanicStackFunc
+		panicHook      PanicHookFunc
 		sessions       *session.Manager
 		binder         Binder
+		binders        atomic.Value // *binderRegistry, replaced as a whole on every change
+		bindersLock    sync.Mutex
 		renderer       Renderer
 		memoryCache    *MemoryCache
 		ctxPool        sync.Pool
+		ctxNewHook     func(*Context)
+		requestHook    func(*Context)
+		responseHook   func(c *Context, latency time.Duration)
 		serving        bool
+		inflight       int64 // number of requests being served, accessed atomically
+		served         int64 // number of requests served, accessed atomically
+		openConns      int64 // number of open connections, accessed atomically
+		connStateHook  func(net.Conn, http.ConnState)
+		maxPathLength  int
+		maxBodyBytes   int64
+		defaultHeaders [][2]string // canonical key and value
 		lock           sync.RWMutex
 		// the graceful exit or restart callback function
 		graceExitCallback func() error
+		// status code responded by the routes registered without a handler
+		missingHandlerStatus int
+		// allocate a fresh Context per request instead of using the pool
+		disablePooling bool
+		// detach the request, the response and the path params of the Context before it is put back
+		poolPoisoning bool
+		// let the panics propagate to the server instead of responding 500
+		disableRecover bool
+		// discard the body written after a superfluous WriteHeader on an error response
+		discardSuperfluousWrites bool
+		// generate the ID of every request, and whether to keep the valid X-Request-Id of the client
+		requestIDGenerator func() string
+		trustRequestID     bool
+		// the proxies whose X-Forwarded-For and X-Real-IP are trusted, see SetTrustedProxies
+		trustedProxies []netip.Prefix
+		// trust the address headers from any peer without trusted proxies, see SetTrustAnyProxy
+		trustAnyProxy bool
+		// the servers being served, their listeners and their shutdown, nil if not serving
+		servers  []*http.Server
+		addrs    []net.Addr
+		gnet     *gracenet.Net
+		shutdown *shutdownState
+		// the certificates of the running HTTPS servers loaded from the files
+		certReloaders []*certReloader
+		// called with the address of every listener once the servers are started
+		onListen func(net.Addr)
+		// the time to wait for the in-flight requests when shutting down on a signal
+		shutdownTimeout time.Duration
+		// the base TLS config of the HTTPS server
+		tlsConfig *tls.Config
+		// wraps the handler of the HTTP server
+		httpHandlerWrapper func(http.Handler) http.Handler
+		// obtains the certificates of the HTTPS server automatically, see SetAutoTLS
+		autoTLS AutoTLSManager
+		// the listen configs served together with Config.Listen
+		extraListens []Listen
 	}
 
+	// shutdownState is the shutdown of the servers, which is done once.
+	shutdownState struct {
+		once  sync.Once
+		start chan struct{} // closed when the shutdown starts
+		err   error
+	}
+
+	// ServerStats holds the counters of the server.
+	ServerStats struct {
+		OpenConnections int64 // connections being open, including the idle ones
+		ActiveRequests  int64 // requests being served
+		TotalRequests   int64 // requests served since the start
+	}
+
+	// binderRegistry holds the binders registered by the media type and by the path prefix.
+	binderRegistry struct {
+		types  map[string]Binder
+		groups []groupBinder // sorted by the prefix length in descending order
+	}
+
+	// groupBinder is the default binder of the routes under the prefix.
+	groupBinder struct {
+		prefix string
+		binder Binder
+	}
+
+	// groupFailureHandler is the failure handler of the routes under the prefix.
+	groupFailureHandler struct {
+		prefix  string
+		handler FailureHandlerFunc
+	}
+
+	// connContextKey is the request context key of the underlying net.Conn.
+	connContextKey struct{}
+
 	// Route contains a handler and information for matching against requests.
 	Route struct {
 		Method  string
@@ -57,8 +153,22 @@ type (
 
 	FailureHandlerFunc func(c *Context, code int, errString string) error
 
+	// ErrorHookFunc is invoked with the error returned by the handlers before the failure response is rendered.
+	// The returned error replaces the original one, returning nil means the error has been handled.
+	ErrorHookFunc func(c *Context, err error) error
+
 	PanicStackFunc func(rcv interface{}) string
 
+	// PanicHookFunc is invoked after a panic during the request has been recovered,
+	// with the middleware or handler where it originated.
+	PanicHookFunc func(c *Context, rcv interface{}, source PanicSource)
+
+	// PanicSource is the position in the chain where a panic originated.
+	PanicSource struct {
+		Kind string // PanicInMiddleware or PanicInHandler, empty if outside the chain
+		Name string // the ApiMiddleware name or the function name
+	}
+
 	// MiddlewareFunc defines a function to process middleware.
 	MiddlewareFunc func(HandlerFunc) HandlerFunc
 
@@ -115,24 +225,37 @@ const (
 
 // Headers
 const (
+	HeaderAccept                        = "Accept"
 	HeaderAcceptEncoding                = "Accept-Encoding"
 	HeaderAuthorization                 = "Authorization"
 	HeaderContentDisposition            = "Content-Disposition"
 	HeaderContentEncoding               = "Content-Encoding"
 	HeaderContentLength                 = "Content-Length"
 	HeaderContentType                   = "Content-Type"
+	HeaderConnection                    = "Connection"
 	HeaderCookie                        = "Cookie"
 	HeaderSetCookie                     = "Set-Cookie"
+	HeaderETag                          = "ETag"
+	HeaderIfMatch                       = "If-Match"
+	HeaderIfNoneMatch                   = "If-None-Match"
 	HeaderIfModifiedSince               = "If-Modified-Since"
+	HeaderIfUnmodifiedSince             = "If-Unmodified-Since"
 	HeaderLastModified                  = "Last-Modified"
+	HeaderLink                          = "Link"
+	HeaderAltSvc                        = "Alt-Svc"
 	HeaderLocation                      = "Location"
+	HeaderTrailer                       = "Trailer"
 	HeaderUpgrade                       = "Upgrade"
 	HeaderVary                          = "Vary"
 	HeaderWWWAuthenticate               = "WWW-Authenticate"
 	HeaderXForwardedProto               = "X-Forwarded-Proto"
+	HeaderXForwardedSsl                 = "X-Forwarded-Ssl"
+	HeaderForwarded                     = "Forwarded"
 	HeaderXHTTPMethodOverride           = "X-HTTP-Method-Override"
 	HeaderXForwardedFor                 = "X-Forwarded-For"
+	HeaderXRequestID                    = "X-Request-Id"
 	HeaderXRealIP                       = "X-Real-IP"
+	HeaderXAPIVersion                   = "X-API-Version"
 	HeaderServer                        = "Server"
 	HeaderOrigin                        = "Origin"
 	HeaderAccessControlRequestMethod    = "Access-Control-Request-Method"
@@ -143,6 +266,10 @@ const (
 	HeaderAccessControlAllowCredentials = "Access-Control-Allow-Credentials"
 	HeaderAccessControlExposeHeaders    = "Access-Control-Expose-Headers"
 	HeaderAccessControlMaxAge           = "Access-Control-Max-Age"
+	HeaderIdempotencyKey                = "Idempotency-Key"
+	HeaderIdempotentReplayed            = "Idempotent-Replayed"
+	HeaderTraceparent                   = "Traceparent"
+	HeaderTracestate                    = "Tracestate"
 
 	// Security
 	HeaderStrictTransportSecurity = "Strict-Transport-Security"
@@ -167,6 +294,20 @@ var (
 	}
 )
 
+// Kinds of PanicSource
+const (
+	PanicInMiddleware = "middleware"
+	PanicInHandler    = "handler"
+)
+
+// String returns the readable position, e.g. "middleware main.Auth".
+func (s PanicSource) String() string {
+	if s.Kind == "" {
+		return "unknown"
+	}
+	return s.Kind + " " + s.Name
+}
+
 // Errors
 var (
 	ErrUnsupportedMediaType        = NewHTTPError(http.StatusUnsupportedMediaType)
@@ -174,34 +315,31 @@ var (
 	ErrUnauthorized                = NewHTTPError(http.StatusUnauthorized)
 	ErrMethodNotAllowed            = NewHTTPError(http.StatusMethodNotAllowed)
 	ErrStatusRequestEntityTooLarge = NewHTTPError(http.StatusRequestEntityTooLarge)
+	ErrBodyTooLarge                = ErrStatusRequestEntityTooLarge
+	ErrStatusRequestURITooLong     = NewHTTPError(http.StatusRequestURITooLong)
+	ErrPreconditionFailed          = NewHTTPError(http.StatusPreconditionFailed)
 	ErrStatusInternalServerError   = NewHTTPError(http.StatusInternalServerError)
 	ErrRendererNotRegistered       = errors.New("renderer not registered")
 	ErrInvalidRedirectCode         = errors.New("invalid redirect status code")
 	ErrCookieNotFound              = errors.New("cookie not found")
+	ErrResponseCommitted           = errors.New("response already committed")
+	ErrFlushNotSupported           = errors.New("flush not supported by the response writer")
+	ErrPushNotSupported            = errors.New("HTTP/2 server push not supported")
 )
 
+// 内置的失败状态页面模板
+const defaultFailurePage = "<html>\n" +
+	"<head><title>%d %s</title></head>\n" +
+	"<body bgcolor=\"white\">\n" +
+	"<center><h1>%d %s</h1></center>\n" +
+	"<hr>\n<center>lessgo/%s</center>\n%s\n</body>\n</html>\n"
+
 var (
 	// 请求处理链的最末端(最后被调用的空操作)
 	chainEndHandler = HandlerFunc(func(c *Context) error {
 		return nil
 	})
 
-	// 失败状态默认的响应内容
-	defaultFailureHandler = func(c *Context, code int, errStr string) error {
-		statusText := http.StatusText(code)
-		if len(errStr) > 0 {
-			errStr = `<br><p><b style="color:red;">[ERROR]</b> <pre>` + errStr + `</pre></p>`
-		}
-		c.response.Header().Set(HeaderXContentTypeOptions, "nosniff")
-		return c.HTML(code, fmt.Sprintf("<html>\n"+
-			"<head><title>%d %s</title></head>\n"+
-			"<body bgcolor=\"white\">\n"+
-			"<center><h1>%d %s</h1></center>\n"+
-			"<hr>\n<center>lessgo/%s</center>\n%s\n</body>\n</html>\n",
-			code, statusText, code, statusText, VERSION, errStr),
-		)
-	}
-
 	// 从请求过程中的恐慌获取显示的日志内容
 	defaultPanicStackFunc = func(rcv interface{}) string {
 		s := []byte("/src/runtime/panic.go")
@@ -220,12 +358,21 @@ func newApp() *App {
 	this := &App{
 		chainHandler:   chainEndHandler,
 		binder:         &binder{},
-		failureHandler: defaultFailureHandler,
 		panicStackFunc: defaultPanicStackFunc,
+
+		missingHandlerStatus: http.StatusServiceUnavailable,
+		shutdownTimeout:      time.Minute,
+		requestIDGenerator:   defaultRequestIDGenerator,
 	}
 
+	this.failureHandler = this.defaultFailureHandler
+
 	this.ctxPool.New = func() interface{} {
-		return this.newContext(new(Response), new(http.Request))
+		c := this.newContext(new(Response), new(http.Request))
+		if this.ctxNewHook != nil {
+			this.ctxNewHook(c)
+		}
+		return c
 	}
 
 	this.router = newRouter()
@@ -250,16 +397,370 @@ func (this *App) SetPanicStackFunc(fn func(rcv interface{}) string) {
 	this.panicStackFunc = PanicStackFunc(fn)
 }
 
+// SetPanicHook sets the hook called after a panic during the request has been recovered,
+// e.g. to report it with the middleware or handler where it originated.
+func (this *App) SetPanicHook(fn func(c *Context, rcv interface{}, source PanicSource)) {
+	this.panicHook = PanicHookFunc(fn)
+}
+
 // set the default failuer handler.
 func (this *App) SetFailureHandler(fn func(c *Context, code int, errString string) error) {
 	this.failureHandler = FailureHandlerFunc(fn)
 }
 
+// SetGroupFailureHandler sets the failure handler of the routes under the path prefix,
+// e.g. JSON errors for "/api" and HTML error pages for "/admin", overriding the default one.
+// The handler of the longest prefix matching the registered route path is used;
+// the default one is used if none matches, or if no route matches the request, e.g. 404.
+// A nil fn removes the handler of the prefix.
+func (this *App) SetGroupFailureHandler(prefix string, fn func(c *Context, code int, errString string) error) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	list := make([]groupFailureHandler, 0, len(this.groupFailures)+1)
+	for _, g := range this.groupFailures {
+		if g.prefix != prefix {
+			list = append(list, g)
+		}
+	}
+	if fn != nil {
+		list = append(list, groupFailureHandler{prefix: prefix, handler: FailureHandlerFunc(fn)})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return len(list[i].prefix) > len(list[j].prefix)
+	})
+	this.groupFailures = list
+}
+
+// failureHandlerOf returns the failure handler of the route path.
+func (this *App) failureHandlerOf(route string) FailureHandlerFunc {
+	for _, g := range this.groupFailures {
+		if underPrefix(route, g.prefix) {
+			return g.handler
+		}
+	}
+	return this.failureHandler
+}
+
+// underPrefix reports whether the route path is the prefix or under it.
+func underPrefix(route, prefix string) bool {
+	return prefix == "/" || route == prefix ||
+		strings.HasPrefix(route, prefix) && route[len(prefix)] == '/'
+}
+
+// 失败状态默认的响应内容，无需配置模板渲染器：
+// 请求只接受JSON而不接受HTML时返回JSON，否则返回内置的HTML页面；
+// 仅调试模式下显示错误详情，生产环境只显示状态码与通用说明
+func (this *App) defaultFailureHandler(c *Context, code int, errStr string) error {
+	statusText := http.StatusText(code)
+	if len(errStr) == 0 || !this.debug {
+		errStr = ""
+	}
+	if accept := c.request.Header.Get(HeaderAccept); !strings.Contains(accept, MIMETextHTML) && strings.Contains(accept, MIMEApplicationJSON) {
+		info := statusText
+		if len(errStr) > 0 {
+			info = errStr
+		}
+		b, err := json.Marshal(CommJSON{Code: code, Info: info})
+		if err != nil {
+			return err
+		}
+		return c.JSONBlob(code, b)
+	}
+	if len(errStr) > 0 {
+		errStr = `<br><p><b style="color:red;">[ERROR]</b> <pre>` + html.EscapeString(errStr) + `</pre></p>`
+	}
+	c.response.Header().Set(HeaderXContentTypeOptions, "nosniff")
+	return c.HTML(code, fmt.Sprintf(defaultFailurePage, code, statusText, code, statusText, VERSION, errStr))
+}
+
+// UseOnError appends the error hooks, which are called in order by the central error handler.
+// Each hook receives the error returned by the previous one; if a hook returns nil,
+// the remaining hooks are skipped and no failure response is rendered.
+func (this *App) UseOnError(hooks ...ErrorHookFunc) {
+	this.errorHooks = append(this.errorHooks, hooks...)
+}
+
+// handleError runs the error hooks and renders the failure response,
+// the status code is taken from `*HTTPError`, is 400 for `BindErrors`, or defaults to 500.
+// It returns the error transformed by the hooks.
+func (this *App) handleError(c *Context, err error) error {
+	for _, hook := range this.errorHooks {
+		if err = hook(c, err); err == nil {
+			return nil
+		}
+	}
+	if !c.response.Committed() {
+		code, errString := http.StatusInternalServerError, err.Error()
+		if he, ok := err.(*HTTPError); ok {
+			code, errString = he.Code, he.Message
+		} else if isBodyTooLarge(err) {
+			code, errString = ErrBodyTooLarge.Code, ErrBodyTooLarge.Message
+		} else if isBindError(err) {
+			code = http.StatusBadRequest
+		}
+		if e := c.failureHandler(c, code, errString); e != nil {
+			Log.Error("%s", e.Error())
+		}
+	}
+	return err
+}
+
+// SetContextNewHook sets the hook called whenever the context pool allocates a new Context,
+// e.g. to attach per-object data by `Context.SetPoolData()` or to pre-allocate buffers.
+// The framework fields of the Context are still reset before and after every request,
+// while the pool data is kept for the life of the pooled object.
+func (this *App) SetContextNewHook(fn func(*Context)) {
+	this.ctxNewHook = fn
+}
+
+// SetRequestHook sets the hook called at the beginning of every request, before the default headers,
+// the routing and the middlewares, e.g. to start a timer or a span.
+func (this *App) SetRequestHook(fn func(*Context)) {
+	this.requestHook = fn
+}
+
+// SetResponseHook sets the hook called at the end of every request, also after a panic has been
+// recovered and the failure response is rendered, e.g. to record the status, the bytes written
+// and the latency, which includes the time of taking the Context from the pool and initializing it.
+// The Context is reset and put back to the pool after the hook returns, so it must not be kept.
+func (this *App) SetResponseHook(fn func(c *Context, latency time.Duration)) {
+	this.responseHook = fn
+}
+
+// SetMaxPathLength sets the max length of the decoded URL path,
+// longer requests are rejected with 414 before routing, n <= 0 means no limit.
+func (this *App) SetMaxPathLength(n int) {
+	this.maxPathLength = n
+}
+
+// SetMaxBodyBytes sets the max size of the request body, n <= 0 means no limit.
+// A request with a larger Content-Length is rejected with 413 before routing,
+// otherwise reading past the limit fails with `*http.MaxBytesError`,
+// which is responded with 413 if it is returned by the handler.
+func (this *App) SetMaxBodyBytes(n int64) {
+	this.maxBodyBytes = n
+}
+
+// isBindError reports whether err is returned by the default binder for a malformed request.
+func isBindError(err error) bool {
+	var errs BindErrors
+	var e *BindError
+	return errors.As(err, &errs) || errors.As(err, &e)
+}
+
+// isBodyTooLarge reports whether err is caused by reading past the body size limit.
+func isBodyTooLarge(err error) bool {
+	var e *http.MaxBytesError
+	return errors.As(err, &e)
+}
+
+// SetCaseInsensitiveRouting sets whether a path that can't be matched exactly is
+// matched case-insensitively, e.g. /Users/123 is handled by /users/:id.
+// The parameter values keep their original case. Disabled by default.
+func (this *App) SetCaseInsensitiveRouting(on bool) {
+	this.router.CaseInsensitive = on
+}
+
+// SetCleanPathRouting sets whether a path that can't be matched exactly is cleaned
+// before matching, e.g. //users//123 is handled by /users/:id. Disabled by default.
+func (this *App) SetCleanPathRouting(on bool) {
+	this.router.MatchCleanPath = on
+}
+
+// SetDefaultHeaders sets the headers applied to every response, e.g. `Server`, a build version
+// or the security headers. They are set before the middlewares and handlers run, which can
+// still override them. It replaces the headers set before, nil clears them.
+func (this *App) SetDefaultHeaders(headers map[string]string) {
+	list := make([][2]string, 0, len(headers))
+	for k, v := range headers {
+		list = append(list, [2]string{textproto.CanonicalMIMEHeaderKey(k), v})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i][0] < list[j][0] })
+	this.defaultHeaders = list
+}
+
+// SetDisablePooling enables or disables the Context pooling.
+// When disabled, every request allocates a fresh Context that is never reused, so a reference
+// held past the handler can not observe the data of another request; it costs an allocation
+// and more GC work per request, and is meant for debugging only.
+func (this *App) SetDisablePooling(disable bool) {
+	this.disablePooling = disable
+}
+
+// SetPoolPoisoning enables or disables the poisoning of the pooled Contexts, which takes effect
+// while the pooling is enabled: before a Context is put back to the pool, its request is replaced
+// by an empty one, and its Response and path params are replaced by new ones, while the old ones
+// are zeroed. So a reference held past the handler reads empty values, and its writes are discarded,
+// instead of reaching the data of the next request. It costs a few allocations per request,
+// and is meant for debugging only.
+func (this *App) SetPoolPoisoning(poison bool) {
+	this.poolPoisoning = poison
+}
+
+// SetDisableRecover enables or disables the recovery of the panics during the requests.
+// When disabled, a panic propagates to the server without the failure response and the panic hook,
+// after the Context is cleaned up and the response hook is called, e.g. to be handled by a recover
+// outside of `Handler()`; net/http logs it and closes the connection.
+func (this *App) SetDisableRecover(disable bool) {
+	this.disableRecover = disable
+}
+
+// SetDiscardSuperfluousWrites sets whether to discard the body written after a superfluous
+// WriteHeader on an error response, e.g. when a middleware has sent 403 and the handler
+// still responds 200 with its body, which would be appended to the error otherwise.
+// The superfluous WriteHeader itself is always ignored and logged with the position of the caller.
+func (this *App) SetDiscardSuperfluousWrites(discard bool) {
+	this.discardSuperfluousWrites = discard
+}
+
+// SetRequestIDGenerator sets the generator of the request IDs, which are assigned before the
+// session, the hooks and the middlewares, returned by `Context.RequestID()`, included in the logs
+// of the panics and the errors, and echoed in the X-Request-Id response header.
+// The default generator is a random prefix of the process followed by a counter;
+// nil restores it.
+func (this *App) SetRequestIDGenerator(fn func() string) {
+	if fn == nil {
+		fn = defaultRequestIDGenerator
+	}
+	this.requestIDGenerator = fn
+}
+
+// SetTrustRequestID sets whether to keep the X-Request-Id header sent by the client,
+// e.g. from a trusted gateway so that the logs of both sides are correlated, instead of
+// generating a new one. A header longer than 128 bytes or with non-printable characters is ignored.
+func (this *App) SetTrustRequestID(trust bool) {
+	this.trustRequestID = trust
+}
+
+// requestID returns the valid X-Request-Id of the client if trusted, or a new one.
+func (this *App) requestID(req *http.Request) string {
+	if this.trustRequestID {
+		if id := req.Header.Get(HeaderXRequestID); isValidRequestID(id) {
+			return id
+		}
+	}
+	return this.requestIDGenerator()
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	requestIDPrefix  = newTraceHexID(4) + "-"
+	requestIDCounter uint64
+)
+
+// defaultRequestIDGenerator returns the random prefix of the process followed by a counter,
+// which is unique, cheap, and sortable in a process.
+func defaultRequestIDGenerator() string {
+	return requestIDPrefix + strconv.FormatUint(atomic.AddUint64(&requestIDCounter, 1), 10)
+}
+
+// SetMissingHandlerStatus sets the status code responded by the routes registered
+// without a handler, e.g. an ApiHandler whose Handler is not set, 503 by default.
+func (this *App) SetMissingHandlerStatus(code int) {
+	this.missingHandlerStatus = code
+}
+
 // SetBinder registers a custom binder. It's invoked by `Context#Bind()`.
 func (this *App) SetBinder(b Binder) {
 	this.binder = b
 }
 
+// RegisterBinder registers the binder of the media type, e.g. "application/vnd.acme+json" or "text/csv",
+// which is used by `Context#Bind()` for the requests of the Content-Type in any parameters,
+// taking precedence over the group and the default binders. A nil b removes the binder of the media type.
+// It is safe to be called while serving, e.g. when the routes are reloaded.
+func (this *App) RegisterBinder(contentType string, b Binder) {
+	mediaType := bindMediaType(contentType)
+	this.updateBinders(func(r *binderRegistry) {
+		r.types = make(map[string]Binder, len(r.types)+1)
+		for k, v := range this.binderRegistry().types {
+			r.types[k] = v
+		}
+		if b == nil {
+			delete(r.types, mediaType)
+		} else {
+			r.types[mediaType] = b
+		}
+	})
+}
+
+// SetGroupBinder sets the binder of the routes under the path prefix, overriding the default one
+// set by SetBinder, like SetGroupFailureHandler; the binders registered by the media type still
+// take precedence. A nil b removes the binder of the prefix. It is safe to be called while serving.
+func (this *App) SetGroupBinder(prefix string, b Binder) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	this.updateBinders(func(r *binderRegistry) {
+		r.groups = make([]groupBinder, 0, len(r.groups)+1)
+		for _, g := range this.binderRegistry().groups {
+			if g.prefix != prefix {
+				r.groups = append(r.groups, g)
+			}
+		}
+		if b != nil {
+			r.groups = append(r.groups, groupBinder{prefix: prefix, binder: b})
+		}
+		sort.SliceStable(r.groups, func(i, j int) bool {
+			return len(r.groups[i].prefix) > len(r.groups[j].prefix)
+		})
+	})
+}
+
+// updateBinders replaces the binder registry by a copy modified by fn.
+func (this *App) updateBinders(fn func(*binderRegistry)) {
+	this.bindersLock.Lock()
+	defer this.bindersLock.Unlock()
+	r := *this.binderRegistry()
+	fn(&r)
+	this.binders.Store(&r)
+}
+
+// binderRegistry returns the current binder registry, which must not be modified.
+func (this *App) binderRegistry() *binderRegistry {
+	if r, _ := this.binders.Load().(*binderRegistry); r != nil {
+		return r
+	}
+	return &binderRegistry{}
+}
+
+// binderOf returns the binder of the request: the one of its media type, of its route group, or the default one.
+func (this *App) binderOf(c *Context) Binder {
+	r, _ := this.binders.Load().(*binderRegistry)
+	if r == nil {
+		return this.binder
+	}
+	if len(r.types) > 0 {
+		if ctype := c.request.Header.Get(HeaderContentType); ctype != "" {
+			if b, ok := r.types[bindMediaType(ctype)]; ok {
+				return b
+			}
+		}
+	}
+	for _, g := range r.groups {
+		if underPrefix(c.path, g.prefix) {
+			return g.binder
+		}
+	}
+	return this.binder
+}
+
+// bindMediaType returns the lower-case media type of the Content-Type without the parameters.
+func bindMediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
 // SetRenderer registers an HTML template renderer. It's invoked by `Context#Render()`.
 func (this *App) SetRenderer(r Renderer) {
 	this.renderer = r
@@ -321,6 +822,16 @@ func (this *App) RealRoutes() []Route {
 	return routes
 }
 
+// 返回指定请求方法与路径将匹配的真实路由(不执行处理)，用于测试与排查路由优先级，
+// 如通配路由是否覆盖了具体路由；不考虑末尾斜杠与大小写修正的重定向
+func (this *App) MatchRoute(method, path string) (Route, bool) {
+	pattern, ok := this.router.match(method, path)
+	if !ok {
+		return Route{}, false
+	}
+	return this.routes[method+pattern], true
+}
+
 // return the server status.
 func (this *App) IsClose() bool {
 	this.lock.RLock()
@@ -336,15 +847,56 @@ func (this *App) SetStatus(serving bool) {
 }
 
 // ServeHTTP implements `http.Handler` interface, which serves HTTP requests.
+// The app can be served by other servers through it with the same middlewares and pooling,
+// e.g. over HTTP/3 by `github.com/quic-go/quic-go/http3`, which is not bundled.
+// The HTTP/3 server can be advertised with the `Alt-Svc` header of SetDefaultHeaders,
+// which is set on the responses of every server, the HTTP and HTTPS servers started by `Run()`
+// as well as those serving the app through this method:
+//
+//	lessgo.SetDefaultHeaders(map[string]string{lessgo.HeaderAltSvc: `h3=":443"; ma=86400`})
+//	go (&http3.Server{Addr: ":443", Handler: lessgo.Handler()}).ListenAndServeTLS(certFile, keyFile)
+//
+// A request body left unread by the handler, e.g. when it rejects the request early, does not
+// corrupt the next request of the keep-alive connection: `net/http` discards up to 256KB of it
+// after the handler returns, and closes the connection after the response if there is more.
 func (this *App) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	var c = this.ctxPool.Get().(*Context)
-	var err error
+	start := time.Now()
+	atomic.AddInt64(&this.inflight, 1)
+	defer func() {
+		atomic.AddInt64(&this.inflight, -1)
+		atomic.AddInt64(&this.served, 1)
+	}()
 
+	var c *Context
+	// the last resort, for the panics of the hooks and the failure handler while recovering
 	defer func() {
+		if this.disableRecover {
+			return
+		}
 		if rcv := recover(); rcv != nil {
+			Log.Error("%s %s: [%s] while recovering\n%s", req.Method, req.URL.String(), color.Red("PANIC"), defaultPanicStackFunc(rcv))
+			if c == nil || !c.response.committed {
+				http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}
+	}()
+
+	if this.disablePooling {
+		c = this.ctxPool.New().(*Context)
+	} else {
+		c = this.ctxPool.Get().(*Context)
+	}
+	var err error
+
+	defer func() {
+		var rcv interface{}
+		if !this.disableRecover {
+			rcv = recover()
+		}
+		if rcv != nil {
 			errString := this.panicStackFunc(rcv)
 			if !c.response.Committed() {
-				err = this.failureHandler(c, 500, errString)
+				err = c.failureHandler(c, 500, errString)
 			}
 			var code string
 			if runtime.GOOS == "linux" {
@@ -352,105 +904,660 @@ func (this *App) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			} else {
 				code = color.Red(500)
 			}
-			Log.Error("%15s | %7s | %s | %s | [%s]\n%s",
+			source := c.stage
+			Log.Error("%15s | %7s | %s | %s | %s | [%s] in %s\n%s",
 				c.RealRemoteAddr(),
 				c.request.Method,
 				code,
 				c.request.URL.String(),
+				c.requestID,
 				color.Red("PANIC"),
+				source,
 				errString,
 			)
+			if this.panicHook != nil {
+				this.panicHook(c, rcv, source)
+			}
 		}
 
 		if err != nil {
-			Log.Error("%s", err.Error())
+			Log.Error("%s | %s", c.requestID, err.Error())
 		}
 
+		if this.responseHook != nil {
+			this.responseHook(c, time.Since(start))
+		}
+
+		if c.response.hijacked {
+			// the hijacker may keep using the Context and Response after the handler returns
+			c.freeSession()
+			return
+		}
+
+		c.response.writeTrailer()
+
+		if this.disablePooling {
+			// keep the data for the references held past the handler
+			c.freeSession()
+			return
+		}
 		c.free()
+		if this.poolPoisoning {
+			c.poison()
+		}
 		this.ctxPool.Put(c)
 	}()
 
-	if err = c.init(rw, req); err != nil {
+	if this.maxBodyBytes > 0 && req.Body != nil && req.Body != http.NoBody {
+		req.Body = http.MaxBytesReader(rw, req.Body, this.maxBodyBytes)
+	}
+	c.requestID = this.requestID(req)
+	rw.Header().Set(HeaderXRequestID, c.requestID)
+	err = c.init(rw, req)
+	c.response.discardSuperfluous = this.discardSuperfluousWrites
+	// set before the request hook, whose panic is rendered by it,
+	// the group failure handler is set when a route is matched
+	c.failureHandler = this.failureHandler
+	if this.requestHook != nil {
+		this.requestHook(c)
+	}
+	if err != nil {
 		return
 	}
 
+	if len(this.defaultHeaders) > 0 {
+		header := c.response.Header()
+		for _, kv := range this.defaultHeaders {
+			header[kv[0]] = []string{kv[1]}
+		}
+	}
+
 	if this.IsClose() {
 		err = this.failureHandler(c, 503, "Server is upgrading...")
 		return
 	}
 
+	// reject the pathological paths before routing
+	if this.maxPathLength > 0 && len(req.URL.Path) > this.maxPathLength {
+		err = this.handleError(c, ErrStatusRequestURITooLong)
+		return
+	}
+	if this.maxBodyBytes > 0 && req.ContentLength > this.maxBodyBytes {
+		err = this.handleError(c, ErrBodyTooLarge)
+		return
+	}
+
 	// Execute chain
 	if err = this.chainHandler(c); err != nil {
-		errString := err.Error()
-		if !c.response.Committed() {
-			err = this.failureHandler(c, 500, errString)
-		}
-		Log.Error("%s", errString)
+		err = this.handleError(c, err)
 		return
 	}
 }
 
+// InflightRequests returns the number of requests being served.
+func (this *App) InflightRequests() int {
+	return int(atomic.LoadInt64(&this.inflight))
+}
+
+// Stats returns the counters of the server, e.g. for a readiness probe or the drain logic.
+// The connections are counted only for the servers started by `Run()`.
+func (this *App) Stats() ServerStats {
+	return ServerStats{
+		OpenConnections: atomic.LoadInt64(&this.openConns),
+		ActiveRequests:  atomic.LoadInt64(&this.inflight),
+		TotalRequests:   atomic.LoadInt64(&this.served),
+	}
+}
+
+// SetKeepAlivesEnabled enables or disables the HTTP keep-alives of the running servers at runtime,
+// e.g. to rotate the connections while draining. The servers started later follow listen.DisableKeepAlive.
+func (this *App) SetKeepAlivesEnabled(enabled bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	for _, server := range this.servers {
+		server.SetKeepAlivesEnabled(enabled)
+	}
+}
+
+// SetConnStateHook sets the hook called when a client connection changes state,
+// see `http.Server.ConnState`. It must be set before the server starts.
+func (this *App) SetConnStateHook(fn func(net.Conn, http.ConnState)) {
+	this.connStateHook = fn
+}
+
+// connState counts the open connections, and calls the hook.
+func (this *App) connState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&this.openConns, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&this.openConns, -1)
+	}
+	if this.connStateHook != nil {
+		this.connStateHook(conn, state)
+	}
+}
+
+// reportDraining logs the number of in-flight requests every second after
+// the shutdown starts, until all of them are finished or done is closed.
+func (this *App) reportDraining(start, done <-chan struct{}) {
+	select {
+	case <-start:
+	case <-done:
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		n := this.InflightRequests()
+		if n == 0 {
+			Log.Sys("> all in-flight requests are finished")
+			return
+		}
+		Log.Sys("> draining: %d in-flight requests remaining", n)
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
 // Set the graceful exit or restart callback function.
 func (this *App) SetGraceExitFunc(fn func() error) {
 	this.graceExitCallback = fn
 }
 
-// Run starts the HTTP server.
-func (this *App) run(address, tlsAddress, tlsCertfile, tlsKeyfile string, readTimeout, writeTimeout int64) {
-	var err error
-	var endRunning = make(chan bool)
+// SetShutdownTimeout sets the time to wait for the in-flight requests
+// when the server is shut down by SIGINT or SIGTERM, one minute by default.
+func (this *App) SetShutdownTimeout(timeout time.Duration) {
+	this.shutdownTimeout = timeout
+}
+
+// Shutdown gracefully stops the running server: it stops accepting new connections at once,
+// then waits for the in-flight requests to finish, whose cleanup such as putting the Context
+// back to the pool still runs. If ctx is done first, the remaining connections are closed
+// and ctx.Err() is returned, e.g. context.DeadlineExceeded.
+// Concurrent and later calls wait for the first one and return its result.
+// It returns nil if the server is not running.
+func (this *App) Shutdown(ctx context.Context) error {
+	this.lock.RLock()
+	s, servers := this.shutdown, this.servers
+	this.lock.RUnlock()
+	if s == nil {
+		return nil
+	}
+	s.once.Do(func() {
+		close(s.start)
+		errs := make(chan error, len(servers))
+		for _, server := range servers {
+			go func(server *http.Server) {
+				err := server.Shutdown(ctx)
+				if err != nil {
+					server.Close()
+				}
+				errs <- err
+			}(server)
+		}
+		for range servers {
+			if err := <-errs; err != nil && s.err == nil {
+				s.err = err
+			}
+		}
+	})
+	return s.err
+}
+
+// Restart gracefully restarts the running server like SIGUSR2, e.g. after the binary is replaced:
+// it starts a new process with the same binary path, arguments and environment, which inherits
+// the listeners by the LISTEN_FDS environment variable and sends SIGTERM to this process once it
+// is serving; this process then stops accepting and drains the in-flight requests.
+// The graceful exit callback is called before, and the restart is canceled if it fails.
+// It returns the pid of the new process. It is not supported on Windows.
+func (this *App) Restart() (int, error) {
+	this.lock.RLock()
+	gnet := this.gnet
+	this.lock.RUnlock()
+	if gnet == nil {
+		return 0, errors.New("the server is not running")
+	}
+	if this.graceExitCallback != nil {
+		if err := this.graceExitCallback(); err != nil {
+			return 0, err
+		}
+	}
+	return gnet.StartProcess()
+}
+
+// shutdownOnSignal calls the graceful exit callback, then shuts down the server
+// within the shutdown timeout.
+func (this *App) shutdownOnSignal() {
+	if this.graceExitCallback != nil {
+		if err := this.graceExitCallback(); err != nil {
+			Log.Error("graceful exit callback: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), this.shutdownTimeout)
+	defer cancel()
+	this.Shutdown(ctx)
+}
+
+// run starts the HTTP server, and logs the error that made the server stop.
+func (this *App) run(listen Listen) {
+	err := this.serve(listen)
+	if err != nil {
+		if strings.Contains(err.Error(), "use of closed network connection") {
+			Log.Warn("stopped listening and serveing: %s", listen.Address)
+		} else {
+			Log.Fatal("%v", err)
+		}
+	}
+}
+
+// serve starts the HTTP server and blocks until it stops.
+// It is shut down gracefully by `Shutdown()` or SIGINT/SIGTERM, and restarted gracefully by SIGUSR2.
+func (this *App) serve(listen Listen) (err error) {
 	var mode string
 	if Config.Debug {
 		mode = "debug"
 	} else {
 		mode = "release"
 	}
-	go func() {
-		defer func() {
-			endRunning <- true
-		}()
-		var servers []*http.Server
-		if canTLS := tlsCertfile != "" && tlsKeyfile != ""; canTLS {
-			server := &http.Server{
-				Addr:         tlsAddress,
-				Handler:      this,
-				ReadTimeout:  time.Duration(readTimeout),
-				WriteTimeout: time.Duration(writeTimeout),
-			}
-			var cert tls.Certificate
-			cert, err = tls.LoadX509KeyPair(tlsCertfile, tlsKeyfile)
-			if err != nil {
-				err = fmt.Errorf("Grace-ListenAndServeTLS: %s %s %v", tlsCertfile, tlsKeyfile, err)
-				return
+	var (
+		servers   []*http.Server
+		specs     []Listen // the listen config of each server
+		reloaders []*certReloader
+	)
+	for _, listen := range append([]Listen{listen}, this.extraListens...) {
+		group, reloader, err := this.newServers(listen)
+		if err != nil {
+			return err
+		}
+		for range group {
+			specs = append(specs, listen)
+		}
+		servers = append(servers, group...)
+		if reloader != nil {
+			reloaders = append(reloaders, reloader)
+		}
+	}
+	if len(servers) == 0 {
+		return errors.New("Grace-ListenAndServe: no address to listen on")
+	}
+
+	// the listeners are inherited from the parent process after a graceful restart
+	gnet := new(gracenet.Net)
+	listeners := make([]net.Listener, 0, len(servers))
+	// the LISTEN_FDNAMES of the listeners of gnet, if any systemd socket is used
+	var (
+		fdNames []string
+		systemd bool
+		addrs   []net.Addr
+	)
+	for i, server := range servers {
+		var (
+			l    net.Listener
+			name string
+			err  error
+		)
+		spec := specs[i]
+		if spec.UseSystemdSocket {
+			name = spec.SystemdSocketName
+			if server.TLSConfig != nil {
+				name = spec.SystemdTLSSocketName
 			}
-			server.TLSConfig = &tls.Config{
-				Certificates:             []tls.Certificate{cert},
-				PreferServerCipherSuites: true,
+			l, name, err = listenSystemd(gnet, name)
+			systemd = true
+		} else {
+			l, err = listenNet(gnet, server.Addr, spec)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
 			}
-			servers = append(servers, server)
-			Log.Sys("> %s listen and serve gracefully HTTPS/HTTP2 on %v (%s-mode)", Config.AppName, tlsAddress, mode)
+			return fmt.Errorf("Grace-ListenAndServe: %v, %d", err, os.Getpid())
 		}
-		server := &http.Server{
-			Addr:         address,
-			Handler:      this,
-			ReadTimeout:  time.Duration(readTimeout),
-			WriteTimeout: time.Duration(writeTimeout),
+		addr := server.Addr
+		if spec.UseSystemdSocket || strings.HasSuffix(addr, ":0") {
+			addr = l.Addr().String()
 		}
-		servers = append(servers, server)
-		Log.Sys("> %s listen and serve gracefully HTTP/HTTP2 on %v (%s-mode)", Config.AppName, address, mode)
-		if err = gracehttp.ServeWithTerminateFunc(this.graceExitCallback, servers...); err != nil {
-			err = fmt.Errorf("Grace-ListenAndServe: %v, %d", err, os.Getpid())
+		addrs = append(addrs, l.Addr())
+		if spec.UseSystemdSocket || !spec.ReusePort || spec.Network == "unix" {
+			fdNames = append(fdNames, name)
+		}
+		if spec.AcceptProxyProtocol {
+			l = newProxyListener(l, time.Duration(spec.ProxyHeaderTimeout)*time.Second)
+		}
+		if server.TLSConfig != nil {
+			l = tls.NewListener(l, server.TLSConfig)
+			Log.Sys("> %s listen and serve gracefully HTTPS/HTTP2 on %v (%s-mode)", Config.AppName, addr, mode)
+		} else {
+			Log.Sys("> %s listen and serve gracefully HTTP/HTTP2 on %v (%s-mode)", Config.AppName, addr, mode)
 		}
+		listeners = append(listeners, l)
+	}
+
+	s := &shutdownState{start: make(chan struct{})}
+	this.lock.Lock()
+	this.servers, this.addrs, this.gnet, this.shutdown = servers, addrs, gnet, s
+	this.certReloaders = reloaders
+	this.lock.Unlock()
+	done := make(chan struct{})
+	reported := make(chan struct{})
+	go this.handleSignals(gnet, done)
+	go func() {
+		this.reportDraining(s.start, done)
+		close(reported)
 	}()
-	<-endRunning
 
-	if err != nil {
-		if strings.Contains(err.Error(), "use of closed network connection") {
-			Log.Warn("%v", "stopped listening and serveing: %s", address)
+	errs := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(server *http.Server, l net.Listener) {
+			errs <- server.Serve(l)
+		}(server, listeners[i])
+	}
+	if e := terminateParent(); e != nil {
+		Log.Error("failed to close parent: %v", e)
+	}
+	if systemd {
+		// for the new process of a graceful restart
+		setSystemdEnv(fdNames)
+	}
+	if this.onListen != nil {
+		for _, addr := range addrs {
+			this.onListen(addr)
+		}
+	}
+	for range servers {
+		if e := <-errs; e != http.ErrServerClosed && err == nil {
+			err = fmt.Errorf("Grace-ListenAndServe: %v, %d", e, os.Getpid())
+			// stop the other servers
+			go this.Shutdown(context.Background())
+		}
+	}
+	// Serve returns as soon as the shutdown starts, wait for it to finish
+	if e := this.Shutdown(context.Background()); e != nil {
+		Log.Warn("> %d in-flight requests were force-closed at the shutdown deadline", this.InflightRequests())
+	}
+	close(done)
+	<-reported
+	this.lock.Lock()
+	this.servers, this.addrs, this.gnet, this.shutdown = nil, nil, nil, nil
+	this.certReloaders = nil
+	this.lock.Unlock()
+	return
+}
+
+// ListenerAddrs returns the addresses of the running servers, HTTPS before HTTP and then
+// those added by `AddListen()`, e.g. the port picked by the kernel for the address ":0".
+// It returns nil if the server is not running.
+func (this *App) ListenerAddrs() []net.Addr {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return append([]net.Addr(nil), this.addrs...)
+}
+
+// ReloadTLS reloads the certificates of listen.HTTPSCertFile and HTTPSKeyFile of the running
+// HTTPS servers at once, e.g. from a SIGHUP handler after the certificates are renewed.
+// They are also reloaded on the TLS handshakes within a second after the files change.
+// If a certificate fails to load, the old one is kept serving and the first error is returned.
+// It returns nil if the server is not running.
+func (this *App) ReloadTLS() error {
+	this.lock.RLock()
+	reloaders := this.certReloaders
+	this.lock.RUnlock()
+	var err error
+	for _, r := range reloaders {
+		if e := r.Reload(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// SetOnListen sets the callback called with the address of every listener once the servers
+// are started and accept the connections, e.g. to register the service, or to wait for
+// the server in the tests without sleeping. It is called every time the server starts.
+func (this *App) SetOnListen(fn func(net.Addr)) {
+	this.onListen = fn
+}
+
+// AddListen adds another listen config served by `Run()` together with `Config.Listen`,
+// e.g. to serve the same routes on more addresses, which are shut down together.
+// The fields are used as they are, so copy `Config.Listen` to keep its defaults like ReadHeaderTimeout.
+// The HTTP server is started if Address is not empty, and the HTTPS server if EnableTLS is set.
+func (this *App) AddListen(listen Listen) {
+	this.extraListens = append(this.extraListens, listen)
+}
+
+// newServers creates the HTTPS server if listen.EnableTLS is set (with a certificate),
+// and the HTTP server if listen.Address is not empty.
+// The certificate files of the HTTPS server, if any, are reloaded by the returned reloader when they change.
+func (this *App) newServers(listen Listen) (servers []*http.Server, reloader *certReloader, err error) {
+	certFiles := listen.HTTPSCertFile != "" || listen.HTTPSKeyFile != ""
+	autoTLS := listen.EnableTLS && this.autoTLS != nil && !certFiles && !hasCertificate(this.tlsConfig)
+	if listen.EnableTLS && (listen.HTTPSCertFile != "" && listen.HTTPSKeyFile != "" || hasCertificate(this.tlsConfig) || autoTLS) {
+		server := this.newServer(listen.TLSAddress, listen)
+		base := this.tlsConfig
+		if autoTLS {
+			base = autoTLSConfig(base, this.autoTLS)
+		}
+		if server.TLSConfig, err = newTLSConfig(base, listen); err != nil {
+			return nil, nil, fmt.Errorf("Grace-ListenAndServeTLS: %v", err)
+		}
+		if certFiles {
+			reloader = newCertReloader(server.TLSConfig, listen.HTTPSCertFile, listen.HTTPSKeyFile)
+		}
+		servers = append(servers, server)
+	}
+	address := listen.Address
+	if address == "" && autoTLS && listen.Network != "unix" && !listen.UseSystemdSocket {
+		// for the HTTP-01 challenges
+		address = ":80"
+	}
+	if address != "" {
+		server := this.newServer(address, listen)
+		switch {
+		case this.httpHandlerWrapper != nil:
+			server.Handler = this.httpHandlerWrapper(this)
+		case autoTLS:
+			server.Handler = this.autoTLS.HTTPHandler(nil)
+		}
+		servers = append(servers, server)
+	}
+	return servers, reloader, nil
+}
+
+// listenNet listens on the address with listen.Network, "tcp" if empty.
+// For "unix", a stale socket file that no one is listening on is removed before,
+// and listen.SocketFileMode is applied after.
+// With listen.ReusePort, the TCP listener is not inherited after a graceful restart,
+// since the new process can listen on the same port itself.
+func listenNet(gnet *gracenet.Net, address string, listen Listen) (net.Listener, error) {
+	network := listen.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network != "unix" {
+		if listen.ReusePort {
+			lc := net.ListenConfig{Control: reusePortControl}
+			return lc.Listen(context.Background(), network, address)
+		}
+		return gnet.Listen(network, address)
+	}
+	var mode os.FileMode
+	if listen.SocketFileMode != "" {
+		m, err := strconv.ParseUint(listen.SocketFileMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket file mode: %s", listen.SocketFileMode)
+		}
+		mode = os.FileMode(m)
+	}
+	if _, err := os.Stat(address); err == nil {
+		if conn, err := net.Dial("unix", address); err == nil {
+			// in use, maybe inherited after a graceful restart
+			conn.Close()
 		} else {
-			Log.Fatal("%v", err)
+			os.Remove(address)
+		}
+	}
+	l, err := gnet.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err = os.Chmod(address, mode); err != nil {
+			l.Close()
+			return nil, err
 		}
 	}
+	return l, nil
+}
+
+// SetTLSConfig sets the base TLS config of the HTTPS server, e.g. to set MinVersion,
+// restrict CipherSuites or add NextProtos (ALPN). It is cloned when the server starts,
+// the certificate of listen.HTTPSCertFile and HTTPSKeyFile is appended to its Certificates
+// and reloaded when the files change (see ReloadTLS),
+// and listen.ClientAuth and ClientCAFile override its settings if they are set.
+// The HTTPS server is enabled by listen.EnableTLS with either the certificate files,
+// or the Certificates or GetCertificate of the config.
+func (this *App) SetTLSConfig(config *tls.Config) {
+	this.tlsConfig = config
+}
+
+// SetHTTPHandlerWrapper sets the function to wrap the handler of the HTTP server, the HTTPS server
+// is not affected, e.g. to serve the HTTP-01 challenges of another ACME client.
+// It takes precedence over the handler of SetAutoTLS.
+func (this *App) SetHTTPHandlerWrapper(fn func(http.Handler) http.Handler) {
+	this.httpHandlerWrapper = fn
+}
+
+// AutoTLSManager obtains the certificates automatically, which is implemented by `*autocert.Manager`
+// of `golang.org/x/crypto/acme/autocert`.
+type AutoTLSManager interface {
+	// TLSConfig returns the TLS config getting the certificates, with the ALPN protocol of the TLS-ALPN-01 challenges.
+	TLSConfig() *tls.Config
+	// HTTPHandler returns the handler of the HTTP-01 challenges, which passes the other requests
+	// to fallback, or redirects them to HTTPS if fallback is nil.
+	HTTPHandler(fallback http.Handler) http.Handler
+}
+
+// SetAutoTLS sets the manager to obtain the certificates of the HTTPS server automatically,
+// e.g. from Let's Encrypt, where the hosts allowed and the cache directory of the certificates
+// are set by the manager:
+//
+//	app.SetAutoTLS(&autocert.Manager{
+//		Prompt:     autocert.AcceptTOS,
+//		HostPolicy: autocert.HostWhitelist("example.com", "www.example.com"),
+//		Cache:      autocert.DirCache("certs"),
+//	})
+//
+// It is used by the servers with listen.EnableTLS but without a certificate of their own, i.e. neither
+// the certificate files nor the certificates of SetTLSConfig. Their HTTP server on listen.Address,
+// ":80" if empty, serves the HTTP-01 challenges and redirects the other requests to HTTPS.
+// It must be set before the server starts.
+func (this *App) SetAutoTLS(m AutoTLSManager) {
+	this.autoTLS = m
+}
+
+// autoTLSConfig returns a clone of base, which may be nil, getting the certificates from the manager.
+func autoTLSConfig(base *tls.Config, m AutoTLSManager) *tls.Config {
+	mc := m.TLSConfig()
+	if base == nil {
+		return mc
+	}
+	c := base.Clone()
+	c.GetCertificate = mc.GetCertificate
+	if len(c.NextProtos) == 0 {
+		c.NextProtos = []string{"h2", "http/1.1"}
+	}
+next:
+	for _, p := range mc.NextProtos {
+		for _, q := range c.NextProtos {
+			if p == q {
+				continue next
+			}
+		}
+		c.NextProtos = append(c.NextProtos, p)
+	}
+	return c
+}
+
+// hasCertificate reports whether the TLS config provides the server certificate itself.
+func hasCertificate(config *tls.Config) bool {
+	return config != nil && (len(config.Certificates) > 0 || config.GetCertificate != nil || config.GetConfigForClient != nil)
+}
+
+// newTLSConfig creates the TLS config of the HTTPS server from a clone of base, which may be nil,
+// client certificates are requested and verified according to listen.ClientAuth.
+func newTLSConfig(base *tls.Config, listen Listen) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if base != nil {
+		tlsConfig = base.Clone()
+	} else {
+		tlsConfig = &tls.Config{PreferServerCipherSuites: true}
+	}
+	if listen.HTTPSCertFile != "" || listen.HTTPSKeyFile != "" || !hasCertificate(base) {
+		cert, err := tls.LoadX509KeyPair(listen.HTTPSCertFile, listen.HTTPSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s %v", listen.HTTPSCertFile, listen.HTTPSKeyFile, err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	switch strings.ToLower(listen.ClientAuth) {
+	case "":
+	case "request":
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	case "verify_if_given":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require_and_verify":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client auth type: %s", listen.ClientAuth)
+	}
+	if listen.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(listen.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in client CA file: %s", listen.ClientCAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// newServer creates a http.Server which serves the app on the address.
+// With listen.EnableH2C, the HTTP/2 requests with prior knowledge are served without TLS as well,
+// the handlers can tell them apart by `Request.ProtoMajor`.
+// The `Upgrade: h2c` requests are served over HTTP/1.1, since the upgrade is deprecated by RFC 9113.
+func (this *App) newServer(address string, listen Listen) *http.Server {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           this,
+		ReadTimeout:       time.Duration(listen.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(listen.WriteTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(listen.ReadHeaderTimeout) * time.Second,
+		IdleTimeout:       time.Duration(listen.IdleTimeout) * time.Second,
+		MaxHeaderBytes:    int(listen.MaxHeaderBytes),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, conn)
+		},
+		ConnState: this.connState,
+	}
+	if listen.DisableKeepAlive {
+		server.SetKeepAlivesEnabled(false)
+	}
+	if listen.EnableH2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return server
 }
 
 // set files cache
@@ -513,7 +1620,41 @@ func (this *App) resetRouterEnd() {
 func (this *App) resetChain() {
 	this.chainHandler = chainEndHandler
 	for i := len(this.chainNodes) - 1; i >= 0; i-- {
-		this.chainHandler = this.chainNodes[i](this.chainHandler)
+		this.chainHandler = chainMiddleware(this.chainNodes[i], this.chainHandler)
+	}
+}
+
+// chainMiddleware applies the middleware to next, so that next is skipped once the Context
+// has been aborted and the middleware is recorded as the stage of the chain while it is running.
+func chainMiddleware(middleware MiddlewareFunc, next HandlerFunc) HandlerFunc {
+	return namedMiddleware(funcName(middleware), middleware)(abortable(next))
+}
+
+// namedMiddleware wraps the middleware to record it by name as the stage of the chain
+// while it is running, so that a panic can be traced back to it.
+func namedMiddleware(name string, middleware MiddlewareFunc) MiddlewareFunc {
+	stage := PanicSource{Kind: PanicInMiddleware, Name: name}
+	return func(next HandlerFunc) HandlerFunc {
+		h := middleware(func(c *Context) error {
+			err := next(c)
+			c.stage = stage
+			return err
+		})
+		return func(c *Context) error {
+			c.stage = stage
+			return h(c)
+		}
+	}
+}
+
+// abortable wraps next so that it is skipped once the Context has been aborted,
+// even if the calling middleware ignores `Context.IsAborted()`.
+func abortable(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		if c.aborted {
+			return nil
+		}
+		return next(c)
 	}
 }
 
@@ -576,13 +1717,27 @@ func (this *App) add(method, path string, handler HandlerFunc, middleware ...Mid
 
 func (this *App) addwithlog(logprint bool, method, path string, handler HandlerFunc, middleware ...MiddlewareFunc) {
 	path = joinpath(path, "")
+	if handler == nil {
+		handler = this.missingHandler(method, path)
+	}
 	name := handlerName(handler)
 	// Chain middleware
-	h := handler
+	stage := PanicSource{Kind: PanicInHandler, Name: name}
+	h := HandlerFunc(func(c *Context) error {
+		c.stage = stage
+		return handler(c)
+	})
 	for i := len(middleware) - 1; i >= 0; i-- {
-		h = middleware[i](h)
+		h = chainMiddleware(middleware[i], h)
 	}
-	this.router.Handle(method, path, h)
+	route := path
+	this.router.Handle(method, path, func(c *Context) error {
+		c.path = route
+		if len(this.groupFailures) > 0 {
+			c.failureHandler = this.failureHandlerOf(route)
+		}
+		return h(c)
+	})
 
 	this.routes[method+path] = Route{
 		Method:  method,
@@ -595,6 +1750,16 @@ func (this *App) addwithlog(logprint bool, method, path string, handler HandlerF
 	}
 }
 
+// missingHandler returns the handler of a route registered without a handler,
+// which makes the misconfiguration visible to callers instead of responding an empty 200.
+func (this *App) missingHandler(method, path string) HandlerFunc {
+	Log.Warn("| %7s | %-30s | handler not set", method, path)
+	return func(c *Context) error {
+		Log.Error("| %7s | %-30s | handler not set", method, path)
+		return NewHTTPError(this.missingHandlerStatus, "handler not set")
+	}
+}
+
 // uri generates a uri from handler.
 func (this *App) uri(handler HandlerFunc, params ...interface{}) string {
 	uri := new(bytes.Buffer)
@@ -651,8 +1816,9 @@ func (this *App) putContext(c *Context) {
 
 // HTTPError represents an error that occured while handling a request.
 type HTTPError struct {
-	Code    int
-	Message string
+	Code     int
+	Message  string
+	internal error // the cause returned by Unwrap, e.g. `BindErrors`
 }
 
 // NewHTTPError creates a new HTTPError instancthis.
@@ -670,6 +1836,11 @@ func (this *HTTPError) Error() string {
 	return this.Message
 }
 
+// Unwrap returns the cause of the error, if any, for `errors.As`.
+func (this *HTTPError) Unwrap() error {
+	return this.internal
+}
+
 func wrapMiddlewares(middleware []interface{}) []MiddlewareFunc {
 	ms := make([]MiddlewareFunc, len(middleware))
 	for i, m := range middleware {
@@ -679,6 +1850,10 @@ func wrapMiddlewares(middleware []interface{}) []MiddlewareFunc {
 }
 
 func handlerName(h HandlerFunc) string {
+	return funcName(h)
+}
+
+func funcName(h interface{}) string {
 	v := reflect.ValueOf(h)
 	t := v.Type()
 	if t.Kind() == reflect.Func {
@@ -0,0 +1,4524 @@
+package lessgo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/grace/gracenet"
+	"github.com/henrylee2cn/lessgo/logs"
+	"github.com/henrylee2cn/lessgo/websocket"
+)
+
+func TestReadHeaderTimeout(t *testing.T) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = app.newServer("", Listen{ReadHeaderTimeout: 1})
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// dribble the headers slowly and never finish them
+	if _, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection with slow headers was not cut off")
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("connection cut off after %v, want about 1s", d)
+	}
+}
+
+func TestHTTP10ConnectionClose(t *testing.T) {
+	app.SetStatus(true)
+	ts := httptest.NewServer(app)
+	defer ts.Close()
+
+	cases := []struct {
+		request   string
+		keepAlive bool
+	}{
+		{"GET / HTTP/1.0\r\nHost: localhost\r\n\r\n", false},
+		{"GET / HTTP/1.0\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n", true},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", true},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Write([]byte(tc.request)); err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		// http.ReadResponse turns "Connection: close" into resp.Close
+		if resp.Close == tc.keepAlive {
+			t.Errorf("%q: response Connection: close = %v", tc.request, resp.Close)
+		}
+		// the server must close non persistent connections after the response
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, err = br.ReadByte()
+		closed := err == io.EOF
+		if closed == tc.keepAlive {
+			t.Errorf("%q: connection closed = %v, err = %v", tc.request, closed, err)
+		}
+		conn.Close()
+	}
+}
+
+// newTestCert creates a certificate signed by parent (self-signed if parent is nil).
+func newTestCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return cert, key, certPEM, keyPEM
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lessgo-mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, caPEM, _ := newTestCert(t, "test-ca", true, nil, nil)
+	_, _, serverPEM, serverKeyPEM := newTestCert(t, "127.0.0.1", false, nil, nil)
+	_, _, clientPEM, clientKeyPEM := newTestCert(t, "service-a", false, ca, caKey)
+	_, _, strangerPEM, strangerKeyPEM := newTestCert(t, "stranger", false, nil, nil)
+	for name, b := range map[string][]byte{"ca.pem": caPEM, "server.pem": serverPEM, "server.key": serverKeyPEM} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listen := Listen{
+		HTTPSCertFile: filepath.Join(dir, "server.pem"),
+		HTTPSKeyFile:  filepath.Join(dir, "server.key"),
+		ClientAuth:    "require_and_verify",
+		ClientCAFile:  filepath.Join(dir, "ca.pem"),
+	}
+	tlsConfig, err := newTLSConfig(nil, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c := app.newContext(new(Response), req)
+		c.init(rw, req)
+		defer c.free()
+		if c.TLSState() == nil || !c.TLSState().HandshakeComplete {
+			c.NoContent(http.StatusInternalServerError)
+			return
+		}
+		certs := c.ClientCertificates()
+		if len(certs) == 0 || c.VerifiedClientCertificate() != certs[0] {
+			c.NoContent(http.StatusUnauthorized)
+			return
+		}
+		c.String(http.StatusOK, c.VerifiedClientCertificate().Subject.CommonName)
+	}))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverPEM)
+	get := func(certPEM, keyPEM []byte) (string, error) {
+		clientTLS := &tls.Config{RootCAs: roots}
+		if certPEM != nil {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientTLS.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	if cn, err := get(clientPEM, clientKeyPEM); err != nil || cn != "service-a" {
+		t.Errorf("trusted client cert: got %q, %v, want %q", cn, err, "service-a")
+	}
+	if _, err := get(strangerPEM, strangerKeyPEM); err == nil {
+		t.Error("client cert not signed by the CA was accepted")
+	}
+	if _, err := get(nil, nil); err == nil {
+		t.Error("request without client cert was accepted")
+	}
+}
+
+func TestMaxPathLength(t *testing.T) {
+	app.SetStatus(true)
+	app.SetMaxPathLength(1024)
+	defer app.SetMaxPathLength(0)
+
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, httptest.NewRequest("GET", "/"+strings.Repeat("a/", 64<<10), nil))
+	if rec.Code != http.StatusRequestURITooLong {
+		t.Errorf("long path: got status %d, want %d", rec.Code, http.StatusRequestURITooLong)
+	}
+
+	rec = httptest.NewRecorder()
+	app.ServeHTTP(rec, httptest.NewRequest("GET", "/"+strings.Repeat("a", 1023), nil))
+	if rec.Code == http.StatusRequestURITooLong {
+		t.Errorf("path within the limit was rejected")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	var calls []string
+	// a careless middleware that writes the response but still calls next
+	guard := func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			calls = append(calls, "guard")
+			if c.QueryParam("deny") != "" {
+				c.Abort()
+				c.String(http.StatusForbidden, "denied")
+			}
+			return next(c)
+		}
+	}
+	logger := func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			calls = append(calls, "logger")
+			return next(c)
+		}
+	}
+	a.addwithlog(false, GET, "/abort-test", func(c *Context) error {
+		calls = append(calls, "handler")
+		return c.String(http.StatusOK, "ok")
+	}, guard, logger)
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		body  string
+		calls string
+	}{
+		{"", http.StatusOK, "ok", "guard logger handler"},
+		{"?deny=1", http.StatusForbidden, "denied", "guard"},
+		{"", http.StatusOK, "ok", "guard logger handler"}, // the pooled context is reset
+	} {
+		calls = nil
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, "/abort-test"+tc.query, nil))
+		if rec.Code != tc.code || rec.Body.String() != tc.body {
+			t.Errorf("%q: got %d %q, want %d %q", tc.query, rec.Code, rec.Body.String(), tc.code, tc.body)
+		}
+		if got := strings.Join(calls, " "); got != tc.calls {
+			t.Errorf("%q: executed %q, want %q", tc.query, got, tc.calls)
+		}
+	}
+}
+
+func TestMissingHandler(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/no-handler", nil)
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/no-handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	a.SetMissingHandlerStatus(http.StatusNotImplemented)
+	resp, err = http.Get(srv.URL + "/no-handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("configured status: got %d, want %d", resp.StatusCode, http.StatusNotImplemented)
+	}
+}
+
+func TestDisablePooling(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	var held []*Context
+	a.addwithlog(false, GET, "/pool/:id", func(c *Context) error {
+		held = append(held, c)
+		return c.NoContent(http.StatusOK)
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	a.SetDisablePooling(true)
+
+	for _, id := range []string{"1", "2"} {
+		a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, "/pool/"+id, nil))
+	}
+	if held[0] == held[1] {
+		t.Fatal("the Context was reused with pooling disabled")
+	}
+	if id := held[0].PathParam("id"); id != "1" {
+		t.Errorf("held Context: got id %q, want %q", id, "1")
+	}
+}
+
+func TestPoolPoisoning(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	var (
+		held      []*Context
+		responses []*Response
+		params    [][]string
+	)
+	a.addwithlog(false, GET, "/pool/:id", func(c *Context) error {
+		held = append(held, c)
+		responses = append(responses, c.Response())
+		params = append(params, c.PathParamValues())
+		c.Response().Header().Set("X-Id", c.PathParam("id"))
+		return c.String(http.StatusOK, c.PathParam("id"))
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	a.SetPoolPoisoning(true)
+
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, "/pool/1?q=secret", nil))
+	// the stale reads after the Context is put back are empty, instead of panicking
+	c := held[0]
+	if c.PathParam("id") != "" || c.QueryParam("q") != "" || c.Request().Header.Get("Host") != "" {
+		t.Errorf("stale Context: got id %q, q %q", c.PathParam("id"), c.QueryParam("q"))
+	}
+	if r := responses[0]; r.Status() != 0 || r.Size() != 0 || r.Header().Get("X-Id") != "" {
+		t.Errorf("stale Response: got %d, %d bytes, X-Id %q", r.Status(), r.Size(), r.Header().Get("X-Id"))
+	}
+	if _, err := responses[0].Write([]byte("late")); err == nil {
+		t.Error("stale Response: the write succeeded")
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(GET, "/pool/2", nil))
+	if rec.Body.String() != "2" || rec.Header().Get("X-Id") != "2" {
+		t.Fatalf("got %q, X-Id %q", rec.Body.String(), rec.Header().Get("X-Id"))
+	}
+	// the next request can not be reached through the old Response and params
+	if responses[0] == responses[1] || responses[0].Size() != 0 {
+		t.Error("the Response was reused")
+	}
+	if len(params[0]) != 1 || params[0][0] != "" {
+		t.Errorf("stale params: got %q", params[0])
+	}
+}
+
+func testPanicAuth(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		if c.QueryParam("deny") != "" {
+			panic("auth failed")
+		}
+		return next(c)
+	}
+}
+
+func testPanicLogger(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		err := next(c)
+		if c.QueryParam("after") != "" {
+			panic("logger failed")
+		}
+		return err
+	}
+}
+
+func testPanicHandler(c *Context) error {
+	if c.QueryParam("handler") != "" {
+		panic("handler failed")
+	}
+	return c.String(http.StatusOK, "ok")
+}
+
+func TestPanicSource(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/panic", testPanicHandler, testPanicLogger, testPanicAuth)
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	var source PanicSource
+	a.SetPanicHook(func(c *Context, rcv interface{}, s PanicSource) {
+		source = s
+	})
+
+	for _, tc := range []struct {
+		query string
+		kind  string
+		name  string
+		code  int
+	}{
+		{"?deny=1", PanicInMiddleware, "testPanicAuth", http.StatusInternalServerError},
+		{"?handler=1", PanicInHandler, "testPanicHandler", http.StatusInternalServerError},
+		{"?after=1", PanicInMiddleware, "testPanicLogger", http.StatusOK}, // after the response is written
+		{"", "", "", http.StatusOK},
+	} {
+		source = PanicSource{}
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, "/panic"+tc.query, nil))
+		if source.Kind != tc.kind || !strings.HasSuffix(source.Name, tc.name) {
+			t.Errorf("%q: got source %q, want %s %s", tc.query, source, tc.kind, tc.name)
+		}
+		if rec.Code != tc.code {
+			t.Errorf("%q: got status %d, want %d", tc.query, rec.Code, tc.code)
+		}
+	}
+}
+
+func TestUnreadBodyKeepAlive(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, POST, "/reject", func(c *Context) error {
+		// reject before reading the body
+		return c.NoContent(http.StatusUnauthorized)
+	})
+	a.addwithlog(false, GET, "/next", func(c *Context) error {
+		return c.String(http.StatusOK, "next")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		size      int
+		keepAlive bool
+	}{
+		{100 << 10, true},
+		{4 << 20, false}, // too large to drain, the connection is closed
+	} {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(conn)
+		go func() {
+			io.WriteString(conn, "POST /reject HTTP/1.1\r\nHost: test\r\nContent-Type: text/plain\r\n")
+			io.WriteString(conn, "Content-Length: "+strconv.Itoa(tc.size)+"\r\n\r\n")
+			conn.Write([]byte(strings.Repeat("x", tc.size)))
+		}()
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%d: %v", tc.size, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%d: got status %d", tc.size, resp.StatusCode)
+		}
+		if resp.Close == tc.keepAlive {
+			t.Errorf("%d: got Connection close %v, want %v", tc.size, resp.Close, !tc.keepAlive)
+		}
+		if !tc.keepAlive {
+			conn.Close()
+			continue
+		}
+
+		// the next request on the same connection is not corrupted by the unread body
+		io.WriteString(conn, "GET /next HTTP/1.1\r\nHost: test\r\n\r\n")
+		resp, err = http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%d: second request: %v", tc.size, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != "next" {
+			t.Errorf("%d: second request: got %d %q", tc.size, resp.StatusCode, b)
+		}
+		conn.Close()
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	for _, path := range []string{"/users/:id", "/users/:id/posts", "/files/*filepath", "/about", "/about/team"} {
+		a.addwithlog(false, GET, path, func(c *Context) error { return nil })
+	}
+	a.resetRouterEnd()
+
+	for _, tc := range []struct {
+		method, path string
+		route        string
+	}{
+		{GET, "/users/42", "/users/:id"},
+		{GET, "/users/new", "/users/:id"},
+		{GET, "/users/42/posts", "/users/:id/posts"},
+		{GET, "/files/a/b.txt", "/files/*filepath"},
+		{GET, "/about", "/about"},
+		{GET, "/about/team", "/about/team"},
+		{GET, "/users/42/", ""}, // only a trailing slash redirect
+		{POST, "/users/42", ""},
+		{GET, "/nothing", ""},
+	} {
+		r, ok := a.MatchRoute(tc.method, tc.path)
+		if ok != (tc.route != "") || r.Path != tc.route {
+			t.Errorf("%s %s: got %q %v, want %q", tc.method, tc.path, r.Path, ok, tc.route)
+		}
+		if ok && r.Method != tc.method {
+			t.Errorf("%s %s: got method %s", tc.method, tc.path, r.Method)
+		}
+	}
+}
+
+func TestGroupFailureHandler(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	fail := func(c *Context) error {
+		return NewHTTPError(http.StatusBadRequest, "bad")
+	}
+	for _, path := range []string{"/api/users", "/api/v2/users", "/apix", "/admin/panel", "/home"} {
+		a.addwithlog(false, GET, path, fail)
+	}
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	a.SetFailureHandler(func(c *Context, code int, errString string) error {
+		return c.String(code, "default:"+errString)
+	})
+	a.SetGroupFailureHandler("/api", func(c *Context, code int, errString string) error {
+		return c.String(code, "api:"+errString)
+	})
+	a.SetGroupFailureHandler("/api/v2/", func(c *Context, code int, errString string) error {
+		return c.String(code, "v2:"+errString)
+	})
+	a.SetGroupFailureHandler("/admin", func(c *Context, code int, errString string) error {
+		return c.String(code, "admin:"+errString)
+	})
+
+	for _, tc := range []struct {
+		path string
+		body string
+	}{
+		{"/api/users", "api:bad"},
+		{"/api/v2/users", "v2:bad"},
+		{"/apix", "default:bad"},
+		{"/admin/panel", "admin:bad"},
+		{"/home", "default:bad"},
+		{"/api/missing", "default:"}, // no route matched
+		{"/admin/panel", "admin:bad"},
+	} {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, tc.path, nil))
+		if rec.Body.String() != tc.body {
+			t.Errorf("%s: got %q, want %q", tc.path, rec.Body.String(), tc.body)
+		}
+	}
+
+	a.SetGroupFailureHandler("/api/v2", nil)
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(GET, "/api/v2/users", nil))
+	if rec.Body.String() != "api:bad" {
+		t.Errorf("removed handler: got %q", rec.Body.String())
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/page", func(c *Context) error {
+		if err := c.EarlyHints("</app.css>; rel=preload; as=style", "/app.js"); err != nil {
+			return err
+		}
+		if err := c.String(http.StatusOK, "page"); err != nil {
+			return err
+		}
+		if err := c.EarlyHints("/late.js"); err != ErrResponseCommitted {
+			t.Errorf("after the final response: got %v, want %v", err, ErrResponseCommitted)
+		}
+		return nil
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	var hints []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header["Link"]...)
+			}
+			return nil
+		},
+	}
+	req, _ := http.NewRequest(GET, srv.URL+"/page", nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "page" {
+		t.Errorf("final response: got %d %q", resp.StatusCode, b)
+	}
+	want := "</app.css>; rel=preload; as=style,</app.js>; rel=preload"
+	if got := strings.Join(hints, ","); got != want {
+		t.Errorf("got hints %q, want %q", got, want)
+	}
+}
+
+// testMiddleware returns the middleware function of m with the JSON config, or the default config if empty.
+func testMiddleware(t *testing.T, m *ApiMiddleware, config string) MiddlewareFunc {
+	mw, err := m.regetFunc([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mw
+}
+
+func TestEarlyHintsCompress(t *testing.T) {
+	text := strings.Repeat("hello world ", 1000)
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/page", func(c *Context) error {
+		if err := c.EarlyHints("/app.js"); err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, text)
+	}, testMiddleware(t, Compress, ""))
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	var hints int
+	req, _ := http.NewRequest(GET, srv.URL+"/page", nil)
+	req.Header.Set(HeaderAcceptEncoding, "gzip")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			hints++
+			return nil
+		},
+	}))
+	// the transport would decompress the body transparently
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if hints != 1 || resp.Header.Get(HeaderContentEncoding) != "gzip" {
+		t.Fatalf("got %d hints, Content-Encoding %q", hints, resp.Header.Get(HeaderContentEncoding))
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(zr); string(b) != text {
+		t.Errorf("got %d bytes, want %d", len(b), len(text))
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		accept    string
+		encodings []string
+		want      string
+	}{
+		{"gzip, deflate", []string{"gzip", "deflate"}, "gzip"},
+		{"deflate;q=1, gzip;q=0.5", []string{"gzip", "deflate"}, "deflate"},
+		{"GZIP", []string{"gzip", "deflate"}, "gzip"},
+		{"gzip;q=0", []string{"gzip", "deflate"}, ""},
+		{"*", []string{"gzip", "deflate"}, "gzip"},
+		{"*;q=0.1, deflate", []string{"gzip", "deflate"}, "deflate"},
+		{"", []string{"gzip", "deflate"}, ""},
+		{"br;q=1, gzip;q=0.8", []string{"br", "gzip"}, "br"},
+		{"gzip, br", []string{"br", "gzip"}, "br"}, // the same quality, in the order enabled
+		{"gzip", []string{"br", "gzip"}, "gzip"},   // falls back to gzip
+		{"br;q=0, gzip", []string{"br", "gzip"}, "gzip"},
+	} {
+		if got := negotiateEncoding(tc.accept, tc.encodings); got != tc.want {
+			t.Errorf("%q of %v: got %q, want %q", tc.accept, tc.encodings, got, tc.want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	// a stand-in of a third-party Brotli compressor
+	RegisterCompressor("br", 4, func(w io.Writer, level int) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	})
+	defer func() {
+		compressorsLock.Lock()
+		delete(compressors, "br")
+		delete(defaultCompressLevels, "br")
+		compressorsLock.Unlock()
+	}()
+	text := strings.Repeat("hello world ", 100)
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/br", func(c *Context) error {
+		return c.String(http.StatusOK, text)
+	}, testMiddleware(t, Compress, `{"encodings":["br","gzip"],"levels":{"gzip":1}}`))
+	a.addwithlog(false, GET, "/default", func(c *Context) error {
+		return c.String(http.StatusOK, text)
+	}, testMiddleware(t, Compress, ""))
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for _, tc := range []struct {
+		path, accept, encoding string
+	}{
+		{"/br", "br, gzip", "br"},
+		{"/br", "gzip;q=1, br;q=0.5", "gzip"},
+		{"/br", "gzip", "gzip"},
+		{"/br", "identity", ""},
+		{"/default", "br", ""}, // br is not enabled by default
+		{"/default", "br;q=1, gzip;q=0.5", "gzip"},
+	} {
+		req := httptest.NewRequest(GET, tc.path, nil)
+		req.Header.Set(HeaderAcceptEncoding, tc.accept)
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		if got := rec.Header().Get(HeaderContentEncoding); got != tc.encoding {
+			t.Errorf("%s %q: got Content-Encoding %q, want %q", tc.path, tc.accept, got, tc.encoding)
+		}
+		if vary := rec.Header().Get(HeaderVary); vary != HeaderAcceptEncoding {
+			t.Errorf("%s %q: got Vary %q", tc.path, tc.accept, vary)
+		}
+		body := rec.Body.Bytes()
+		if tc.encoding != "" {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("%s %q: %v", tc.path, tc.accept, err)
+			}
+			body, _ = ioutil.ReadAll(zr)
+		}
+		if string(body) != text {
+			t.Errorf("%s %q: got %d bytes, want %d", tc.path, tc.accept, len(body), len(text))
+		}
+	}
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/default", func(c *Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	a.addwithlog(false, GET, "/override", func(c *Context) error {
+		c.SetHeader(HeaderServer, "custom")
+		return c.String(http.StatusOK, "ok")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	a.SetDefaultHeaders(map[string]string{"server": "lessgo", "X-App-Version": "1.2.3"})
+
+	for path, server := range map[string]string{"/default": "lessgo", "/override": "custom", "/missing": "lessgo"} {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, path, nil))
+		if got := rec.Header().Get(HeaderServer); got != server {
+			t.Errorf("%s: got Server %q, want %q", path, got, server)
+		}
+		if got := rec.Header().Get("X-App-Version"); got != "1.2.3" {
+			t.Errorf("%s: got X-App-Version %q", path, got)
+		}
+	}
+
+	a.SetDefaultHeaders(nil)
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(GET, "/default", nil))
+	if got := rec.Header().Get(HeaderServer); got != "" {
+		t.Errorf("cleared: got Server %q", got)
+	}
+}
+
+func TestAltSvc(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/page", func(c *Context) error {
+		return c.String(http.StatusOK, "page")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	altSvc := `h3=":443"; ma=86400`
+	a.SetDefaultHeaders(map[string]string{HeaderAltSvc: altSvc})
+
+	// the plain HTTP server started by serve(), and another HTTPS server serving the app as the handler
+	addr, _ := serveTestApp(t, a)
+	ts := httptest.NewTLSServer(a)
+	defer ts.Close()
+	for url, client := range map[string]*http.Client{
+		"http://" + addr + "/page": http.DefaultClient,
+		ts.URL + "/page":           ts.Client(),
+		ts.URL + "/missing":        ts.Client(),
+	} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get(HeaderAltSvc); got != altSvc {
+			t.Errorf("%s: got Alt-Svc %q, want %q", url, got, altSvc)
+		}
+	}
+	http.DefaultClient.CloseIdleConnections()
+}
+
+func TestRoutingNormalization(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/users/:id", func(c *Context) error {
+		return c.String(http.StatusOK, c.PathParam("id"))
+	})
+	a.addwithlog(false, GET, "/about/team", func(c *Context) error {
+		return c.String(http.StatusOK, "team")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	a.router.RedirectTrailingSlash = false
+	a.router.RedirectFixedPath = false
+
+	cases := []struct {
+		path      string
+		ci, clean bool
+		code      int
+		body      string
+	}{
+		{"/users/AbC", false, false, http.StatusOK, "AbC"},
+		{"/Users/AbC", false, false, http.StatusNotFound, ""},
+		{"/Users/AbC", true, false, http.StatusOK, "AbC"},
+		{"/USERS/123", true, false, http.StatusOK, "123"},
+		{"/About/TEAM", true, false, http.StatusOK, "team"},
+		{"//users//42", false, false, http.StatusNotFound, ""},
+		{"//users//42", false, true, http.StatusOK, "42"},
+		{"/about/../users/7", false, true, http.StatusOK, "7"},
+		{"//Users/x/../Mixed", true, true, http.StatusOK, "Mixed"},
+		{"//Users/42", false, true, http.StatusNotFound, ""},
+	}
+	for _, tc := range cases {
+		a.SetCaseInsensitiveRouting(tc.ci)
+		a.SetCleanPathRouting(tc.clean)
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, tc.path, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s (ci=%v clean=%v): got code %d, want %d", tc.path, tc.ci, tc.clean, rec.Code, tc.code)
+			continue
+		}
+		if tc.body != "" && rec.Body.String() != tc.body {
+			t.Errorf("%s (ci=%v clean=%v): got body %q, want %q", tc.path, tc.ci, tc.clean, rec.Body.String(), tc.body)
+		}
+	}
+
+	a.SetCaseInsensitiveRouting(true)
+	if r, ok := a.MatchRoute(GET, "/USERS/1"); !ok || r.Path != "/users/:id" {
+		t.Errorf("MatchRoute: got %v %v", r.Path, ok)
+	}
+}
+
+func TestResponseFirstByteTime(t *testing.T) {
+	var start, firstByte, end time.Time
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/stream", func(c *Context) error {
+		start = time.Now()
+		if !c.Response().FirstByteTime().IsZero() {
+			t.Error("first byte time is set before the response is committed")
+		}
+		time.Sleep(10 * time.Millisecond)
+		c.Response().Write([]byte("a"))
+		firstByte = c.Response().FirstByteTime()
+		time.Sleep(30 * time.Millisecond)
+		c.Response().Write([]byte("b"))
+		if !c.Response().FirstByteTime().Equal(firstByte) {
+			t.Error("first byte time is changed by a later write")
+		}
+		end = time.Now()
+		return nil
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, "/stream", nil))
+	if ttfb := firstByte.Sub(start); ttfb < 10*time.Millisecond || ttfb > end.Sub(start)-30*time.Millisecond {
+		t.Errorf("got time to first byte %v", ttfb)
+	}
+	if end.Sub(firstByte) < 30*time.Millisecond {
+		t.Errorf("got %v after the first byte", end.Sub(firstByte))
+	}
+
+	var r Response
+	r.init(httptest.NewRecorder())
+	r.WriteHeader(http.StatusAccepted)
+	if r.FirstByteTime().IsZero() {
+		t.Error("first byte time is not set by WriteHeader")
+	}
+	r.init(httptest.NewRecorder())
+	if !r.FirstByteTime().IsZero() {
+		t.Error("first byte time is not reset")
+	}
+}
+
+func TestResponseStatus(t *testing.T) {
+	for name, tc := range map[string]struct {
+		write  func(r *Response)
+		status int
+		size   int64
+	}{
+		"none":         {func(r *Response) {}, 0, 0},
+		"write":        {func(r *Response) { r.Write([]byte("abc")) }, http.StatusOK, 3},
+		"read from":    {func(r *Response) { io.Copy(r, strings.NewReader("abcd")) }, http.StatusOK, 4},
+		"flush":        {func(r *Response) { r.Flush() }, http.StatusOK, 0},
+		"write header": {func(r *Response) { r.WriteHeader(http.StatusCreated); r.Write([]byte("a")) }, http.StatusCreated, 1},
+		"superfluous":  {func(r *Response) { r.Write([]byte("a")); r.WriteHeader(http.StatusTeapot) }, http.StatusOK, 1},
+	} {
+		var r Response
+		r.init(httptest.NewRecorder())
+		if r.Status() != 0 || r.Committed() {
+			t.Fatalf("%s: got status %d before writing", name, r.Status())
+		}
+		tc.write(&r)
+		if r.Status() != tc.status || r.Size() != tc.size || r.Committed() != (tc.status != 0) {
+			t.Errorf("%s: got status %d, %d bytes, committed %v", name, r.Status(), r.Size(), r.Committed())
+		}
+		r.free()
+		if r.Status() != 0 || r.Size() != 0 {
+			t.Errorf("%s: got status %d after free", name, r.Status())
+		}
+	}
+
+	// a handler that never writes is reported with status 0 to the response hook
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/silent", func(c *Context) error {
+		return nil
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	status := -1
+	a.SetResponseHook(func(c *Context, _ time.Duration) {
+		status = c.Response().Status()
+	})
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, "/silent", nil))
+	if status != 0 {
+		t.Errorf("silent handler: got status %d", status)
+	}
+}
+
+// serveTestApp serves a on a free local port, returning the address and the result of `serve()`.
+// The server is shut down at the end of the test, which waits for `serve()` to return.
+func serveTestApp(t *testing.T, a *App) (string, <-chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	errc := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		errc <- a.serve(Listen{Address: addr})
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		a.Shutdown(context.Background())
+		<-stopped
+	})
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr, errc
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server is not started")
+	return "", nil
+}
+
+func TestShutdown(t *testing.T) {
+	if err := newApp().Shutdown(context.Background()); err != nil {
+		t.Fatalf("not running: got %v", err)
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/slow", func(c *Context) error {
+		started <- struct{}{}
+		<-release
+		return c.String(http.StatusOK, "done")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	// the in-flight request is finished
+	addr, errc := serveTestApp(t, a)
+	resc := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			resc <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resc <- string(b)
+	}()
+	<-started
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- a.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the in-flight request is finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("new connections are accepted after Shutdown")
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatalf("got %v", err)
+	}
+	if got := <-resc; got != "done" {
+		t.Fatalf("got response %q", got)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("serve: got %v", err)
+	}
+	if n := a.InflightRequests(); n != 0 {
+		t.Fatalf("got %d in-flight requests", n)
+	}
+
+	// the deadline is exceeded
+	release = make(chan struct{})
+	defer close(release)
+	addr, errc = serveTestApp(t, a)
+	go http.Get("http://" + addr + "/slow")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := a.Shutdown(context.Background()); err != context.DeadlineExceeded {
+		t.Fatalf("later call: got %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("serve: got %v", err)
+	}
+}
+
+func TestDraining(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/slow", func(c *Context) error {
+		started <- struct{}{}
+		<-release
+		return c.String(http.StatusOK, "done")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	if n := a.InflightRequests(); n != 0 {
+		t.Fatalf("got %d in-flight requests before serving", n)
+	}
+
+	addr, errc := serveTestApp(t, a)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := http.Get("http://" + addr + "/slow"); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	<-started
+	<-started
+	if n := a.InflightRequests(); n != 2 {
+		t.Fatalf("got %d in-flight requests, want 2", n)
+	}
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- a.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := a.InflightRequests(); n != 2 {
+		t.Fatalf("draining: got %d in-flight requests, want 2", n)
+	}
+	close(release)
+	wg.Wait()
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("serve: got %v", err)
+	}
+	if n := a.InflightRequests(); n != 0 {
+		t.Fatalf("got %d in-flight requests after draining", n)
+	}
+
+	// reportDraining returns once the in-flight requests are finished, or once done is closed
+	report := func(start, done chan struct{}) <-chan struct{} {
+		returned := make(chan struct{})
+		go func() {
+			a.reportDraining(start, done)
+			close(returned)
+		}()
+		return returned
+	}
+	start, done := make(chan struct{}), make(chan struct{})
+	returned := report(start, done)
+	close(done)
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("not returned after done is closed before the shutdown")
+	}
+
+	atomic.StoreInt64(&a.inflight, 1)
+	start, done = make(chan struct{}), make(chan struct{})
+	defer close(done)
+	returned = report(start, done)
+	close(start)
+	select {
+	case <-returned:
+		t.Fatal("returned while a request is in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	atomic.StoreInt64(&a.inflight, 0)
+	select {
+	case <-returned:
+	case <-time.After(3 * time.Second):
+		t.Fatal("not returned after the in-flight requests are finished")
+	}
+}
+
+func TestH2C(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/proto", func(c *Context) error {
+		return c.String(http.StatusOK, c.Request().Proto)
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: h2c}}
+	for _, enabled := range []bool{true, false} {
+		ts := httptest.NewUnstartedServer(nil)
+		ts.Config = a.newServer("", Listen{EnableH2C: enabled})
+		ts.Start()
+
+		// HTTP/1.1 is still served
+		resp, err := http.Get(ts.URL + "/proto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "HTTP/1.1" {
+			t.Errorf("enabled=%v: HTTP/1.1 request got %q", enabled, b)
+		}
+
+		// the Upgrade: h2c request is not upgraded, it falls back to HTTP/1.1
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, "GET /proto HTTP/1.1\r\nHost: lessgo\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+			"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n")
+		resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 1 || string(b) != "HTTP/1.1" {
+			t.Errorf("enabled=%v: Upgrade: h2c request got %d %s %q", enabled, resp.StatusCode, resp.Proto, b)
+		}
+
+		// several streams are multiplexed on one connection
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := client.Get(ts.URL + "/proto")
+				if !enabled {
+					if err == nil {
+						resp.Body.Close()
+						t.Error("h2c request is served when disabled")
+					}
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				b, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.ProtoMajor != 2 || string(b) != "HTTP/2.0" {
+					t.Errorf("h2c request got %s %q", resp.Proto, b)
+				}
+			}()
+		}
+		wg.Wait()
+		client.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/grpc", func(c *Context) error {
+		c.SetHeader(HeaderTrailer, "Grpc-Message")
+		c.Response().Write([]byte("data"))
+		c.Response().Flush()
+		c.Response().Trailer().Set("Grpc-Status", "0")
+		c.Response().Header().Set("Grpc-Message", "ok")
+		return nil
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = a.newServer("", Listen{EnableH2C: true})
+	ts.Start()
+	defer ts.Close()
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	for _, client := range []*http.Client{http.DefaultClient, {Transport: &http.Transport{Protocols: h2c}}} {
+		resp, err := client.Get(ts.URL + "/grpc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "data" || resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "ok" {
+			t.Errorf("%s: got %q with trailers %v", resp.Proto, b, resp.Trailer)
+		}
+	}
+}
+func TestServeUnixSocket(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/ping", func(c *Context) error {
+		return c.String(http.StatusOK, "pong")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	dir, err := ioutil.TempDir("", "lessgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "app.sock")
+	// a stale socket file left by a crashed process
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- a.serve(Listen{Network: "unix", Address: sock, SocketFileMode: "0600"})
+	}()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", sock)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = client.Get("http://unix/ping"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "pong" {
+		t.Errorf("got %q", b)
+	}
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got socket file mode %v, %v", fi.Mode().Perm(), err)
+	}
+	client.CloseIdleConnections()
+	if err := a.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("serve: got %v", err)
+	}
+
+	if err := a.serve(Listen{Network: "unix", Address: sock, SocketFileMode: "rw"}); err == nil {
+		t.Error("invalid socket file mode is accepted")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/addr", func(c *Context) error {
+		return c.String(http.StatusOK, c.Request().RemoteAddr)
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: a}
+	go server.Serve(newProxyListener(l, 200*time.Millisecond))
+	defer server.Close()
+
+	v2 := func(cmd, family byte, addrs ...byte) string {
+		return string(proxyV2Signature) + string([]byte{0x20 | cmd, family, 0, byte(len(addrs))}) + string(addrs)
+	}
+	for header, want := range map[string]string{
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51000 80\r\n":     "203.0.113.7:51000",
+		"PROXY TCP6 2001:db8::7 2001:db8::1 51000 443\r\n": "[2001:db8::7]:51000",
+		"PROXY UNKNOWN\r\n": "127.0.0.1:",
+		v2(1, 0x11, 203, 0, 113, 8, 10, 0, 0, 1, 0xc7, 0x38, 0, 80): "203.0.113.8:51000",
+		v2(0, 0x00):              "127.0.0.1:",
+		"GET /addr HTTP/1.1\r\n": "",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51000\r\n": "",
+		"": "",
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if header != "" {
+			io.WriteString(conn, header+"GET /addr HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		}
+		// nothing is sent without the header, nor within the timeout
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		got := ""
+		if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+			got = string(b[i+4:])
+		}
+		if want == "" && len(b) != 0 || want != "" && !strings.HasPrefix(got, want) {
+			t.Errorf("header %q: got %q, want %q", header, b, want)
+		}
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/slow", func(c *Context) error {
+		time.Sleep(1500 * time.Millisecond)
+		return c.String(http.StatusOK, "late")
+	})
+	a.addwithlog(false, GET, "/fast", func(c *Context) error {
+		return c.String(http.StatusOK, "fast")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	server := a.newServer("", Listen{ReadTimeout: 2, WriteTimeout: 1, ReadHeaderTimeout: 1, IdleTimeout: 1})
+	if server.ReadTimeout != 2*time.Second || server.WriteTimeout != time.Second || server.IdleTimeout != time.Second {
+		t.Fatalf("got timeouts %v, %v, %v", server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = server
+	ts.Start()
+	defer ts.Close()
+
+	// the handler sleeping past the write timeout is cut off
+	start := time.Now()
+	resp, err := http.Get(ts.URL + "/slow")
+	if err == nil {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Fatalf("got response %q after the write timeout", b)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("cut off after %v", d)
+	}
+
+	// the idle keep-alive connection is closed
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /fast HTTP/1.1\r\nHost: test\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start = time.Now()
+	if _, err = br.ReadByte(); err != io.EOF {
+		t.Fatalf("idle connection: got %v, want EOF", err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("idle connection closed after %v, want about 1s", d)
+	}
+}
+
+func TestCustomTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lessgo-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, _, filePEM, fileKeyPEM := newTestCert(t, "127.0.0.1", false, nil, nil)
+	_, _, basePEM, baseKeyPEM := newTestCert(t, "base", false, nil, nil)
+	listen := Listen{HTTPSCertFile: filepath.Join(dir, "server.pem"), HTTPSKeyFile: filepath.Join(dir, "server.key")}
+	ioutil.WriteFile(listen.HTTPSCertFile, filePEM, 0600)
+	ioutil.WriteFile(listen.HTTPSKeyFile, fileKeyPEM, 0600)
+	baseCert, err := tls.X509KeyPair(basePEM, baseKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{"h2", "http/1.1"},
+		Certificates: []tls.Certificate{baseCert},
+	}
+
+	// the file-based certificate is appended
+	tlsConfig, err := newTLSConfig(base, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsConfig.Certificates) != 2 || tlsConfig.MinVersion != tls.VersionTLS13 || len(tlsConfig.NextProtos) != 2 {
+		t.Fatalf("got %d certificates, min version %x, ALPN %v", len(tlsConfig.Certificates), tlsConfig.MinVersion, tlsConfig.NextProtos)
+	}
+	if len(base.Certificates) != 1 {
+		t.Fatal("the base config is modified")
+	}
+	// the certificate of the base config is enough
+	if c, err := newTLSConfig(base, Listen{}); err != nil || len(c.Certificates) != 1 {
+		t.Fatalf("base certificate only: got %v", err)
+	}
+	if _, err := newTLSConfig(nil, Listen{}); err == nil {
+		t.Fatal("no certificate is accepted")
+	}
+	if !hasCertificate(&tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return nil, nil }}) {
+		t.Error("GetCertificate is not taken as a certificate")
+	}
+
+	// the min version is enforced
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(filePEM)
+	roots.AppendCertsFromPEM(basePEM)
+	for version, ok := range map[uint16]bool{tls.VersionTLS12: false, tls.VersionTLS13: true} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MaxVersion: version}}}
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != ok {
+			t.Errorf("TLS version %x: got %v", version, err)
+		}
+	}
+}
+
+func TestHTTPHandlerWrapper(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/page", func(c *Context) error {
+		return c.String(http.StatusOK, "page")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	// like autocert.Manager.HTTPHandler
+	a.SetHTTPHandlerWrapper(func(fallback http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			switch {
+			case strings.HasPrefix(req.URL.Path, "/.well-known/acme-challenge/"):
+				io.WriteString(rw, "token")
+			case req.URL.Query().Get("fallback") != "":
+				fallback.ServeHTTP(rw, req)
+			default:
+				http.Redirect(rw, req, "https://"+req.Host+req.URL.RequestURI(), http.StatusFound)
+			}
+		})
+	})
+
+	addr, errc := serveTestApp(t, a)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for path, want := range map[string]string{
+		"/.well-known/acme-challenge/x": "token",
+		"/page?fallback=1":              "page",
+		"/page":                         "https://" + addr + "/page",
+	} {
+		resp, err := client.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		got := string(b)
+		if resp.StatusCode == http.StatusFound {
+			got = resp.Header.Get(HeaderLocation)
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+	client.CloseIdleConnections()
+	a.Shutdown(context.Background())
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeAutoTLS is an AutoTLSManager like autocert.Manager serving a fixed certificate.
+type fakeAutoTLS struct {
+	cert        tls.Certificate
+	lock        sync.Mutex
+	hosts       []string
+	fallbackNil bool
+}
+
+func (m *fakeAutoTLS) TLSConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"h2", "http/1.1", "acme-tls/1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			m.lock.Lock()
+			m.hosts = append(m.hosts, hello.ServerName)
+			m.lock.Unlock()
+			return &m.cert, nil
+		},
+	}
+}
+
+func (m *fakeAutoTLS) HTTPHandler(fallback http.Handler) http.Handler {
+	m.fallbackNil = fallback == nil
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/.well-known/acme-challenge/") {
+			io.WriteString(rw, "token")
+			return
+		}
+		http.Redirect(rw, req, "https://"+req.Host+req.URL.RequestURI(), http.StatusFound)
+	})
+}
+
+func TestAutoTLS(t *testing.T) {
+	_, _, certPEM, keyPEM := newTestCert(t, "example.com", false, nil, nil)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeAutoTLS{cert: cert}
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/page", func(c *Context) error {
+		return c.String(http.StatusOK, "page")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	a.SetAutoTLS(m)
+	a.SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})
+
+	var probes []net.Listener
+	freeAddr := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		probes = append(probes, l)
+		return l.Addr().String()
+	}
+	listen := Listen{Address: freeAddr(), EnableTLS: true, TLSAddress: freeAddr()}
+	// the probes are held until both addresses are picked, so that they differ
+	for _, l := range probes {
+		l.Close()
+	}
+	servers, _, err := a.newServers(listen)
+	if err != nil || len(servers) != 2 {
+		t.Fatalf("got %d servers, %v", len(servers), err)
+	}
+	if c := servers[0].TLSConfig; c.MinVersion != tls.VersionTLS12 || c.GetCertificate == nil || strings.Join(c.NextProtos, ",") != "h2,http/1.1,acme-tls/1" {
+		t.Errorf("HTTPS config: got MinVersion %x, NextProtos %v", c.MinVersion, c.NextProtos)
+	}
+	if !m.fallbackNil {
+		t.Error("the plain HTTP requests are not redirected")
+	}
+	if servers, _, _ := a.newServers(Listen{EnableTLS: true, TLSAddress: listen.TLSAddress}); len(servers) != 2 || servers[1].Addr != ":80" {
+		t.Errorf("no HTTP server for the HTTP-01 challenges: got %d servers", len(servers))
+	}
+
+	listening := make(chan net.Addr, 2)
+	a.SetOnListen(func(addr net.Addr) {
+		listening <- addr
+	})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- a.serve(listen)
+	}()
+	select {
+	case <-listening:
+	case err := <-errc:
+		t.Fatal(err)
+	}
+	defer func() {
+		a.Shutdown(context.Background())
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "example.com"}}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for url, want := range map[string]string{
+		"https://" + listen.TLSAddress + "/page":                     "page",
+		"http://" + listen.Address + "/.well-known/acme-challenge/x": "token",
+		"http://" + listen.Address + "/page":                         "https://" + listen.Address + "/page",
+	} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		got := string(b)
+		if resp.StatusCode == http.StatusFound {
+			got = resp.Header.Get(HeaderLocation)
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", url, got, want)
+		}
+	}
+	m.lock.Lock()
+	hosts := strings.Join(m.hosts, ",")
+	m.lock.Unlock()
+	if hosts != "example.com" {
+		t.Errorf("got certificates of %q", hosts)
+	}
+
+	// a certificate of its own is used instead of the manager
+	a.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if servers, _, _ := a.newServers(Listen{EnableTLS: true, TLSAddress: listen.TLSAddress}); len(servers) != 1 || servers[0].TLSConfig.GetCertificate != nil {
+		t.Errorf("got %d servers with the manager", len(servers))
+	}
+}
+
+func TestWrapHandler(t *testing.T) {
+	content := bytes.NewReader([]byte("0123456789"))
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/file", WrapHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.ServeContent(rw, req, "file.txt", time.Time{}, content)
+	})), WrapMiddleware(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("deny") != "" {
+			http.Error(rw, "denied", http.StatusForbidden)
+		}
+	}))
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(GET, "/file", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	a.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Errorf("got %d %q, want 206 \"234\"", rec.Code, rec.Body.String())
+	}
+
+	// the standard middleware has responded, the handler is not called
+	rec = httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(GET, "/file?deny=1", nil))
+	if rec.Code != http.StatusForbidden || strings.Contains(rec.Body.String(), "0123") {
+		t.Errorf("got %d %q, want 403", rec.Code, rec.Body.String())
+	}
+}
+func TestMaxBodyBytes(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, POST, "/raw", func(c *Context) error {
+		b, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, strconv.Itoa(len(b)))
+	})
+	a.addwithlog(false, POST, "/bind", func(c *Context) error {
+		var v map[string]string
+		if err := c.Bind(&v); err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, v["a"])
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	a.SetMaxBodyBytes(16)
+	ts := httptest.NewServer(a)
+	defer ts.Close()
+
+	chunked := func(s string) io.Reader {
+		// hide the length to send the body chunked
+		return io.MultiReader(strings.NewReader(s))
+	}
+	for _, tc := range []struct {
+		path string
+		body io.Reader
+		code int
+	}{
+		{"/raw", strings.NewReader("0123456789"), http.StatusOK},
+		{"/raw", strings.NewReader(strings.Repeat("x", 17)), http.StatusRequestEntityTooLarge},
+		{"/raw", chunked(strings.Repeat("x", 17)), http.StatusRequestEntityTooLarge},
+		{"/bind", chunked(`{"a":"b"}`), http.StatusOK},
+		{"/bind", chunked(`{"a":"` + strings.Repeat("x", 20) + `"}`), http.StatusRequestEntityTooLarge},
+	} {
+		resp, err := http.Post(ts.URL+tc.path, MIMEApplicationJSON, tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: got %d, want %d", tc.path, resp.StatusCode, tc.code)
+		}
+	}
+
+	a.SetMaxBodyBytes(0)
+	resp, err := http.Post(ts.URL+"/raw", MIMETextPlain, strings.NewReader(strings.Repeat("x", 1<<10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("no limit: got %d", resp.StatusCode)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	if server := app.newServer("", Listen{MaxHeaderBytes: 4096}); server.MaxHeaderBytes != 4096 {
+		t.Fatalf("got %d", server.MaxHeaderBytes)
+	}
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = app.newServer("", Listen{MaxHeaderBytes: 1024})
+	ts.Start()
+	defer ts.Close()
+	req, _ := http.NewRequest(GET, ts.URL, nil)
+	req.Header.Set("X-Big", strings.Repeat("x", 8<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("got %d", resp.StatusCode)
+	}
+}
+
+func TestPanicResetsPooledContext(t *testing.T) {
+	var pooled []*Context
+	a := newApp()
+	a.SetContextNewHook(func(c *Context) {
+		pooled = append(pooled, c)
+	})
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/panic/:id", func(c *Context) error {
+		c.Set("user", "admin")
+		c.SetHeader("X-Secret", "1")
+		c.Response().Trailer().Set("X-Checksum", "1")
+		c.Response().Write([]byte("partial"))
+		panic("boom")
+	})
+	a.addwithlog(false, GET, "/early/:id", func(c *Context) error {
+		c.Set("user", "admin")
+		panic("boom")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(GET, "/early/1", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("uncommitted response: got %d, want 500", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(GET, "/panic/2", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "partial" {
+		t.Errorf("committed response: got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if len(pooled) == 0 {
+		t.Fatal("no pooled context")
+	}
+	for _, c := range pooled {
+		if c.request != nil || len(c.pkeys) != 0 || len(c.pvalues) != 0 || c.store != nil ||
+			c.failureHandler != nil || c.stage != (PanicSource{}) {
+			t.Errorf("context is not reset: %+v", c)
+		}
+		if r := c.response; r.writer != nil || r.committed || r.size != 0 || r.status != 0 || !r.firstByte.IsZero() || r.trailer != nil || r.superfluous {
+			t.Errorf("response is not reset: %+v", r)
+		}
+	}
+}
+
+func TestStdContext(t *testing.T) {
+	type key struct{}
+	canceled := make(chan error, 1)
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/slow", func(c *Context) error {
+		select {
+		case <-c.StdContext().Done():
+			canceled <- c.StdContext().Err()
+			return nil
+		case <-time.After(5 * time.Second):
+			canceled <- nil
+			return c.String(http.StatusOK, "late")
+		}
+	})
+	a.addwithlog(false, GET, "/live", func(c *Context) error {
+		c.SetStdContext(context.WithValue(c.StdContext(), key{}, "v"))
+		return c.String(http.StatusOK, fmt.Sprintf("%v %v", c.StdContext().Err(), c.StdContext().Value(key{})))
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	addr, _ := serveTestApp(t, a)
+	defer a.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest(GET, "http://"+addr+"/slow", nil)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+		t.Fatal("the request is not canceled")
+	}
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Errorf("got %v after the client went away, want %v", err, context.Canceled)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the handler is not notified")
+	}
+
+	// the pooled context carries the context of the new request
+	resp, err := http.Get("http://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "<nil> v" {
+		t.Errorf("got %q, want %q", b, "<nil> v")
+	}
+}
+
+func TestConnTLS(t *testing.T) {
+	_, _, certPEM, keyPEM := newTestCert(t, "127.0.0.1", false, nil, nil)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/conn", func(c *Context) error {
+		switch conn := c.Conn().(type) {
+		case *tls.Conn:
+			state := conn.ConnectionState()
+			return c.String(http.StatusOK, fmt.Sprintf("tls %v %s", state.HandshakeComplete, state.ServerName))
+		case nil:
+			return c.String(http.StatusOK, "nil")
+		default:
+			return c.String(http.StatusOK, "plain "+conn.RemoteAddr().Network())
+		}
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	a.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+
+	var probes []net.Listener
+	freeAddr := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		probes = append(probes, l)
+		return l.Addr().String()
+	}
+	listen := Listen{Address: freeAddr(), EnableTLS: true, TLSAddress: freeAddr()}
+	// the probes are held until both addresses are picked, so that they differ
+	for _, l := range probes {
+		l.Close()
+	}
+	listening := make(chan net.Addr, 2)
+	a.SetOnListen(func(addr net.Addr) {
+		listening <- addr
+	})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- a.serve(listen)
+	}()
+	select {
+	case <-listening:
+	case err := <-errc:
+		t.Fatal(err)
+	}
+	defer func() {
+		a.Shutdown(context.Background())
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "example.com"}}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	for url, want := range map[string]string{
+		"https://" + listen.TLSAddress + "/conn": "tls true example.com",
+		"http://" + listen.Address + "/conn":     "plain tcp",
+	} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != want {
+			t.Errorf("%s: got %q, want %q", url, b, want)
+		}
+	}
+
+	// not served by the lessgo server
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(GET, "/conn", nil))
+	if rec.Body.String() != "nil" {
+		t.Errorf("got %q", rec.Body.String())
+	}
+}
+
+func TestFlush(t *testing.T) {
+	next := make(chan struct{})
+	stream := func(rw http.ResponseWriter) {
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(rw, "chunk%d\n", i)
+			rw.(http.Flusher).Flush()
+			<-next
+		}
+	}
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/stream", func(c *Context) error {
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(c.Response(), "chunk%d\n", i)
+			if err := c.FlushError(); err != nil {
+				return err
+			}
+			<-next
+		}
+		return nil
+	})
+	a.addwithlog(false, GET, "/wrapped", WrapHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		stream(rw)
+	})))
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	addr, _ := serveTestApp(t, a)
+	defer a.Shutdown(context.Background())
+
+	for _, path := range []string{"/stream", "/wrapped"} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(resp.Body)
+		for i := 1; i <= 3; i++ {
+			// the handler waits until the chunk is read by the client
+			line, err := r.ReadString('\n')
+			if err != nil || line != fmt.Sprintf("chunk%d\n", i) {
+				t.Fatalf("%s: got %q, %v", path, line, err)
+			}
+			next <- struct{}{}
+		}
+		resp.Body.Close()
+	}
+
+	// the writer without flushing
+	resp := NewResponse(struct{ http.ResponseWriter }{httptest.NewRecorder()})
+	if err := resp.FlushError(); err != ErrFlushNotSupported {
+		t.Errorf("got %v, want %v", err, ErrFlushNotSupported)
+	}
+	resp.Flush()
+}
+
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (r *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	r.pushed = append(r.pushed, target+" "+opts.Header.Get(HeaderAcceptEncoding))
+	return nil
+}
+
+func TestPush(t *testing.T) {
+	var late error
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/page", func(c *Context) error {
+		if err := c.Push("/app.css", http.Header{HeaderAcceptEncoding: {"gzip"}}); err != nil {
+			return c.String(http.StatusOK, err.Error())
+		}
+		c.String(http.StatusOK, "page")
+		late = c.Push("/app.js", nil)
+		return nil
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	rec := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	a.ServeHTTP(rec, httptest.NewRequest(GET, "/page", nil))
+	if len(rec.pushed) != 1 || rec.pushed[0] != "/app.css gzip" {
+		t.Errorf("got pushed %q", rec.pushed)
+	}
+	// pushing after the response is committed fails
+	if rec.Body.String() != "page" || late != ErrResponseCommitted {
+		t.Errorf("got %q, %v after committed, want %v", rec.Body.String(), late, ErrResponseCommitted)
+	}
+
+	// HTTP/1.1
+	rec2 := httptest.NewRecorder()
+	a.ServeHTTP(rec2, httptest.NewRequest(GET, "/page", nil))
+	if rec2.Body.String() != ErrPushNotSupported.Error() {
+		t.Errorf("got %q, want %q", rec2.Body.String(), ErrPushNotSupported.Error())
+	}
+}
+
+func TestRequestResponseHooks(t *testing.T) {
+	var log []string
+	a := newApp()
+	a.SetRequestHook(func(c *Context) {
+		log = append(log, "begin "+c.Request().URL.Path)
+	})
+	a.SetResponseHook(func(c *Context, latency time.Duration) {
+		if latency <= 0 {
+			t.Errorf("got latency %v", latency)
+		}
+		log = append(log, fmt.Sprintf("end %s %d %d", c.Request().URL.Path, c.Response().Status(), c.Response().Size()))
+	})
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/ok", func(c *Context) error {
+		log = append(log, "handler")
+		return c.String(http.StatusCreated, "done")
+	})
+	a.addwithlog(false, GET, "/panic", func(c *Context) error {
+		panic("boom")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, "/ok", nil))
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, "/panic", nil))
+	want := []string{"begin /ok", "handler", "end /ok 201 4", "begin /panic", "end /panic 500"}
+	if len(log) != len(want) {
+		t.Fatalf("got %q, want %q", log, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(log[i], want[i]) {
+			t.Errorf("got %q, want %q", log, want)
+			break
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var hooked string
+	a := newApp()
+	a.SetRequestHook(func(c *Context) {
+		hooked = c.RequestID()
+	})
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/id", func(c *Context) error {
+		return c.String(http.StatusOK, c.RequestID())
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	get := func(clientID string) string {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(GET, "/id", nil)
+		if clientID != "" {
+			req.Header.Set(HeaderXRequestID, clientID)
+		}
+		a.ServeHTTP(rec, req)
+		if id := rec.Header().Get(HeaderXRequestID); id == "" || id != rec.Body.String() || id != hooked {
+			t.Errorf("got header %q, body %q and hooked %q", id, rec.Body.String(), hooked)
+		}
+		return rec.Body.String()
+	}
+	if first, second := get(""), get(""); first == second {
+		t.Errorf("got the same ID %q", first)
+	}
+	if id := get("from-gateway"); id == "from-gateway" {
+		t.Error("the client ID is used without trust")
+	}
+
+	a.SetTrustRequestID(true)
+	if id := get("from-gateway"); id != "from-gateway" {
+		t.Errorf("got %q, want the trusted client ID", id)
+	}
+	if id := get("bad id"); id == "bad id" {
+		t.Error("the invalid client ID is used")
+	}
+
+	a.SetRequestIDGenerator(func() string { return "custom" })
+	if id := get(""); id != "custom" {
+		t.Errorf("got %q, want the custom ID", id)
+	}
+}
+
+func TestLastResortRecover(t *testing.T) {
+	a := newApp()
+	a.SetFailureHandler(func(c *Context, code int, errString string) error {
+		panic("failure handler")
+	})
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/panic", func(c *Context) error {
+		panic("boom")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(GET, "/panic", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), http.StatusText(http.StatusInternalServerError)) {
+		t.Errorf("got %d %q, want the plain 500", rec.Code, rec.Body.String())
+	}
+
+	a.SetDisableRecover(true)
+	defer func() {
+		if rcv := recover(); rcv != "boom" {
+			t.Errorf("got panic %v, want boom", rcv)
+		}
+		if a.InflightRequests() != 0 {
+			t.Errorf("got %d in-flight requests after the panic", a.InflightRequests())
+		}
+	}()
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, "/panic", nil))
+	t.Error("the panic is recovered when disabled")
+}
+
+func TestHijackedContextNotPooled(t *testing.T) {
+	hijacked := make(chan *Context, 1)
+	release := make(chan struct{})
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/hijack", func(c *Context) error {
+		conn, brw, err := c.Response().Hijack()
+		if err != nil {
+			return err
+		}
+		if !c.Response().Hijacked() {
+			t.Error("Hijacked() is false after Hijack()")
+		}
+		// keep using the context after the handler returns
+		go func() {
+			defer conn.Close()
+			<-release
+			brw.WriteString("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n" + c.Request().URL.Path)
+			brw.Flush()
+		}()
+		hijacked <- c
+		return nil
+	})
+	var plain []*Context
+	a.addwithlog(false, GET, "/plain", func(c *Context) error {
+		plain = append(plain, c)
+		if c.Response().Hijacked() {
+			t.Error("Hijacked() is true for a new request")
+		}
+		return c.String(http.StatusOK, c.Request().URL.Path)
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	ts := httptest.NewServer(a)
+	defer ts.Close()
+
+	resc := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + "/hijack")
+		if err != nil {
+			resc <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resc <- string(b)
+	}()
+	hc := <-hijacked
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(ts.URL + "/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	for _, c := range plain {
+		if c == hc {
+			t.Fatal("the hijacked context is reused")
+		}
+	}
+	close(release)
+	if got := <-resc; got != "/hijack" {
+		t.Errorf("hijacker got %q, want %q", got, "/hijack")
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/stats", func(c *Context) error {
+		return c.String(http.StatusOK, strconv.FormatInt(a.Stats().ActiveRequests, 10))
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	states := make(chan http.ConnState, 10)
+	a.SetConnStateHook(func(_ net.Conn, state http.ConnState) {
+		states <- state
+	})
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = a.newServer("", Listen{})
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		io.WriteString(conn, "GET /stats HTTP/1.1\r\nHost: test\r\n\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "1" {
+			t.Errorf("got %s active requests in the handler", b)
+		}
+	}
+	stats := a.Stats()
+	if stats.OpenConnections != 1 || stats.ActiveRequests != 0 || stats.TotalRequests != 2 {
+		t.Errorf("got %+v", stats)
+	}
+	conn.Close()
+	if got := <-states; got != http.StateNew {
+		t.Errorf("got first state %v, want %v", got, http.StateNew)
+	}
+	timeout := time.After(5 * time.Second)
+	for state := http.StateNew; state != http.StateClosed; {
+		select {
+		case state = <-states:
+		case <-timeout:
+			t.Fatal("connection is not closed")
+		}
+	}
+	if n := a.Stats().OpenConnections; n != 0 {
+		t.Errorf("got %d open connections after closed", n)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		if _, err := listenNet(new(gracenet.Net), "127.0.0.1:0", Listen{ReusePort: true}); err == nil {
+			t.Fatal("SO_REUSEPORT is accepted on an unsupported platform")
+		}
+		return
+	}
+	l1, err := listenNet(new(gracenet.Net), "127.0.0.1:0", Listen{ReusePort: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	addr := l1.Addr().String()
+	l2, err := listenNet(new(gracenet.Net), addr, Listen{ReusePort: true})
+	if err != nil {
+		t.Fatalf("second listener with SO_REUSEPORT: %v", err)
+	}
+	l2.Close()
+	if l3, err := listenNet(new(gracenet.Net), addr, Listen{}); err == nil {
+		l3.Close()
+		t.Fatal("second listener without SO_REUSEPORT is accepted")
+	}
+}
+
+func TestDisableKeepAlive(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/", func(c *Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	// get reports whether the connection is kept alive after a request
+	get := func(addr string) bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = br.ReadByte()
+		ne, ok := err.(net.Error)
+		return ok && ne.Timeout()
+	}
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = a.newServer("", Listen{DisableKeepAlive: true})
+	ts.Start()
+	defer ts.Close()
+	if get(ts.Listener.Addr().String()) {
+		t.Error("connection is kept alive with DisableKeepAlive")
+	}
+
+	addr, errc := serveTestApp(t, a)
+	if !get(addr) {
+		t.Error("connection is not kept alive by default")
+	}
+	a.SetKeepAlivesEnabled(false)
+	if get(addr) {
+		t.Error("connection is kept alive after SetKeepAlivesEnabled(false)")
+	}
+	a.SetKeepAlivesEnabled(true)
+	if !get(addr) {
+		t.Error("connection is not kept alive after SetKeepAlivesEnabled(true)")
+	}
+	a.Shutdown(context.Background())
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenerAddrs(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/ok", func(c *Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	if addrs := a.ListenerAddrs(); addrs != nil {
+		t.Fatalf("got %v before serving", addrs)
+	}
+	listening := make(chan net.Addr, 1)
+	a.SetOnListen(func(addr net.Addr) {
+		listening <- addr
+	})
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- a.serve(Listen{Address: "127.0.0.1:0"})
+	}()
+	var addr net.Addr
+	select {
+	case addr = <-listening:
+	case err := <-errc:
+		t.Fatal(err)
+	}
+	if addrs := a.ListenerAddrs(); len(addrs) != 1 || addrs[0].String() != addr.String() || strings.HasSuffix(addr.String(), ":0") {
+		t.Fatalf("got %v and %v", addrs, addr)
+	}
+	resp, err := http.Get("http://" + addr.String() + "/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	a.Shutdown(context.Background())
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if addrs := a.ListenerAddrs(); addrs != nil {
+		t.Errorf("got %v after the shutdown", addrs)
+	}
+}
+
+func TestAddListen(t *testing.T) {
+	freeAddr := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		return l.Addr().String()
+	}
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/ping", func(c *Context) error {
+		return c.String(http.StatusOK, "pong")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	extra := freeAddr()
+	a.AddListen(Listen{Address: extra})
+	addr, errc := serveTestApp(t, a)
+	for _, addr := range []string{addr, extra} {
+		resp, err := http.Get("http://" + addr + "/ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "pong" {
+			t.Errorf("%s: got %q", addr, b)
+		}
+	}
+	http.DefaultClient.CloseIdleConnections()
+	if err := a.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{addr, extra} {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("%s is still listened on after Shutdown", addr)
+		}
+	}
+
+	// the listeners are closed if one of them fails
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	a.extraListens = nil
+	a.AddListen(Listen{Address: busy.Addr().String()})
+	first := freeAddr()
+	if err := a.serve(Listen{Address: first}); err == nil {
+		t.Fatal("serve succeeded on a busy address")
+	}
+	l, err := net.Listen("tcp", first)
+	if err != nil {
+		t.Fatalf("the first listener is not closed: %v", err)
+	}
+	l.Close()
+
+	a.extraListens = nil
+	if err := a.serve(Listen{}); err == nil {
+		t.Fatal("serve succeeded without any address")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the graceful restart is not supported on Windows")
+	}
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/pid", func(c *Context) error {
+		return c.String(http.StatusOK, strconv.Itoa(os.Getpid()))
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	if addr := os.Getenv("LESSGO_TEST_RESTART_ADDR"); addr != "" && os.Getenv("LISTEN_FDS") != "" {
+		// the new process started by Restart, which serves on the inherited listener for a while
+		go func() {
+			time.Sleep(3 * time.Second)
+			a.Shutdown(context.Background())
+		}()
+		if err := a.serve(Listen{Address: addr}); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if _, err := a.Restart(); err == nil {
+		t.Fatal("restarted while not running")
+	}
+	addr, errc := serveTestApp(t, a)
+	os.Setenv("LESSGO_TEST_RESTART_ADDR", addr)
+	defer os.Unsetenv("LESSGO_TEST_RESTART_ADDR")
+	// let the server go back to wait for connections after the probe of serveTestApp,
+	// since passing the listener to the new process makes it blocking for a moment
+	time.Sleep(100 * time.Millisecond)
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestRestart$"}
+	pid, err := a.Restart()
+	os.Args = args
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Wait()
+	defer proc.Kill()
+
+	// this process is terminated gracefully by the new one once it is serving
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the old process is not shut down")
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + addr + "/pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != strconv.Itoa(pid) {
+		t.Errorf("got served by pid %s, want %d", b, pid)
+	}
+}
+
+func TestSystemdSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the systemd socket activation is not supported on Windows")
+	}
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/pid", func(c *Context) error {
+		go a.Shutdown(context.Background())
+		return c.String(http.StatusOK, strconv.Itoa(os.Getpid()))
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	listen := Listen{Address: "unused", UseSystemdSocket: true, SystemdSocketName: "web"}
+
+	if os.Getenv("LESSGO_TEST_SYSTEMD") != "" {
+		// the process started like by a socket unit, which serves on the socket named web
+		if err := a.serve(listen); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if err := a.serve(listen); err == nil || !strings.Contains(err.Error(), "LISTEN_FDS is not set") {
+		t.Fatalf("got %v without the socket activation", err)
+	}
+	var (
+		files []*os.File
+		addr  string
+	)
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addr = l.Addr().String()
+	}
+	// the new process terminates this one like after a graceful restart
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdSocket$")
+	cmd.ExtraFiles = files
+	// LISTEN_PID of the parent process is accepted after a graceful restart
+	cmd.Env = append(os.Environ(), "LESSGO_TEST_SYSTEMD=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=other:web",
+		"LISTEN_PID="+strconv.Itoa(os.Getpid()))
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	resp, err := http.Get("http://" + addr + "/pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != strconv.Itoa(cmd.Process.Pid) {
+		t.Errorf("got served by pid %s, want %d", b, cmd.Process.Pid)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%v: %s", err, out.Bytes())
+	}
+	select {
+	case <-sig:
+	default:
+		t.Error("the parent process is not terminated")
+	}
+}
+
+func TestReloadTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lessgo-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listen := Listen{
+		EnableTLS:     true,
+		TLSAddress:    "127.0.0.1:0",
+		HTTPSCertFile: filepath.Join(dir, "server.pem"),
+		HTTPSKeyFile:  filepath.Join(dir, "server.key"),
+	}
+	writeCert := func(cn string) {
+		_, _, certPEM, keyPEM := newTestCert(t, cn, false, nil, nil)
+		ioutil.WriteFile(listen.HTTPSCertFile, certPEM, 0600)
+		ioutil.WriteFile(listen.HTTPSKeyFile, keyPEM, 0600)
+	}
+	writeCert("one")
+
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/ok", func(c *Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	if err := a.ReloadTLS(); err != nil {
+		t.Fatalf("not running: got %v", err)
+	}
+	listening := make(chan net.Addr, 1)
+	a.SetOnListen(func(addr net.Addr) {
+		listening <- addr
+	})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- a.serve(listen)
+	}()
+	var addr net.Addr
+	select {
+	case addr = <-listening:
+	case err := <-errc:
+		t.Fatal(err)
+	}
+	defer func() {
+		a.Shutdown(context.Background())
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}()
+	served := func() string {
+		conn, err := tls.Dial("tcp", addr.String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if cn := served(); cn != "one" {
+		t.Fatalf("got certificate %q, want one", cn)
+	}
+
+	// reloaded explicitly
+	writeCert("two")
+	if err := a.ReloadTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := served(); cn != "two" {
+		t.Fatalf("after ReloadTLS: got certificate %q, want two", cn)
+	}
+	// the old certificate is kept if the new one is broken
+	ioutil.WriteFile(listen.HTTPSKeyFile, []byte("broken"), 0600)
+	if err := a.ReloadTLS(); err == nil {
+		t.Fatal("a broken key is reloaded")
+	}
+	if cn := served(); cn != "two" {
+		t.Fatalf("after a failed reload: got certificate %q, want two", cn)
+	}
+	// reloaded on the handshake once the files change
+	writeCert("three")
+	time.Sleep(certCheckInterval + 100*time.Millisecond)
+	if cn := served(); cn != "three" {
+		t.Fatalf("after the files change: got certificate %q, want three", cn)
+	}
+}
+
+func TestMultipartForm(t *testing.T) {
+	defer func(n int64) { MaxMemory = n }(MaxMemory)
+	MaxMemory = 16 // the upload is stored in a temporary file
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("name", "lessgo")
+	fw, err := mw.CreateFormFile("upload", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bytes.Repeat([]byte("x"), 1024))
+	mw.Close()
+	req := httptest.NewRequest(POST, "/upload", &body)
+	req.Header.Set(HeaderContentType, mw.FormDataContentType())
+	c := app.newContext(new(Response), req)
+	c.init(httptest.NewRecorder(), req)
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := form.Value["name"]; len(v) != 1 || v[0] != "lessgo" || len(form.File["upload"]) != 1 {
+		t.Fatalf("got values %v and files %v", form.Value, form.File)
+	}
+	f, fh, err := c.FormFile("upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fh.Filename != "a.txt" || fh.Size != 1024 {
+		t.Fatalf("got file %q of %d bytes", fh.Filename, fh.Size)
+	}
+	tmp, ok := f.(*os.File)
+	if !ok {
+		t.Fatalf("the upload is kept in memory: %T", f)
+	}
+	f.Close()
+	c.free()
+	if _, err := os.Stat(tmp.Name()); !os.IsNotExist(err) {
+		t.Errorf("the temporary file is left after the request: %v", err)
+	}
+
+	req = httptest.NewRequest(POST, "/", strings.NewReader("a=1"))
+	req.Header.Set(HeaderContentType, MIMEApplicationForm)
+	c.init(httptest.NewRecorder(), req)
+	defer c.free()
+	if _, err := c.MultipartForm(); err != http.ErrNotMultipart {
+		t.Errorf("url-encoded form: got %v, want http.ErrNotMultipart", err)
+	}
+}
+
+func TestCookies(t *testing.T) {
+	req := httptest.NewRequest(GET, "/", nil)
+	req.Header.Add(HeaderCookie, "a=1; b=2")
+	req.Header.Add(HeaderCookie, "c=3")
+	c := app.newContext(new(Response), req)
+	c.init(httptest.NewRecorder(), req)
+	cookies, err := c.Cookies()
+	if err != nil || len(cookies) != 3 {
+		t.Fatalf("got %v and %v", cookies, err)
+	}
+	if cookie, err := c.Cookie("b"); err != nil || cookie.Value != "2" {
+		t.Fatalf("got %v and %v", cookie, err)
+	}
+	if _, err := c.Cookie("d"); err != http.ErrNoCookie {
+		t.Fatalf("missing cookie: got %v", err)
+	}
+	c.AddCookieParam(&http.Cookie{Name: "d", Value: "4"})
+	if cookie, err := c.Cookie("d"); err != nil || cookie.Value != "4" {
+		t.Fatalf("added cookie: got %v and %v", cookie, err)
+	}
+	c.free()
+
+	// a malformed header is reported, the valid ones are still returned
+	req = httptest.NewRequest(GET, "/", nil)
+	req.Header.Add(HeaderCookie, "a=1")
+	req.Header.Add(HeaderCookie, "b c=2")
+	c.init(httptest.NewRecorder(), req)
+	defer c.free()
+	cookies, err = c.Cookies()
+	if err == nil || len(cookies) != 1 || cookies[0].Name != "a" {
+		t.Fatalf("got %v and %v", cookies, err)
+	}
+	if _, err := c.Cookie("a"); err == nil {
+		t.Error("the malformed header is ignored by Cookie")
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	req := httptest.NewRequest(GET, "/", nil)
+	rec := httptest.NewRecorder()
+	c := app.newContext(new(Response), req)
+	c.init(rec, req)
+	defer c.free()
+	c.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	c.SetCookie(&http.Cookie{Name: "sid", Value: "1", Path: "/", SameSite: http.SameSiteLaxMode})
+	// replaces the sid cookie only
+	c.SetCookie(&http.Cookie{Name: "sid", Value: "2", Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	c.AddCookie(&http.Cookie{Name: "old", MaxAge: -1})
+	c.AddCookie(&http.Cookie{Name: "bad name", Value: "x"})
+	c.String(http.StatusOK, "ok")
+	c.AddCookie(&http.Cookie{Name: "late", Value: "x"})
+	c.response.SetCookie(&http.Cookie{Name: "late", Value: "x"})
+
+	want := []string{
+		"theme=dark",
+		"sid=2; Path=/; HttpOnly; SameSite=Strict",
+		"old=; Max-Age=0",
+	}
+	if got := rec.Result().Header[HeaderSetCookie]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got Set-Cookie %q, want %q", got, want)
+	}
+}
+
+func TestQueryValues(t *testing.T) {
+	req := httptest.NewRequest(GET, "/?a=1&b=x&a=2&bad=%zz&a=3", nil)
+	c := app.newContext(new(Response), req)
+	c.init(httptest.NewRecorder(), req)
+	defer c.free()
+	if v := c.QueryParams("a"); strings.Join(v, ",") != "1,2,3" {
+		t.Errorf("got %v, want the repeated values in order", v)
+	}
+	if c.QueryParam("b") != "x" || c.QueryParam("bad") != "" {
+		t.Errorf("the malformed pair is not skipped: %v", c.QueryValues())
+	}
+	// parsed once, the changes are kept until the Context is freed
+	c.AddQueryParam("b", "y")
+	req.URL.RawQuery = ""
+	if v := c.QueryParams("b"); len(v) != 2 {
+		t.Errorf("got %v after AddQueryParam", v)
+	}
+
+	c.DelQueryParam("a")
+	if v := c.QueryParams("a"); v != nil || c.request.URL.RawQuery != "b=x&b=y" {
+		t.Errorf("after DelQueryParam: got %v, raw query %q", v, c.request.URL.RawQuery)
+	}
+	c.DelQueryParam("missing")
+	c.DelQueryParam("b")
+	if c.request.URL.RawQuery != "" || len(c.QueryValues()) != 0 {
+		t.Errorf("got raw query %q after deleting all", c.request.URL.RawQuery)
+	}
+}
+
+func TestRealRemoteAddr(t *testing.T) {
+	a := newApp()
+	realIP := func(remoteAddr string, header ...string) string {
+		req := httptest.NewRequest(GET, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Add(header[i], header[i+1])
+		}
+		return a.realIP(req)
+	}
+
+	// the headers are ignored without trusted proxies
+	if ip := realIP("10.0.0.1:1234", HeaderXForwardedFor, "203.0.113.1, 10.0.0.2", HeaderXRealIP, "203.0.113.2"); ip != "10.0.0.1" {
+		t.Errorf("no trusted proxies: got %q", ip)
+	}
+	// unless they are trusted from any peer explicitly
+	a.SetTrustAnyProxy(true)
+	if ip := realIP("10.0.0.1:1234", HeaderXForwardedFor, "203.0.113.1, 10.0.0.2"); ip != "203.0.113.1" {
+		t.Errorf("any proxy: got %q", ip)
+	}
+	if ip := realIP("10.0.0.1:1234", HeaderXRealIP, "203.0.113.2"); ip != "203.0.113.2" {
+		t.Errorf("any proxy, X-Real-IP: got %q", ip)
+	}
+	if ip := realIP("10.0.0.1:1234"); ip != "10.0.0.1" {
+		t.Errorf("any proxy without headers: got %q", ip)
+	}
+
+	if err := a.SetTrustedProxies("10.0.0.0/8", "fe80::/10", "::1"); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []struct {
+		remoteAddr string
+		header     []string
+		want       string
+	}{
+		// spoofed headers from an untrusted peer are ignored
+		{"198.51.100.7:1234", []string{HeaderXForwardedFor, "203.0.113.1", HeaderXRealIP, "203.0.113.2"}, "198.51.100.7"},
+		// walked from right to left past the trusted hops
+		{"10.0.0.1:1234", []string{HeaderXForwardedFor, "198.51.100.9, 203.0.113.1, 10.0.0.3"}, "203.0.113.1"},
+		{"10.0.0.1:1234", []string{HeaderXForwardedFor, "198.51.100.9", HeaderXForwardedFor, "203.0.113.1:4711, 10.0.0.3"}, "203.0.113.1"},
+		// all hops trusted
+		{"10.0.0.1:1234", []string{HeaderXForwardedFor, "10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		// a malformed hop stops the walk at the last trusted one
+		{"10.0.0.1:1234", []string{HeaderXForwardedFor, "203.0.113.1, unknown, 10.0.0.3"}, "10.0.0.3"},
+		// X-Real-IP without X-Forwarded-For
+		{"10.0.0.1:1234", []string{HeaderXRealIP, "203.0.113.5"}, "203.0.113.5"},
+		{"10.0.0.1:1234", []string{HeaderXRealIP, "bogus"}, "10.0.0.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		// IPv6 with brackets, ports and zones
+		{"[::1]:1234", []string{HeaderXForwardedFor, "[2001:db8::1]:443"}, "2001:db8::1"},
+		{"[fe80::1%eth0]:1234", []string{HeaderXForwardedFor, "2001:db8::2, fe80::2%eth0"}, "2001:db8::2"},
+		{"[::ffff:10.0.0.1]:1234", []string{HeaderXForwardedFor, "203.0.113.1"}, "203.0.113.1"},
+		{"[2001:db8::9]:1234", []string{HeaderXForwardedFor, "203.0.113.1"}, "2001:db8::9"},
+	} {
+		if ip := realIP(c.remoteAddr, c.header...); ip != c.want {
+			t.Errorf("%d: got %q, want %q", i, ip, c.want)
+		}
+	}
+
+	if err := a.SetTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("an invalid CIDR is accepted")
+	}
+	if err := a.SetTrustedProxies("proxy.local"); err == nil {
+		t.Error("a host name is accepted")
+	}
+}
+
+func TestScheme(t *testing.T) {
+	defer func(proxies []netip.Prefix) { app.trustedProxies = proxies }(app.trustedProxies)
+	if err := app.SetTrustedProxies("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	scheme := func(remoteAddr string, tls bool, header ...string) string {
+		target := "http://example.com/"
+		if tls {
+			target = "https://example.com/"
+		}
+		req := httptest.NewRequest(GET, target, nil)
+		req.RemoteAddr = remoteAddr
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Add(header[i], header[i+1])
+		}
+		c := app.newContext(new(Response), req)
+		c.init(httptest.NewRecorder(), req)
+		defer c.free()
+		if c.IsTLS() != (c.Scheme() == "https") {
+			t.Errorf("IsTLS is %v for %s", c.IsTLS(), c.Scheme())
+		}
+		return c.Scheme()
+	}
+	for i, c := range []struct {
+		remoteAddr string
+		tls        bool
+		header     []string
+		want       string
+	}{
+		{"198.51.100.7:1234", true, nil, "https"},
+		{"198.51.100.7:1234", false, nil, "http"},
+		// spoofed by an untrusted client
+		{"198.51.100.7:1234", false, []string{HeaderXForwardedProto, "https"}, "http"},
+		{"198.51.100.7:1234", false, []string{HeaderXForwardedSsl, "on"}, "http"},
+		{"198.51.100.7:1234", false, []string{HeaderForwarded, "proto=https"}, "http"},
+		// from a trusted proxy
+		{"10.0.0.1:1234", false, []string{HeaderXForwardedProto, "https"}, "https"},
+		{"10.0.0.1:1234", false, []string{HeaderXForwardedProto, "HTTPS, http"}, "https"},
+		{"10.0.0.1:1234", false, []string{HeaderXForwardedSsl, "on"}, "https"},
+		{"10.0.0.1:1234", false, []string{HeaderForwarded, `for=192.0.2.60;proto="https";by=10.0.0.1, for=10.0.0.2;proto=http`}, "https"},
+		{"10.0.0.1:1234", false, []string{HeaderXForwardedProto, "javascript"}, "http"},
+		// the connection is over TLS anyway
+		{"10.0.0.1:1234", true, []string{HeaderXForwardedProto, "http"}, "https"},
+	} {
+		if got := scheme(c.remoteAddr, c.tls, c.header...); got != c.want {
+			t.Errorf("%d: got %q, want %q", i, got, c.want)
+		}
+	}
+}
+
+func TestWrapHandlerInterfaces(t *testing.T) {
+	release := make(chan struct{})
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/ws", WrapHandler(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	})))
+	a.addwithlog(false, GET, "/events", WrapHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		f, ok := rw.(http.Flusher)
+		if !ok {
+			http.Error(rw, "no flusher", http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set(HeaderContentType, "text/event-stream")
+		fmt.Fprint(rw, "data: 1\n\n")
+		f.Flush()
+		<-release
+	})))
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	addr, errc := serveTestApp(t, a)
+	defer func() {
+		a.Shutdown(context.Background())
+		<-errc
+	}()
+
+	// the WebSocket upgrade hijacks the connection through the wrapped writer
+	ws, err := websocket.Dial("ws://"+addr+"/ws", "", "http://"+addr+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(ws, b); err != nil || string(b) != "hello" {
+		t.Errorf("websocket echo: got %q, %v", b, err)
+	}
+	ws.Close()
+
+	// the event is flushed before the handler returns
+	resp, err := http.Get("http://" + addr + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	close(release)
+	resp.Body.Close()
+	if err != nil || line != "data: 1\n" || resp.StatusCode != http.StatusOK {
+		t.Errorf("server-sent event: got %d %q, %v", resp.StatusCode, line, err)
+	}
+
+	// only the interfaces of the underlying writer are exposed
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(GET, "/", nil)
+	c := a.newContext(new(Response), req)
+	c.init(rec, req)
+	defer c.free()
+	rw := c.ResponseWriter()
+	if _, ok := rw.(http.Flusher); !ok {
+		t.Error("http.Flusher of the recorder is lost")
+	}
+	if _, ok := rw.(http.Hijacker); ok {
+		t.Error("http.Hijacker is exposed for the recorder")
+	}
+	if _, ok := rw.(http.Pusher); ok {
+		t.Error("http.Pusher is exposed for the recorder")
+	}
+	if u, ok := rw.(interface{ Unwrap() http.ResponseWriter }); !ok || u.Unwrap() != rec {
+		t.Error("the recorder is not unwrapped")
+	}
+	if n, err := io.Copy(rw, strings.NewReader("body")); err != nil || n != 4 || c.response.Size() != 4 || rec.Body.String() != "body" {
+		t.Errorf("io.Copy: got %d, %v, size %d", n, err, c.response.Size())
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	for i, c := range []struct {
+		accept string
+		offers []string
+		want   string
+	}{
+		{"", []string{MIMEApplicationJSON, MIMETextHTML}, MIMEApplicationJSON},
+		{"text/html", []string{MIMEApplicationJSON, MIMETextHTML}, MIMETextHTML},
+		{"text/html", []string{MIMEApplicationJSON}, ""},
+		{"application/json;q=0.5, text/html", []string{MIMEApplicationJSON, MIMETextHTML}, MIMETextHTML},
+		// the earlier offer wins a tie
+		{"*/*", []string{MIMETextHTML, MIMEApplicationJSON}, MIMETextHTML},
+		{"text/*;q=0.8, */*;q=0.1", []string{MIMEApplicationJSON, "text/plain"}, "text/plain"},
+		// the most specific range decides
+		{"text/*, text/html;q=0", []string{MIMETextHTML, "text/plain"}, "text/plain"},
+		{"text/html;level=1, text/html;q=0.3", []string{"text/html", "text/html;level=1"}, "text/html;level=1"},
+		{"*", []string{MIMEApplicationJSON}, MIMEApplicationJSON},
+		{"TEXT/HTML", []string{MIMETextHTML}, MIMETextHTML},
+		// malformed entries are ignored
+		{"text, /html, */json, text/html;q=abc, application/json;q=0.9", []string{MIMETextHTML, MIMEApplicationJSON}, MIMEApplicationJSON},
+		{",,;q=1", []string{MIMEApplicationJSON}, ""},
+		{"application/json;q=0", []string{MIMEApplicationJSON}, ""},
+	} {
+		req := httptest.NewRequest(GET, "/", nil)
+		req.Header.Set(HeaderAccept, c.accept)
+		ctx := app.newContext(new(Response), req)
+		ctx.init(httptest.NewRecorder(), req)
+		if got := ctx.Accepts(c.offers...); got != c.want {
+			t.Errorf("%d: Accepts(%q) with %q: got %q, want %q", i, c.offers, c.accept, got, c.want)
+		}
+		ctx.free()
+	}
+	if got := acceptsOffer("text/html", nil); got != "" {
+		t.Errorf("no offers: got %q", got)
+	}
+
+	// Negotiate sends XML only if it is preferred to JSON
+	type value struct{ A string }
+	for accept, want := range map[string]string{
+		"":                                  MIMEApplicationJSONCharsetUTF8,
+		"*/*":                               MIMEApplicationJSONCharsetUTF8,
+		"application/xml, application/json": MIMEApplicationJSONCharsetUTF8,
+		"text/xml":                          MIMEApplicationXMLCharsetUTF8,
+		"application/xml;q=0.9, */*;q=0.8":  MIMEApplicationXMLCharsetUTF8,
+	} {
+		req := httptest.NewRequest(GET, "/", nil)
+		req.Header.Set(HeaderAccept, accept)
+		rec := httptest.NewRecorder()
+		ctx := app.newContext(new(Response), req)
+		ctx.init(rec, req)
+		ctx.Negotiate(http.StatusOK, value{"a"})
+		ctx.free()
+		if got := rec.Header().Get(HeaderContentType); got != want {
+			t.Errorf("Negotiate with %q: got %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func BenchmarkAccepts(b *testing.B) {
+	accept := "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8"
+	offers := []string{MIMEApplicationJSON, MIMEApplicationXML, MIMETextHTML}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		acceptsOffer(accept, offers)
+	}
+}
+
+func TestRewriteURL(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/new/:id", func(c *Context) error {
+		return c.String(http.StatusOK, c.Request().URL.RequestURI()+" "+c.PathParam("id")+" "+c.QueryParam("v"))
+	})
+	a.addwithlog(false, GET, "/old/:id", func(c *Context) error {
+		return c.String(http.StatusOK, "old "+c.PathParam("id")+" "+c.QueryParam("v"))
+	})
+	a.beforeUse(func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if c.QueryParam("rewrite") != "" {
+				c.SetURLPath(strings.Replace(c.Request().URL.Path, "/old/", "/new/", 1))
+				c.SetQueryString("v=1")
+				c.AddQueryParam("v", "2")
+			}
+			return next(c)
+		}
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for _, c := range []struct{ target, want string }{
+		{"/old/x?rewrite=1", "/new/x?v=1&v=2 x 1"},
+		// the next request reusing the Context sees its own path and query
+		{"/old/y?v=3", "old y 3"},
+	} {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, c.target, nil))
+		if rec.Body.String() != c.want {
+			t.Errorf("%s: got %q, want %q", c.target, rec.Body.String(), c.want)
+		}
+	}
+}
+
+// zeroReader reads zeros endlessly.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestStream(t *testing.T) {
+	const size = 100 << 20
+	var (
+		steps   int64
+		stopped = make(chan error, 1)
+	)
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/export.csv", func(c *Context) error {
+		return c.Stream(http.StatusOK, "text/csv", io.LimitReader(zeroReader{}, size))
+	})
+	a.addwithlog(false, GET, "/endless", func(c *Context) error {
+		err := c.StreamFunc(http.StatusOK, MIMEOctetStream, func(w io.Writer) bool {
+			atomic.AddInt64(&steps, 1)
+			w.Write(make([]byte, 32<<10))
+			return true
+		})
+		stopped <- err
+		return nil
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	addr, errc := serveTestApp(t, a)
+	defer func() {
+		a.Shutdown(context.Background())
+		<-errc
+	}()
+
+	// 100MB under constant memory
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	resp, err := http.Get("http://" + addr + "/export.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	runtime.ReadMemStats(&after)
+	if err != nil || n != size || resp.Header.Get(HeaderContentType) != "text/csv" {
+		t.Fatalf("got %d bytes of %q, %v", n, resp.Header.Get(HeaderContentType), err)
+	}
+	if after.HeapAlloc > before.HeapAlloc+16<<20 {
+		t.Errorf("the heap grows from %d to %d bytes", before.HeapAlloc, after.HeapAlloc)
+	}
+
+	// the stream stops once the client goes away
+	resp, err = http.Get("http://" + addr + "/endless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.CopyN(ioutil.Discard, resp.Body, 1<<20)
+	resp.Body.Close()
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Error("no error after the client has gone away")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream is not stopped")
+	}
+	n = atomic.LoadInt64(&steps)
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt64(&steps) != n {
+		t.Error("step is called after the stream is stopped")
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	for i, c := range []struct {
+		header     string
+		user, pass string
+		basicOK    bool
+		token      string
+		bearerOK   bool
+	}{
+		{"", "", "", false, "", false},
+		{"Basic dXNlcjpwYXNz", "user", "pass", true, "", false},
+		{"basic dXNlcjpwYXNz", "user", "pass", true, "", false},
+		{"Basic dXNlcjo=", "user", "", true, "", false},
+		{"Basic ", "", "", false, "", false},
+		{"Basic  dXNlcjpwYXNz", "", "", false, "", false},
+		{"Basic dXNlcg==", "", "", false, "", false}, // no colon
+		{"Bearer abc.DEF-123_~+/==", "", "", false, "abc.DEF-123_~+/==", true},
+		{"BEARER abc", "", "", false, "abc", true},
+		{"Bearer", "", "", false, "", false},
+		{"Bearer ", "", "", false, "", false},
+		{"Bearer  abc", "", "", false, "", false},
+		{"Bearer abc def", "", "", false, "", false},
+		{"Bearer ==", "", "", false, "", false},
+		{"Token abc", "", "", false, "", false},
+	} {
+		req := httptest.NewRequest(GET, "/", nil)
+		if c.header != "" {
+			req.Header.Set(HeaderAuthorization, c.header)
+		}
+		ctx := app.newContext(new(Response), req)
+		ctx.init(httptest.NewRecorder(), req)
+		if user, pass, ok := ctx.BasicAuth(); user != c.user || pass != c.pass || ok != c.basicOK {
+			t.Errorf("%d: BasicAuth of %q: got %q, %q, %v", i, c.header, user, pass, ok)
+		}
+		if token, ok := ctx.BearerToken(); token != c.token || ok != c.bearerOK {
+			t.Errorf("%d: BearerToken of %q: got %q, %v", i, c.header, token, ok)
+		}
+		ctx.free()
+	}
+}
+
+func TestFileRangeAndETag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lessgo-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "video.mp4"), []byte("0123456789abcdefghij"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := newApp()
+	a.resetRouterBegin()
+	a.static("/static", dir)
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	get := func(header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(GET, "/static/video.mp4", nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get()
+	etag := rec.Header().Get(HeaderETag)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 20 || etag == "" {
+		t.Fatalf("got %d with %d bytes, ETag %q", rec.Code, rec.Body.Len(), etag)
+	}
+	// the middle of the file
+	if rec = get("Range", "bytes=8-11"); rec.Code != http.StatusPartialContent || rec.Body.String() != "89ab" ||
+		rec.Header().Get("Content-Range") != "bytes 8-11/20" {
+		t.Errorf("range: got %d %q %q", rec.Code, rec.Body.String(), rec.Header().Get("Content-Range"))
+	}
+	if rec = get(HeaderIfNoneMatch, etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("matching ETag: got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if rec = get(HeaderIfNoneMatch, `"other"`); rec.Code != http.StatusOK {
+		t.Errorf("other ETag: got %d", rec.Code)
+	}
+	// a stale If-Range sends the whole file
+	if rec = get("Range", "bytes=8-11", "If-Range", `"stale"`); rec.Code != http.StatusOK || rec.Body.Len() != 20 {
+		t.Errorf("stale If-Range: got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+}
+
+func TestSuperfluousWriteHeader(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/", func(c *Context) error {
+		return c.String(http.StatusOK, "ok")
+	}, func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if c.QueryParam("deny") != "" {
+				c.String(http.StatusForbidden, "denied")
+			}
+			// the handler is still called by mistake
+			return next(c)
+		}
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, target, nil))
+		return rec
+	}
+
+	// the status is kept, the body is appended by default
+	if rec := get("/?deny=1"); rec.Code != http.StatusForbidden || rec.Body.String() != "deniedok" {
+		t.Errorf("got %d %q", rec.Code, rec.Body.String())
+	}
+	a.SetDiscardSuperfluousWrites(true)
+	for i := 0; i < 2; i++ {
+		if rec := get("/?deny=1"); rec.Code != http.StatusForbidden || rec.Body.String() != "denied" {
+			t.Errorf("discarded: got %d %q", rec.Code, rec.Body.String())
+		}
+		// the recycled Response is not committed any more
+		if rec := get("/"); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+			t.Errorf("next request: got %d %q", rec.Code, rec.Body.String())
+		}
+	}
+
+	if pos := func() string { return callerOutside() }(); !strings.Contains(pos, "app_test.go:") {
+		t.Errorf("callerOutside: got %s", pos)
+	}
+}
+
+func TestParseForm(t *testing.T) {
+	a := newApp()
+	a.SetMaxBodyBytes(16)
+	a.resetRouterBegin()
+	a.addwithlog(false, DELETE, "/items", func(c *Context) error {
+		if err := c.ParseForm(); err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, c.FormValue("id")+" "+c.FormValue("force")+" "+strings.Join(c.FormParams("id"), ","))
+	})
+	a.addwithlog(false, PATCH, "/items", func(c *Context) error {
+		if err := c.ParseForm(); err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, c.FormValue("id"))
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	send := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(HeaderContentType, contentType)
+		// an unknown length, checked by the reader
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the body of DELETE is parsed, and it takes precedence over the query
+	if rec := send(DELETE, "/items?id=9&force=1", MIMEApplicationForm+"; charset=UTF-8", "id=1&id=2"); rec.Body.String() != "1 1 1,2" {
+		t.Errorf("DELETE: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := send(DELETE, "/items?id=9", MIMEApplicationJSON, `{"id":1}`); rec.Body.String() != "9  " {
+		t.Errorf("DELETE with JSON: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := send(PATCH, "/items", MIMEApplicationForm, "id=3"); rec.Body.String() != "3" {
+		t.Errorf("PATCH: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := send(DELETE, "/items", MIMEApplicationForm, "id="+strings.Repeat("x", 32)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("DELETE too large: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := send(PATCH, "/items", MIMEApplicationForm, "id="+strings.Repeat("x", 32)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PATCH too large: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := send(DELETE, "/items", MIMEApplicationForm, "id=%zz"); rec.Code != http.StatusInternalServerError && rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestJSONP(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/jsonp", func(c *Context) error {
+		return c.JSONP(http.StatusOK, c.QueryParam("callback"), map[string]string{"a": "</script>"})
+	})
+	a.addwithlog(false, GET, "/blob", func(c *Context) error {
+		return c.JSONPBlob(http.StatusCreated, c.QueryParam("callback"), []byte(`[1,2]`))
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for _, tc := range []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/jsonp?callback=jQuery123_456", http.StatusOK, `jQuery123_456({"a":"\u003c/script\u003e"});`},
+		{"/blob?callback=cbs[0].$done", http.StatusCreated, `cbs[0].$done([1,2]);`},
+		{"/blob?callback=", http.StatusBadRequest, ""},
+		{"/blob?callback=alert(1)//", http.StatusBadRequest, ""},
+		{"/jsonp?callback=a%3Bb", http.StatusBadRequest, ""},
+		{"/jsonp?callback=%3Cscript%3E", http.StatusBadRequest, ""},
+	} {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, tc.target, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s: got %d, want %d", tc.target, rec.Code, tc.code)
+			continue
+		}
+		if tc.code == http.StatusBadRequest {
+			if strings.Contains(rec.Body.String(), "(") && rec.Header().Get(HeaderContentType) == MIMEApplicationJavaScriptCharsetUTF8 {
+				t.Errorf("%s: the JSONP is sent: %q", tc.target, rec.Body.String())
+			}
+			continue
+		}
+		// indented in debug mode
+		body := strings.NewReplacer("\n", "", " ", "").Replace(rec.Body.String())
+		if body != tc.body || rec.Header().Get(HeaderContentType) != MIMEApplicationJavaScriptCharsetUTF8 {
+			t.Errorf("%s: got %q %q, want %q", tc.target, rec.Header().Get(HeaderContentType), body, tc.body)
+		}
+	}
+}
+
+func TestBlob(t *testing.T) {
+	req := httptest.NewRequest(GET, "/", nil)
+	rec := httptest.NewRecorder()
+	c := app.newContext(new(Response), req)
+	c.init(rec, req)
+	defer c.free()
+
+	if err := c.Blob(http.StatusAccepted, "image/png", []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusAccepted || rec.Header().Get(HeaderContentType) != "image/png" || rec.Body.String() != "png" {
+		t.Fatalf("got %d %q %q", rec.Code, rec.Header().Get(HeaderContentType), rec.Body.String())
+	}
+
+	// nothing is written once the response is committed
+	if err := c.Blob(http.StatusOK, MIMETextPlain, []byte("late")); err != ErrResponseCommitted {
+		t.Errorf("Blob: got %v, want %v", err, ErrResponseCommitted)
+	}
+	r := strings.NewReader("late")
+	if err := c.Stream(http.StatusOK, MIMETextPlain, r); err != ErrResponseCommitted || r.Len() != 4 {
+		t.Errorf("Stream: got %v, %d bytes read, want %v", err, 4-r.Len(), ErrResponseCommitted)
+	}
+	if rec.Body.String() != "png" || rec.Header().Get(HeaderContentType) != "image/png" {
+		t.Errorf("got %q %q after committed", rec.Header().Get(HeaderContentType), rec.Body.String())
+	}
+}
+
+func TestAttachmentFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lessgo-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "report.pdf")
+	if err = ioutil.WriteFile(file, []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/attachment", func(c *Context) error {
+		return c.AttachmentFile(filepath.Join(dir, c.QueryParam("file")), c.QueryParam("name"))
+	})
+	a.addwithlog(false, GET, "/inline", func(c *Context) error {
+		return c.InlineFile(file, "")
+	})
+	a.addwithlog(false, GET, "/reader", func(c *Context) error {
+		return c.Attachment(strings.NewReader("a,b"), `say "hi".csv`)
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	get := func(target string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(GET, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		target      string
+		disposition string
+	}{
+		{"/attachment?file=report.pdf", `attachment; filename="report.pdf"`},
+		{"/attachment?file=report.pdf&name=annual+report.pdf", `attachment; filename="annual report.pdf"`},
+		{"/attachment?file=report.pdf&name=r%C3%A9sum%C3%A9+2024.pdf", `attachment; filename="r_sum_ 2024.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9%202024.pdf`},
+		{"/attachment?file=report.pdf&name=a%0D%0Ab.pdf", `attachment; filename="a__b.pdf"; filename*=UTF-8''a%0D%0Ab.pdf`},
+		{"/inline", `inline; filename="report.pdf"`},
+	} {
+		rec := get(tc.target)
+		if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+			t.Errorf("%s: got %d %q", tc.target, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get(HeaderContentDisposition); got != tc.disposition {
+			t.Errorf("%s: got %s, want %s", tc.target, got, tc.disposition)
+		}
+		if ct := rec.Header().Get(HeaderContentType); ct != "application/pdf" {
+			t.Errorf("%s: got Content-Type %q", tc.target, ct)
+		}
+	}
+
+	rec := get("/attachment?file=report.pdf", "Range", "bytes=2-4")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" || rec.Header().Get(HeaderETag) == "" {
+		t.Errorf("range: got %d %q, ETag %q", rec.Code, rec.Body.String(), rec.Header().Get(HeaderETag))
+	}
+
+	rec = get("/reader")
+	if rec.Code != http.StatusOK || rec.Body.String() != "a,b" || rec.Header().Get(HeaderContentDisposition) != `attachment; filename="say \"hi\".csv"` {
+		t.Errorf("reader: got %d %q %s", rec.Code, rec.Body.String(), rec.Header().Get(HeaderContentDisposition))
+	}
+
+	// the path of a missing file is not leaked
+	for _, target := range []string{"/attachment?file=missing.pdf", "/attachment?file=."} {
+		rec = get(target)
+		if rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), dir) || rec.Header().Get(HeaderContentDisposition) != "" {
+			t.Errorf("%s: got %d %q", target, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// newIdempotencyApp serves POST /pay with the Idempotency middleware of the JSON config and a fresh store,
+// handler is called with the number of its calls so far.
+func newIdempotencyApp(t *testing.T, config string, handler func(c *Context, n int32) error) (*App, *int32) {
+	store := idempotencyStore
+	SetIdempotencyStore(&memoryIdempotencyStore{items: map[string]*idempotencyItem{}})
+	t.Cleanup(func() { SetIdempotencyStore(store) })
+	calls := new(int32)
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, POST, "/pay", func(c *Context) error {
+		return handler(c, atomic.AddInt32(calls, 1))
+	}, testMiddleware(t, Idempotency, config))
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	return a, calls
+}
+
+func postIdempotent(a *App, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(POST, "/pay", nil)
+	if key != "" {
+		req.Header.Set(HeaderIdempotencyKey, key)
+	}
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	a, calls := newIdempotencyApp(t, `{"ttl":60,"wait":0,"max_body_size":16}`, func(c *Context, n int32) error {
+		c.Response().Header().Add("X-Charge", "c"+strconv.Itoa(int(n)))
+		if c.QueryParam("big") != "" {
+			return c.String(http.StatusCreated, strings.Repeat("x", 17))
+		}
+		return c.String(http.StatusCreated, "charged "+strconv.Itoa(int(n)))
+	})
+	first := postIdempotent(a, "k1")
+	second := postIdempotent(a, "k1")
+	if *calls != 1 {
+		t.Fatalf("the handler is called %d times", *calls)
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != "charged 1" || second.Header().Get("X-Charge") != "c1" ||
+		second.Header().Get(HeaderIdempotentReplayed) != "true" || first.Header().Get(HeaderIdempotentReplayed) != "" {
+		t.Errorf("replay: got %d %q %v", second.Code, second.Body.String(), second.Header())
+	}
+	// the replays do not share the header values with the record
+	second.Header()["X-Charge"][0] = "changed"
+	if third := postIdempotent(a, "k1"); third.Header().Get("X-Charge") != "c1" {
+		t.Errorf("the recorded header is shared: %q", third.Header().Get("X-Charge"))
+	}
+
+	if rec := postIdempotent(a, "k2"); rec.Body.String() != "charged 2" {
+		t.Errorf("another key: got %q", rec.Body.String())
+	}
+	if rec := postIdempotent(a, ""); rec.Body.String() != "charged 3" {
+		t.Errorf("no key: got %q", rec.Body.String())
+	}
+
+	// a body larger than max_body_size is responded but not recorded
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(POST, "/pay?big=1", nil)
+		req.Header.Set(HeaderIdempotencyKey, "k3")
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		if rec.Body.Len() != 17 || rec.Header().Get(HeaderIdempotentReplayed) != "" {
+			t.Errorf("big body: got %d bytes, replayed %q", rec.Body.Len(), rec.Header().Get(HeaderIdempotentReplayed))
+		}
+	}
+	if *calls != 5 {
+		t.Errorf("the handler is called %d times, want 5", *calls)
+	}
+}
+
+func TestIdempotencyTTL(t *testing.T) {
+	store := &memoryIdempotencyStore{items: map[string]*idempotencyItem{}}
+	store.Set("k", &IdempotentResponse{Status: http.StatusOK}, 20*time.Millisecond)
+	if _, ok := store.Get("k"); !ok {
+		t.Fatal("the response is not stored")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := store.Get("k"); ok {
+		t.Fatal("the response is replayed after the TTL")
+	}
+
+	a, calls := newIdempotencyApp(t, `{"ttl":1,"wait":0}`, func(c *Context, n int32) error {
+		return c.String(http.StatusOK, strconv.Itoa(int(n)))
+	})
+	postIdempotent(a, "k")
+	if rec := postIdempotent(a, "k"); rec.Body.String() != "1" {
+		t.Fatalf("within the TTL: got %q", rec.Body.String())
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if rec := postIdempotent(a, "k"); rec.Body.String() != "2" || *calls != 2 {
+		t.Fatalf("after the TTL: got %q, %d calls", rec.Body.String(), *calls)
+	}
+}
+
+func TestIdempotencyConcurrent(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		code   int // of the request arriving while the first one is in flight
+		body   string
+	}{
+		{`{"ttl":60,"wait":10}`, http.StatusOK, "done"}, // waits and replays
+		{`{"ttl":60,"wait":0}`, http.StatusConflict, ""},
+	} {
+		started, finish := make(chan struct{}), make(chan struct{})
+		a, calls := newIdempotencyApp(t, tc.config, func(c *Context, n int32) error {
+			if n == 1 {
+				close(started)
+				<-finish
+			}
+			return c.String(http.StatusOK, "done")
+		})
+		firstDone := make(chan *httptest.ResponseRecorder)
+		go func() { firstDone <- postIdempotent(a, "k") }()
+		<-started
+
+		secondDone := make(chan *httptest.ResponseRecorder)
+		go func() { secondDone <- postIdempotent(a, "k") }()
+		if tc.code == http.StatusOK {
+			time.Sleep(20 * time.Millisecond) // let the second request wait
+		} else if rec := <-secondDone; rec.Code != tc.code {
+			t.Errorf("%s: in flight: got %d %q, want %d", tc.config, rec.Code, rec.Body.String(), tc.code)
+		}
+		close(finish)
+		if rec := <-firstDone; rec.Body.String() != "done" {
+			t.Errorf("%s: first: got %d %q", tc.config, rec.Code, rec.Body.String())
+		}
+		if tc.code == http.StatusOK {
+			if rec := <-secondDone; rec.Code != tc.code || rec.Body.String() != tc.body || rec.Header().Get(HeaderIdempotentReplayed) != "true" {
+				t.Errorf("%s: waiting: got %d %q, want a replay", tc.config, rec.Code, rec.Body.String())
+			}
+		}
+		if *calls != 1 {
+			t.Errorf("%s: the handler is called %d times", tc.config, *calls)
+		}
+	}
+
+	// the waiting request gives up when the client goes away
+	started, finish := make(chan struct{}), make(chan struct{})
+	a, _ := newIdempotencyApp(t, `{"ttl":60,"wait":60}`, func(c *Context, n int32) error {
+		if n == 1 {
+			close(started)
+			<-finish
+		}
+		return c.String(http.StatusOK, "done")
+	})
+	firstDone := make(chan struct{})
+	go func() {
+		postIdempotent(a, "k")
+		close(firstDone)
+	}()
+	defer func() {
+		close(finish)
+		<-firstDone
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(POST, "/pay", nil).WithContext(ctx)
+	req.Header.Set(HeaderIdempotencyKey, "k")
+	done := make(chan struct{})
+	go func() {
+		a.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting request is not canceled")
+	}
+}
+
+func TestSizeMetrics(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, POST, "/size", func(c *Context) error {
+		ioutil.ReadAll(c.request.Body)
+		return c.String(http.StatusOK, strings.Repeat("x", 500))
+	}, testMiddleware(t, SizeMetrics, `{"buckets":[100,10]}`))
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(POST, "/size", strings.NewReader(strings.Repeat("y", 50))))
+
+	var buf bytes.Buffer
+	if err := WriteSizeMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`lessgo_request_size_bytes_bucket{method="POST",route="/size",le="10"} 0`,
+		`lessgo_request_size_bytes_bucket{method="POST",route="/size",le="100"} 1`,
+		`lessgo_request_size_bytes_sum{method="POST",route="/size"} 50`,
+		`lessgo_response_size_bytes_bucket{method="POST",route="/size",le="100"} 0`,
+		`lessgo_response_size_bytes_bucket{method="POST",route="/size",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %s in:\n%s", want, buf.String())
+		}
+	}
+	// the same buckets in another order keep the counts
+	testMiddleware(t, SizeMetrics, `{"buckets":[10,100]}`)
+	buf.Reset()
+	WriteSizeMetrics(&buf)
+	if !strings.Contains(buf.String(), `route="/size"`) {
+		t.Error("the counts are reset by the same buckets")
+	}
+
+	// the metrics of another bucket config are written as well
+	b := newApp()
+	b.resetRouterBegin()
+	b.addwithlog(false, GET, "/other", func(c *Context) error {
+		return c.String(http.StatusOK, "other")
+	}, testMiddleware(t, SizeMetrics, `{"buckets":[1000]}`))
+	b.resetChain()
+	b.resetRouterEnd()
+	b.SetStatus(true)
+	b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, "/other", nil))
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(POST, "/size", strings.NewReader("y")))
+	buf.Reset()
+	if err := WriteSizeMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`lessgo_request_size_bytes_count{method="POST",route="/size"} 2`,
+		`lessgo_request_size_bytes_bucket{method="POST",route="/size",le="100"} 2`,
+		`lessgo_response_size_bytes_bucket{method="GET",route="/other",le="1000"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %s in:\n%s", want, buf.String())
+		}
+	}
+	if n := strings.Count(buf.String(), "# TYPE lessgo_request_size_bytes histogram"); n != 1 {
+		t.Errorf("got %d TYPE lines of the request family", n)
+	}
+
+	// the buckets are changed while the metrics are written and observed
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			testMiddleware(t, SizeMetrics, fmt.Sprintf(`{"buckets":[%d]}`, 10+i%2))
+		}(i)
+		go func() {
+			defer wg.Done()
+			WriteSizeMetrics(ioutil.Discard)
+		}()
+		go func() {
+			defer wg.Done()
+			a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(POST, "/size", nil))
+		}()
+	}
+	wg.Wait()
+	testMiddleware(t, SizeMetrics, "")
+	// a route observed with several bucket configs is written once, from the newest one
+	buf.Reset()
+	WriteSizeMetrics(&buf)
+	if n := strings.Count(buf.String(), `lessgo_request_size_bytes_count{method="POST",route="/size"}`); n != 1 {
+		t.Errorf("got %d series of /size in:\n%s", n, buf.String())
+	}
+}
+
+func TestRequireBody(t *testing.T) {
+	handler := func(c *Context) error {
+		b, err := ioutil.ReadAll(c.request.Body)
+		if err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, string(b))
+	}
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, POST, "/default", handler, testMiddleware(t, RequireBody, ""))
+	a.addwithlog(false, GET, "/default", handler, testMiddleware(t, RequireBody, ""))
+	a.addwithlog(false, DELETE, "/delete", handler, testMiddleware(t, RequireBody, `{"methods":["delete"]}`))
+	a.addwithlog(false, POST, "/delete", handler, testMiddleware(t, RequireBody, `{"methods":["delete"]}`))
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for i, tc := range []struct {
+		method, path string
+		body         io.Reader
+		length       int64 // -1 for a chunked body without Content-Length
+		status       int
+	}{
+		{POST, "/default", nil, 0, http.StatusBadRequest},
+		{POST, "/default", strings.NewReader(""), 0, http.StatusBadRequest},
+		{POST, "/default", strings.NewReader("abc"), 3, http.StatusOK},
+		{POST, "/default", strings.NewReader("abc"), -1, http.StatusOK},
+		{POST, "/default", strings.NewReader(""), -1, http.StatusBadRequest},
+		{GET, "/default", nil, 0, http.StatusOK},
+		{DELETE, "/delete", nil, 0, http.StatusBadRequest},
+		{DELETE, "/delete", strings.NewReader("x"), -1, http.StatusOK},
+		{POST, "/delete", nil, 0, http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, tc.body)
+		req.ContentLength = tc.length
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%d: %s %s: got %d, want %d", i, tc.method, tc.path, rec.Code, tc.status)
+		}
+		if rec.Code == http.StatusOK && tc.body != nil && tc.length != 0 {
+			// the body is not consumed by the check
+			if want := map[string]string{"/default": "abc", "/delete": "x"}[tc.path]; rec.Body.String() != want {
+				t.Errorf("%d: got body %q, want %q", i, rec.Body.String(), want)
+			}
+		}
+	}
+}
+
+func TestMaxQueryParams(t *testing.T) {
+	for _, q := range []string{"", "a", "a=1", "a=1&b=2", "a&a&a", "a=1&&b=2&", "&&", "=1&b"} {
+		values, _ := url.ParseQuery(q)
+		var want int
+		for _, vs := range values {
+			want += len(vs)
+		}
+		if got := countQueryParams(q); got != want {
+			t.Errorf("%q: got %d, want %d like url.ParseQuery", q, got, want)
+		}
+	}
+
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/search", func(c *Context) error {
+		return c.String(http.StatusOK, strconv.Itoa(len(c.QueryValues())))
+	}, testMiddleware(t, MaxQueryParams, `{"max":3}`))
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	for q, status := range map[string]int{
+		"":                  http.StatusOK,
+		"a=1&b=2&c=3":       http.StatusOK, // at the limit
+		"a=1&a=2&a=3":       http.StatusOK,
+		"a=1&&b=2&&c=3&":    http.StatusOK, // the empty pairs are not counted
+		"a=1&b=2&c=3&d=4":   http.StatusBadRequest,
+		"a&a&a&a":           http.StatusBadRequest,
+		"a=1&b=2&c=3&d=4&e": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, "/search?"+q, nil))
+		if rec.Code != status {
+			t.Errorf("%q: got %d, want %d", q, rec.Code, status)
+		}
+		if status == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "the max is 3") {
+			t.Errorf("%q: got %q", q, rec.Body.String())
+		}
+	}
+}
+
+func TestRunAsync(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	old := Config.Listen
+	defer func() { Config.Listen = old }()
+
+	// the terminal error of a server that cannot start is received
+	Config.Listen = Listen{Address: addr}
+	select {
+	case err := <-RunAsync():
+		if err == nil {
+			t.Fatal("address in use: got nil error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("address in use: no error received")
+	}
+	l.Close()
+
+	errc := RunAsync()
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = http.Get("http://" + addr + "/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case err := <-errc:
+		t.Fatalf("got %v while running", err)
+	default:
+	}
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("after Shutdown: got %v, want nil", err)
+	}
+}
+
+func TestSlowRequest(t *testing.T) {
+	type slow struct {
+		path, id string
+		latency  time.Duration
+	}
+	var got []slow
+	SetSlowRequestFunc(func(c *Context, latency time.Duration) {
+		got = append(got, slow{c.Path(), c.PathParam("id"), latency})
+	})
+	defer SetSlowRequestFunc(nil)
+
+	a := newApp()
+	a.resetRouterBegin()
+	mw := testMiddleware(t, SlowRequest, `{"threshold":20}`)
+	a.addwithlog(false, GET, "/slow/:id", func(c *Context) error {
+		time.Sleep(30 * time.Millisecond)
+		return c.NoContent(http.StatusOK)
+	}, mw)
+	a.addwithlog(false, GET, "/fast/:id", func(c *Context) error {
+		return c.NoContent(http.StatusOK)
+	}, mw)
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for _, path := range []string{"/fast/1", "/slow/2", "/fast/3"} {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", path, rec.Code)
+		}
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d slow requests, want 1: %+v", len(got), got)
+	}
+	if got[0].path != "/slow/:id" || got[0].id != "2" || got[0].latency < 20*time.Millisecond {
+		t.Errorf("got %+v, want the route /slow/:id, id 2 and a latency over the threshold", got[0])
+	}
+}
+
+func TestUseOnError(t *testing.T) {
+	errMissing := errors.New("user is missing")
+	var calls []string
+	a := newApp()
+	a.UseOnError(func(c *Context, err error) error {
+		calls = append(calls, "translate")
+		if err == errMissing {
+			return NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err.Error() == "handled" {
+			return c.String(http.StatusTeapot, "handled")
+		}
+		return err
+	}, func(c *Context, err error) error {
+		calls = append(calls, "enrich")
+		c.response.Header().Set("X-Error-Hook", "1")
+		return err
+	})
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/missing", func(c *Context) error { return errMissing })
+	a.addwithlog(false, GET, "/handled", func(c *Context) error { return errors.New("handled") })
+	a.addwithlog(false, GET, "/ok", func(c *Context) error { return c.NoContent(http.StatusOK) })
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for _, tc := range []struct {
+		path   string
+		code   int
+		header string
+		calls  string
+	}{
+		{"/missing", http.StatusNotFound, "1", "translate,enrich"},
+		// a hook returning nil skips the remaining hooks and the failure response
+		{"/handled", http.StatusTeapot, "", "translate"},
+		{"/ok", http.StatusOK, "", ""},
+	} {
+		calls = nil
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, tc.path, nil))
+		if rec.Code != tc.code || rec.Header().Get("X-Error-Hook") != tc.header || strings.Join(calls, ",") != tc.calls {
+			t.Errorf("%s: got %d, header %q, calls %v", tc.path, rec.Code, rec.Header().Get("X-Error-Hook"), calls)
+		}
+	}
+}
+
+func TestRequestLoggerSampling(t *testing.T) {
+	var sampled map[string]bool
+	SetAccessLogSampler(func(c *Context, latency time.Duration, s bool) bool {
+		sampled[c.request.URL.Path] = s
+		return false
+	})
+	defer SetAccessLogSampler(nil)
+
+	ok := func(c *Context) error { return c.NoContent(http.StatusOK) }
+	fail := func(c *Context) error { return NewHTTPError(http.StatusInternalServerError) }
+	for _, tc := range []struct {
+		config string
+		want   map[string]bool
+	}{
+		// the default config logs every request
+		{"", map[string]bool{"/rare": true, "/all": true, "/fail": true}},
+		{`{"sample_rate":1000000000,"route_sample_rates":{"/all":1},"always_log_errors":true}`,
+			map[string]bool{"/rare": false, "/all": true, "/fail": true}},
+		{`{"sample_rate":1000000000,"route_sample_rates":{"/all":1}}`,
+			map[string]bool{"/rare": false, "/all": true, "/fail": false}},
+	} {
+		mw := testMiddleware(t, RequestLogger, tc.config)
+		a := newApp()
+		a.resetRouterBegin()
+		a.addwithlog(false, GET, "/rare", ok, mw)
+		a.addwithlog(false, GET, "/all", ok, mw)
+		a.addwithlog(false, GET, "/fail", fail, mw)
+		a.resetChain()
+		a.resetRouterEnd()
+		a.SetStatus(true)
+		sampled = map[string]bool{}
+		for path := range tc.want {
+			a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, path, nil))
+		}
+		if !reflect.DeepEqual(sampled, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.config, sampled, tc.want)
+		}
+	}
+}
+
+// warnLogger records the warnings and passes the other logs to the embedded Logger.
+type warnLogger struct {
+	logs.Logger
+	warns []string
+}
+
+func (l *warnLogger) Warn(format string, v ...interface{}) {
+	l.warns = append(l.warns, fmt.Sprintf(format, v...))
+}
+
+func TestHeaderAfterCommit(t *testing.T) {
+	log := &warnLogger{Logger: Log}
+	Log = log
+	defer func() { Log = log.Logger }()
+
+	req := httptest.NewRequest(GET, "/", nil)
+	rec := httptest.NewRecorder()
+	c := app.newContext(new(Response), req)
+	c.init(rec, req)
+	c.SetHeader("X-Before", "1")
+	c.AddHeader("X-Before", "2")
+	c.DelHeader("X-Deleted")
+	if len(log.warns) != 0 {
+		t.Fatalf("before commit: got warnings %q", log.warns)
+	}
+	c.response.Write([]byte("body"))
+	c.SetHeader("X-After", "1")
+	c.AddHeader("X-After", "2")
+	c.DelHeader("X-Before")
+	if len(log.warns) != 3 {
+		t.Fatalf("after commit: got %d warnings, want 3: %q", len(log.warns), log.warns)
+	}
+	for _, w := range log.warns {
+		// the position of the caller is reported
+		if !strings.Contains(w, "is ignored") || !strings.Contains(w, "app_test.go:") {
+			t.Errorf("got %q", w)
+		}
+	}
+	// the header sent is the one at the commit
+	if h := rec.Result().Header; len(h["X-Before"]) != 2 || h.Get("X-After") != "" {
+		t.Errorf("got header %v", h)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	type user struct {
+		Name string `json:"name" xml:"name"`
+	}
+	h := ApiHandler{
+		Desc:   "TestStatusHandler",
+		Method: "GET",
+		StatusHandler: func(c *Context) (int, interface{}) {
+			switch c.QueryParam("r") {
+			case "nil":
+				return http.StatusNoContent, nil
+			case "string":
+				return http.StatusCreated, "created"
+			case "bytes":
+				return http.StatusOK, []byte{1, 2}
+			case "httperror":
+				return http.StatusOK, NewHTTPError(http.StatusForbidden, "forbidden")
+			case "conflict":
+				return http.StatusConflict, errors.New("already exists")
+			case "error":
+				return http.StatusOK, errors.New("broken")
+			}
+			return http.StatusAccepted, user{"a"}
+		},
+	}.Reg()
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/user", h.Handler)
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for _, tc := range []struct {
+		query, accept string
+		code          int
+		contentType   string
+		body          string
+	}{
+		{"r=nil", "", http.StatusNoContent, "", ""},
+		{"r=string", "", http.StatusCreated, MIMETextPlainCharsetUTF8, "created"},
+		{"r=bytes", "", http.StatusOK, MIMEOctetStream, "\x01\x02"},
+		{"", "", http.StatusAccepted, MIMEApplicationJSONCharsetUTF8, `"name": "a"`},
+		{"", "application/xml, application/json;q=0.5", http.StatusAccepted, MIMEApplicationXMLCharsetUTF8, "<name>a</name>"},
+		{"", "application/xml;q=0.5, application/json", http.StatusAccepted, MIMEApplicationJSONCharsetUTF8, `"name": "a"`},
+		// the returned errors go to the error handler
+		{"r=httperror", "", http.StatusForbidden, "", "forbidden"},
+		{"r=conflict", "", http.StatusConflict, "", "already exists"},
+		{"r=error", "", http.StatusInternalServerError, "", "broken"},
+	} {
+		req := httptest.NewRequest(GET, "/user?"+tc.query, nil)
+		if tc.accept != "" {
+			req.Header.Set(HeaderAccept, tc.accept)
+		}
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		if rec.Code != tc.code || (tc.contentType != "" && rec.Header().Get(HeaderContentType) != tc.contentType) || !strings.Contains(rec.Body.String(), tc.body) {
+			t.Errorf("%q %q: got %d %q %q", tc.query, tc.accept, rec.Code, rec.Header().Get(HeaderContentType), rec.Body.String())
+		}
+	}
+}
+
+func TestBodyBuffer(t *testing.T) {
+	var signed string
+	verify := func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			b, err := ioutil.ReadAll(c.BodyReader())
+			if err != nil {
+				return err
+			}
+			signed = string(b)
+			return next(c)
+		}
+	}
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, POST, "/user", func(c *Context) error {
+		var v struct {
+			Name string `json:"name"`
+		}
+		if err := c.Bind(&v); err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, v.Name)
+	}, testMiddleware(t, BodyBuffer, `{"limit":16}`), verify)
+	a.addwithlog(false, POST, "/upload", func(c *Context) error {
+		return c.String(http.StatusOK, strconv.FormatBool(c.bodyBuffered))
+	}, testMiddleware(t, BodyBuffer, `{"limit":16}`))
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for _, tc := range []struct {
+		body   string
+		length int64 // -1 for a chunked body without Content-Length
+		code   int
+	}{
+		{`{"name":"abc"}`, 14, http.StatusOK},
+		{`{"name":"abc"}`, -1, http.StatusOK},
+		{`{"name":"abcdefgh"}`, 19, http.StatusRequestEntityTooLarge},
+		{`{"name":"abcdefgh"}`, -1, http.StatusRequestEntityTooLarge},
+	} {
+		signed = ""
+		req := httptest.NewRequest(POST, "/user", strings.NewReader(tc.body))
+		req.Header.Set(HeaderContentType, MIMEApplicationJSON)
+		req.ContentLength = tc.length
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s %d: got %d, want %d", tc.body, tc.length, rec.Code, tc.code)
+			continue
+		}
+		// both the middleware and the binder read the whole body
+		if tc.code == http.StatusOK && (signed != tc.body || rec.Body.String() != "abc") {
+			t.Errorf("%s %d: middleware got %q, handler got %q", tc.body, tc.length, signed, rec.Body.String())
+		}
+	}
+
+	// streaming uploads are not buffered
+	req := httptest.NewRequest(POST, "/upload", strings.NewReader(strings.Repeat("x", 32)))
+	req.Header.Set(HeaderContentType, MIMEMultipartForm+"; boundary=x")
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "false" {
+		t.Errorf("multipart: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDefaultFailurePage(t *testing.T) {
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/fail", func(c *Context) error {
+		return errors.New("db <password> is wrong")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for _, tc := range []struct {
+		debug       bool
+		accept      string
+		contentType string
+		has, hasNot string
+	}{
+		{true, "text/html,application/json", MIMETextHTMLCharsetUTF8, "db &lt;password&gt; is wrong", ""},
+		{false, "text/html", MIMETextHTMLCharsetUTF8, "Internal Server Error", "password"},
+		{false, "", MIMETextHTMLCharsetUTF8, "500", "password"},
+		{true, MIMEApplicationJSON, MIMEApplicationJSONCharsetUTF8, `"info":"db \u003cpassword\u003e is wrong"`, ""},
+		{false, MIMEApplicationJSON, MIMEApplicationJSONCharsetUTF8, `{"code":500,"info":"Internal Server Error"}`, "password"},
+	} {
+		a.debug = tc.debug
+		req := httptest.NewRequest(GET, "/fail", nil)
+		req.Header.Set(HeaderAccept, tc.accept)
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		if rec.Code != http.StatusInternalServerError || rec.Header().Get(HeaderContentType) != tc.contentType ||
+			!strings.Contains(body, tc.has) || (tc.hasNot != "" && strings.Contains(body, tc.hasNot)) {
+			t.Errorf("debug %v, accept %q: got %d %q %s", tc.debug, tc.accept, rec.Code, rec.Header().Get(HeaderContentType), body)
+		}
+	}
+}
+
+func TestContextNewHook(t *testing.T) {
+	var allocs int
+	a := newApp()
+	a.SetContextNewHook(func(c *Context) {
+		allocs++
+		c.SetPoolData(new(bytes.Buffer))
+	})
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/echo/:s", func(c *Context) error {
+		if c.Get("k") != nil {
+			return errors.New("the store of the previous request is kept")
+		}
+		c.Set("k", 1)
+		buf, ok := c.PoolData().(*bytes.Buffer)
+		if !ok {
+			return errors.New("no pool data")
+		}
+		// the owner resets the pool data
+		buf.Reset()
+		buf.WriteString(c.PathParam("s"))
+		return c.String(http.StatusOK, buf.String())
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, "/echo/"+strconv.Itoa(i), nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != strconv.Itoa(i) {
+			t.Fatalf("%d: got %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if allocs < 1 || allocs > n {
+		t.Errorf("the hook is called %d times for %d requests", allocs, n)
+	}
+}
+
+func TestSaveUploadedFile(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		field, declared string
+		content         []byte
+	}{
+		// the declared types lie about the contents
+		{"avatar", "text/plain", png},
+		{"fake", "image/png", []byte("<html><script>alert(1)</script></html>")},
+	} {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="`+part.field+`"; filename="`+part.field+`.png"`)
+		h.Set(HeaderContentType, part.declared)
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pw.Write(part.content)
+	}
+	mw.Close()
+	req := httptest.NewRequest(POST, "/upload", &body)
+	req.Header.Set(HeaderContentType, mw.FormDataContentType())
+	c := app.newContext(new(Response), req)
+	c.init(httptest.NewRecorder(), req)
+	_, avatar, err := c.FormFile("avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fake, err := c.FormFile("fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images := []string{"image/*"}
+	var dst bytes.Buffer
+	if err := c.SaveUploadedFile(avatar, &dst, UploadOptions{MaxSize: int64(len(png)), AllowedTypes: images}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), png) {
+		t.Errorf("got %d bytes, want %d", dst.Len(), len(png))
+	}
+	dst.Reset()
+	if err := c.SaveUploadedFile(avatar, &dst); err != nil || dst.Len() != len(png) {
+		t.Errorf("no options: got %d bytes, %v", dst.Len(), err)
+	}
+
+	err = c.SaveUploadedFile(avatar, ioutil.Discard, UploadOptions{MaxSize: int64(len(png)) - 1})
+	if e, ok := err.(*UploadSizeError); !ok || e.Filename != "avatar.png" || e.MaxSize != int64(len(png))-1 {
+		t.Errorf("over the max size: got %#v", err)
+	}
+	dst.Reset()
+	err = c.SaveUploadedFile(fake, &dst, UploadOptions{AllowedTypes: append(images, "application/pdf")})
+	if e, ok := err.(*UploadTypeError); !ok || e.Type != "text/html" || e.Filename != "fake.png" {
+		t.Errorf("sniffed type: got %#v", err)
+	}
+	if dst.Len() != 0 {
+		t.Errorf("a rejected file is written: %q", dst.String())
+	}
+}
+
+func TestRequestHookPanic(t *testing.T) {
+	var (
+		requests  int
+		hooked    []*Context
+		panics    []PanicSource
+		responses []int
+	)
+	a := newApp()
+	a.SetRequestHook(func(c *Context) {
+		requests++
+		hooked = append(hooked, c)
+		if requests == 2 {
+			panic("hook")
+		}
+	})
+	a.SetPanicHook(func(c *Context, rcv interface{}, source PanicSource) {
+		panics = append(panics, source)
+	})
+	a.SetResponseHook(func(c *Context, latency time.Duration) {
+		responses = append(responses, c.response.Status())
+	})
+	a.resetRouterBegin()
+	a.addwithlog(false, GET, "/", func(c *Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+
+	for i, want := range []int{http.StatusOK, http.StatusInternalServerError, http.StatusOK} {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(GET, "/", nil))
+		if rec.Code != want {
+			t.Fatalf("%d: got %d, want %d", i, rec.Code, want)
+		}
+		// the panic of the hook is rendered by the failure handler, not the last resort
+		if want == http.StatusInternalServerError && !strings.Contains(rec.Body.String(), "<center><h1>500 Internal Server Error</h1></center>") {
+			t.Errorf("%d: got %q", i, rec.Body.String())
+		}
+	}
+	if len(panics) != 1 || !reflect.DeepEqual(responses, []int{http.StatusOK, http.StatusInternalServerError, http.StatusOK}) {
+		t.Errorf("got panics %v and responses %v", panics, responses)
+	}
+	// the Context of the panicking request is reset to be put back in the pool
+	if c := hooked[1]; c.request != nil || c.failureHandler != nil {
+		t.Errorf("the context is not freed: %+v", c)
+	}
+}
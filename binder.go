@@ -1,14 +1,22 @@
 package lessgo
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"net/url"
+	"net/textproto"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type (
@@ -17,101 +25,1045 @@ type (
 		Bind(interface{}, *Context) error
 	}
 
-	binder struct{}
+	// BindConfig holds the options of the default binder.
+	BindConfig struct {
+		// AggregateErrors collects every binding/conversion error into `BindErrors`
+		// instead of returning on the first one.
+		AggregateErrors bool
+		// TimeFormat is the default layout to parse `time.Time` fields that have no
+		// `time_format` tag, for example "2006-01-02" or "unix".
+		// It is not used for the JSON body, whose times without the tag are RFC3339.
+		// When empty, RFC3339 and the common date formats are tried in turn.
+		TimeFormat string
+		// EnumIgnoreCase matches the values of the fields with the `enum` tag case-insensitively,
+		// and normalizes them to the spelling in the tag.
+		EnumIgnoreCase bool
+	}
+
+	// BindError describes a field that can not be bound.
+	BindError struct {
+		Field  string `json:"field"`
+		Source string `json:"source"`
+		Reason string `json:"reason"`
+	}
+
+	// BindErrors is the list of errors returned by the default binder.
+	BindErrors []*BindError
+
+	binder struct {
+		config BindConfig
+	}
+
+	// bindState collects errors while binding a request.
+	bindState struct {
+		errs      BindErrors
+		aggregate bool
+		binding   map[reflect.Type]bool // the struct types being bound, which are not entered again
+		bound     map[boundKey]bool     // the values bound from the request, for the `enum` check
+		// the fields of the body are not tracked (XML), so the non-zero values are taken as bound
+		zeroUnbound bool
+	}
+
+	// boundKey identifies a bound value by its address and its type,
+	// since a struct and its first field share the address.
+	boundKey struct {
+		ptr uintptr
+		typ reflect.Type
+	}
 )
 
 const (
 	bindStructTag  = "bind"
 	bindStructTag2 = "json"
+	bindFormTag    = "form"
+	bindSourceTag  = "in"
+	bindAliasTag   = "alias"
+	bindTimeTag    = "time_format"
+	bindLayoutTag  = "layout"
+	bindEnumTag    = "enum"
+
+	// timeFormatUnix is the time format that means a Unix timestamp in seconds.
+	timeFormatUnix = "unix"
 )
 
+var (
+	timeType = reflect.TypeOf(time.Time{})
+
+	// defaultTimeFormats are tried in turn if no time format is specified.
+	defaultTimeFormats = []string{
+		time.RFC3339Nano,
+		"2006-01-02 15:04:05",
+		"2006-01-02T15:04:05",
+		"2006-01-02",
+		"2006/01/02",
+	}
+)
+
+// Sources of the bound values, same as `Param.In`.
+const (
+	SourcePath     = "path"
+	SourceQuery    = "query"
+	SourceHeader   = "header"
+	SourceFormData = "formData"
+	SourceBody     = "body"
+)
+
+// NewBinder creates the default binder with custom options.
+// A malformed request is returned as `*HTTPError` with status 400 naming the fields,
+// whose `BindErrors` can be taken by `errors.As`.
+// The body is decoded by its Content-Type: JSON, XML, or the url-encoded and multipart forms,
+// whose values are bound to the struct fields by the `form` tag, or else the `json` tag,
+// including the slices, the pointers, the embedded structs and `time.Time` in the layout
+// of the `time_format` or `layout` tag, which is also honoured for the JSON body;
+// any other Content-Type is rejected with 415.
+// Struct fields can be bound from other sources with the `in` tag,
+// for example `in:"query"`, `in:"path"` or `in:"header"`.
+// Renamed fields can keep accepting their old names with the `alias` tag,
+// for example `json:"phoneNumber" alias:"phone,mobile"`.
+// The values of a field can be restricted to an allowed set with the `enum` tag,
+// for example `enum:"active,inactive,pending"`; the bound values are checked, including
+// the empty and zero ones, while the fields absent from the request are not
+// (for an XML body, whose fields are not tracked, its zero values are taken as absent).
+func NewBinder(config BindConfig) Binder {
+	return &binder{config: config}
+}
+
+// Error makes it compatible with `error` interface.
+func (e *BindError) Error() string {
+	if len(e.Field) == 0 {
+		return e.Source + ": " + e.Reason
+	}
+	return e.Source + " field \"" + e.Field + "\": " + e.Reason
+}
+
+// Error makes it compatible with `error` interface.
+func (errs BindErrors) Error() string {
+	s := make([]string, len(errs))
+	for i, e := range errs {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// httpError returns the errors as `*HTTPError` with status 400, which unwraps to them.
+func (errs BindErrors) httpError() *HTTPError {
+	return &HTTPError{Code: http.StatusBadRequest, Message: errs.Error(), internal: errs}
+}
+
+// Bind allocates a `T`, binds the request into it and validates it if it implements `Validator`.
+// If `T` is a slice or an array, e.g. a bulk JSON body, each element is validated and the
+// failures are aggregated by index, e.g. `[2].email`.
+// Binding errors are returned as `*HTTPError` with status 400 (415 for unsupported media type),
+// validation errors as `*HTTPError` with status 422.
+//
+//	req, err := lessgo.Bind[CreateUserReq](c)
+//	items, err := lessgo.Bind[[]Item](c)
+func Bind[T any](c *Context) (T, error) {
+	var v T
+	if err := c.Bind(&v); err != nil {
+		if he, ok := err.(*HTTPError); ok {
+			return v, he
+		}
+		return v, NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := validate(reflect.ValueOf(&v)); err != nil {
+		return v, NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+	return v, nil
+}
+
+// validate calls `Validate()` of the value, or of every element if it is a slice or an array.
+// The element errors are returned as `BindErrors` with the index as the field,
+// element `BindErrors` keep their fields under the index, e.g. `[2].email`.
+func validate(v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		if validator, ok := v.Interface().(Validator); ok {
+			return validator.Validate()
+		}
+		v = v.Elem()
+	}
+	if v.CanAddr() {
+		if validator, ok := v.Addr().Interface().(Validator); ok {
+			return validator.Validate()
+		}
+	}
+	if validator, ok := v.Interface().(Validator); ok {
+		return validator.Validate()
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil
+	}
+	var errs BindErrors
+	for i := 0; i < v.Len(); i++ {
+		index := "[" + strconv.Itoa(i) + "]"
+		switch e := validate(v.Index(i)).(type) {
+		case nil:
+		case BindErrors:
+			for _, be := range e {
+				field := index
+				switch {
+				case len(be.Field) == 0:
+				case be.Field[0] == '[':
+					field += be.Field
+				default:
+					field += "." + be.Field
+				}
+				errs = append(errs, &BindError{Field: field, Source: be.Source, Reason: be.Reason})
+			}
+		default:
+			errs = append(errs, &BindError{Field: index, Source: SourceBody, Reason: e.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// add records a binding error, and reports whether the binding should go on.
+func (s *bindState) add(field, source string, err error) bool {
+	s.errs = append(s.errs, &BindError{
+		Field:  field,
+		Source: source,
+		Reason: err.Error(),
+	})
+	return s.aggregate
+}
+
+// stopped reports whether the binding has to stop.
+func (s *bindState) stopped() bool {
+	return !s.aggregate && len(s.errs) > 0
+}
+
+// markBound records that the value has been bound from the request.
+func (s *bindState) markBound(v reflect.Value) {
+	if !v.CanAddr() {
+		return
+	}
+	if s.bound == nil {
+		s.bound = make(map[boundKey]bool)
+	}
+	s.bound[boundKey{v.UnsafeAddr(), v.Type()}] = true
+}
+
+// isBound reports whether the value has been bound from the request.
+func (s *bindState) isBound(v reflect.Value) bool {
+	if s.zeroUnbound && !v.IsZero() {
+		return true
+	}
+	return v.CanAddr() && s.bound[boundKey{v.UnsafeAddr(), v.Type()}]
+}
+
 func (b *binder) Bind(i interface{}, c *Context) error {
 	req := c.request
-	ctype := req.Header.Get(HeaderContentType)
 	if req.Body == nil {
 		return NewHTTPError(http.StatusBadRequest, "request body can't be empty")
 	}
+	body := c.BodyReader()
+	state := &bindState{aggregate: b.config.AggregateErrors}
+	ctype := req.Header.Get(HeaderContentType)
+	defaultSource := SourceBody
 	switch {
+	case len(ctype) == 0 && req.ContentLength == 0:
+		// nothing in body, bind from path, query and header only
 	case strings.HasPrefix(ctype, MIMEApplicationJSON):
-		if err := json.NewDecoder(req.Body).Decode(i); err != nil {
-			return NewHTTPError(http.StatusBadRequest, err.Error())
+		if err := decodeJSON(body, i, c, state); err != nil {
+			if isBodyTooLarge(err) {
+				return ErrBodyTooLarge
+			}
+			var field string
+			switch e := err.(type) {
+			case *json.UnmarshalTypeError:
+				field = e.Field
+			case *jsonFieldError:
+				field = e.field
+			}
+			state.add(field, SourceBody, err)
 		}
-	case strings.HasPrefix(ctype, MIMEApplicationXML):
-		if err := xml.NewDecoder(req.Body).Decode(i); err != nil {
-			return NewHTTPError(http.StatusBadRequest, err.Error())
+	case strings.HasPrefix(ctype, MIMEApplicationXML), strings.HasPrefix(ctype, "text/xml"):
+		state.zeroUnbound = true
+		if err := xml.NewDecoder(body).Decode(i); err != nil {
+			if isBodyTooLarge(err) {
+				return ErrBodyTooLarge
+			}
+			state.add("", SourceBody, err)
 		}
 	case strings.HasPrefix(ctype, MIMEApplicationForm), strings.HasPrefix(ctype, MIMEMultipartForm):
 		typ := reflect.TypeOf(i)
-		if typ.Kind() != reflect.Ptr {
+		if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
 			return NewHTTPError(http.StatusBadRequest, "When \"Content-Type: "+ctype+"\", \"Bind()\"'s param must be \"*struct\".")
 		}
+		defaultSource = SourceFormData
+	default:
+		return ErrUnsupportedMediaType
+	}
+	if state.stopped() {
+		return state.errs.httpError()
+	}
+
+	typ := reflect.TypeOf(i)
+	if typ.Kind() == reflect.Ptr && typ.Elem().Kind() == reflect.Struct {
+		b.bindFields(typ.Elem(), reflect.ValueOf(i).Elem(), c, defaultSource, state)
+	}
+	if !state.stopped() {
+		b.checkEnums(reflect.ValueOf(i), "", defaultSource, state)
+	}
+	if len(state.errs) > 0 {
+		return state.errs.httpError()
+	}
+	return nil
+}
+
+// decodeJSON decodes the JSON body like `json.Decoder`, then fills the struct fields
+// that are absent in the body from their `alias` names.
+// The `time.Time` fields with the `time_format` or `layout` tag are parsed in that layout,
+// the others in RFC3339 like `encoding/json`; `BindConfig.TimeFormat` is not used for JSON.
+// The fields present in the body are recorded in the state for the check of the `enum` tags.
+// In debug mode, it logs the body fields that are not mapped to any field of i at Debug level,
+// which helps to find the schema drift between the client and the server.
+func decodeJSON(body io.Reader, i interface{}, c *Context, state *bindState) error {
+	body = skipBOM(body)
+	aliased := typeHasFieldTag(reflect.TypeOf(i), bindAliasTag)
+	timed := typeHasFieldTag(reflect.TypeOf(i), bindTimeTag, bindLayoutTag)
+	enumed := typeHasFieldTag(reflect.TypeOf(i), bindEnumTag)
+	if !aliased && !timed && !enumed && !Debug() {
+		return json.NewDecoder(body).Decode(i)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	var raw json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if err = dec.Decode(&raw); err != nil {
+		return err
+	}
+	if timed {
+		if raw, err = rewriteJSONTimes(raw, reflect.TypeOf(i), ""); err != nil {
+			return err
+		}
+	}
+	if err = json.Unmarshal(raw, i); err != nil {
+		return err
+	}
+	if aliased {
+		if err = applyJSONAliases(raw, reflect.ValueOf(i), c); err != nil {
+			return err
+		}
+	}
+	if enumed {
+		markJSONBound(raw, reflect.ValueOf(i), state)
+	}
+	if Debug() {
+		var v interface{}
+		if json.Unmarshal(raw, &v) == nil {
+			if fields := unmappedJSONFields(v, reflect.TypeOf(i), ""); len(fields) > 0 {
+				Log.Debug("Bind: %s %s: unmapped JSON fields: %s", c.request.Method, c.request.URL.Path, strings.Join(fields, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// utf8BOM is the byte order mark prefixed to the JSON bodies by some clients, e.g. certain .NET HTTP stacks.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// skipBOM returns a reader of r without the leading UTF-8 BOM, which the JSON decoder rejects;
+// the leading whitespace is tolerated by the decoder itself.
+func skipBOM(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if b, _ := br.Peek(len(utf8BOM)); bytes.Equal(b, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	return br
+}
+
+// fieldTagCache caches the results of `typeHasFieldTag` by fieldTagKey.
+var fieldTagCache sync.Map
+
+type fieldTagKey struct {
+	typ  reflect.Type
+	tags string
+}
+
+// typeHasFieldTag is `hasFieldTag` cached by the type, which is walked once.
+func typeHasFieldTag(typ reflect.Type, tags ...string) bool {
+	key := fieldTagKey{typ, strings.Join(tags, ",")}
+	if has, ok := fieldTagCache.Load(key); ok {
+		return has.(bool)
+	}
+	has := hasFieldTag(typ, map[reflect.Type]bool{}, tags...)
+	fieldTagCache.Store(key, has)
+	return has
+}
+
+// hasFieldTag reports whether any field of the struct typ, or of its nested structs
+// and the elements of its slices, has one of the tags.
+func hasFieldTag(typ reflect.Type, visited map[reflect.Type]bool, tags ...string) bool {
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
 		typ = typ.Elem()
-		if typ.Kind() != reflect.Struct {
-			return NewHTTPError(http.StatusBadRequest, "When \"Content-Type: "+ctype+"\", \"Bind()\"'s param must be \"*struct\".")
+	}
+	if typ.Kind() != reflect.Struct || visited[typ] {
+		return false
+	}
+	visited[typ] = true
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		for _, tag := range tags {
+			if f.Tag.Get(tag) != "" {
+				return true
+			}
 		}
-		val := reflect.ValueOf(i).Elem()
-		if err := b.bindForm(typ, val, c.FormValues()); err != nil {
-			return NewHTTPError(http.StatusBadRequest, err.Error())
+		if hasFieldTag(f.Type, visited, tags...) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFieldError is an error of the JSON body field, e.g. a time in the wrong layout.
+type jsonFieldError struct {
+	field string
+	err   error
+}
+
+func (e *jsonFieldError) Error() string {
+	return e.err.Error()
+}
+
+// rewriteJSONTimes rewrites the values of the `time.Time` fields with the `time_format` or `layout` tag
+// in the JSON document raw to RFC3339, which `encoding/json` decodes, walking the nested objects and arrays.
+// The values of the aliases of the fields are rewritten too. path is the field path of raw in the errors.
+func rewriteJSONTimes(raw json.RawMessage, typ reflect.Type, path string) (json.RawMessage, error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		var elems []json.RawMessage
+		if json.Unmarshal(raw, &elems) != nil {
+			return raw, nil
+		}
+		for i, elem := range elems {
+			v, err := rewriteJSONTimes(elem, typ.Elem(), path+"["+strconv.Itoa(i)+"]")
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = v
+		}
+		return json.Marshal(elems)
+	case reflect.Struct:
+		if typ == timeType {
+			return raw, nil
+		}
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(raw, &obj) != nil || obj == nil {
+			return raw, nil
+		}
+		if err := rewriteJSONObjectTimes(obj, typ, path); err != nil {
+			return nil, err
+		}
+		return json.Marshal(obj)
+	}
+	return raw, nil
+}
+
+// rewriteJSONObjectTimes rewrites the time values of the object obj decoded into the struct typ,
+// including the fields promoted from the embedded structs.
+func rewriteJSONObjectTimes(obj map[string]json.RawMessage, typ reflect.Type, path string) error {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get(bindStructTag2), ",")[0]
+		if name == "-" {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			if err := rewriteJSONObjectTimes(obj, ft, path); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		field := name
+		if path != "" {
+			field = path + "." + name
+		}
+		keys := []string{name}
+		for _, alias := range strings.Split(f.Tag.Get(bindAliasTag), ",") {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				keys = append(keys, alias)
+			}
+		}
+		for _, k := range keys {
+			key, ok := jsonKeyOf(obj, k)
+			if !ok {
+				continue
+			}
+			v := obj[key]
+			if ft != timeType {
+				rewritten, err := rewriteJSONTimes(v, ft, field)
+				if err != nil {
+					return err
+				}
+				obj[key] = rewritten
+				continue
+			}
+			layout := strings.TrimSpace(f.Tag.Get(bindTimeTag))
+			if layout == "" {
+				layout = strings.TrimSpace(f.Tag.Get(bindLayoutTag))
+			}
+			if layout == "" || bytes.Equal(bytes.TrimSpace(v), []byte("null")) {
+				continue
+			}
+			var s string
+			if json.Unmarshal(v, &s) != nil {
+				// a Unix timestamp may also be a JSON number
+				var n json.Number
+				if layout != timeFormatUnix || json.Unmarshal(v, &n) != nil {
+					return &jsonFieldError{field: field, err: fmt.Errorf("can not parse %s as time, expected a string in format %q", v, layout)}
+				}
+				s = n.String()
+			}
+			var t time.Time
+			if err := setTimeField(s, layout, reflect.ValueOf(&t).Elem()); err != nil {
+				return &jsonFieldError{field: field, err: err}
+			}
+			b, err := t.MarshalJSON()
+			if err != nil {
+				return &jsonFieldError{field: field, err: err}
+			}
+			obj[key] = b
 		}
-	default:
-		return ErrUnsupportedMediaType
 	}
 	return nil
 }
 
-func (b *binder) bindForm(typ reflect.Type, val reflect.Value, form url.Values) error {
+// jsonKeyOf returns the key of the object matching name like `lookupJSONKey`.
+func jsonKeyOf(obj map[string]json.RawMessage, name string) (string, bool) {
+	if _, ok := obj[name]; ok {
+		return name, true
+	}
+	for k := range obj {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// applyJSONAliases sets the struct fields whose JSON names are absent in the object raw
+// from their `alias` names. The JSON name takes precedence over the aliases,
+// and if several aliases are present, the first one in the tag wins.
+// The elements of the slices and arrays are filled in the same way.
+// A deprecation warning is logged when an alias is used.
+func applyJSONAliases(raw json.RawMessage, val reflect.Value, c *Context) error {
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return nil
+		}
+		val = val.Elem()
+	}
+	if val.Kind() == reflect.Slice || val.Kind() == reflect.Array {
+		var elems []json.RawMessage
+		if json.Unmarshal(raw, &elems) != nil {
+			return nil
+		}
+		for i := 0; i < len(elems) && i < val.Len(); i++ {
+			if err := applyJSONAliases(elems[i], val.Index(i), c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if val.Kind() != reflect.Struct {
+		return nil
+	}
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(raw, &obj) != nil {
+		return nil
+	}
+	typ := val.Type()
 	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get(bindStructTag2), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			if err := applyJSONAliases(raw, val.Field(i), c); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if v, ok := lookupJSONKey(obj, name); ok {
+			if err := applyJSONAliases(v, val.Field(i), c); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, alias := range strings.Split(f.Tag.Get(bindAliasTag), ",") {
+			alias = strings.TrimSpace(alias)
+			if alias == "" {
+				continue
+			}
+			v, ok := lookupJSONKey(obj, alias)
+			if !ok {
+				continue
+			}
+			if err := json.Unmarshal(v, val.Field(i).Addr().Interface()); err != nil {
+				return fmt.Errorf("json: cannot unmarshal %s into field %q (alias of %q): %v", v, alias, name, err)
+			}
+			Log.Warn("Bind: %s %s: deprecated JSON field %q is used, please use %q instead", c.request.Method, c.request.URL.Path, alias, name)
+			break
+		}
+	}
+	return nil
+}
+
+// markJSONBound records the struct fields of val that are present and not null in the JSON
+// document raw, by their JSON names or aliases, including the elements of slices and arrays.
+func markJSONBound(raw json.RawMessage, val reflect.Value, state *bindState) {
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return
+		}
+		val = val.Elem()
+	}
+	switch val.Kind() {
+	case reflect.Slice, reflect.Array:
+		var elems []json.RawMessage
+		if json.Unmarshal(raw, &elems) != nil {
+			return
+		}
+		for i := 0; i < len(elems) && i < val.Len(); i++ {
+			state.markBound(val.Index(i))
+			markJSONBound(elems[i], val.Index(i), state)
+		}
+	case reflect.Struct:
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(raw, &obj) != nil {
+			return
+		}
+		typ := val.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			name := strings.Split(f.Tag.Get(bindStructTag2), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if f.Anonymous && name == "" {
+				markJSONBound(raw, val.Field(i), state)
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			v, ok := lookupJSONKey(obj, name)
+			for _, alias := range strings.Split(f.Tag.Get(bindAliasTag), ",") {
+				if alias = strings.TrimSpace(alias); !ok && alias != "" {
+					v, ok = lookupJSONKey(obj, alias)
+				}
+			}
+			if !ok || bytes.Equal(bytes.TrimSpace(v), []byte("null")) {
+				continue
+			}
+			state.markBound(val.Field(i))
+			markJSONBound(v, val.Field(i), state)
+		}
+	}
+}
+
+// lookupJSONKey finds the key in the object like `encoding/json`,
+// preferring an exact match to a case-insensitive one.
+func lookupJSONKey(obj map[string]json.RawMessage, key string) (json.RawMessage, bool) {
+	if v, ok := obj[key]; ok {
+		return v, true
+	}
+	for k, v := range obj {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// lookupJSONPath returns the value at the dotted path of the JSON document,
+// e.g. "data.attributes", looking up each key by `lookupJSONKey`.
+func lookupJSONPath(doc []byte, path string) (json.RawMessage, error) {
+	raw := json.RawMessage(doc)
+	var walked string
+	for _, key := range strings.Split(path, ".") {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil || obj == nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				return nil, err
+			}
+			if walked == "" {
+				return nil, errors.New("request body must be a JSON object")
+			}
+			return nil, fmt.Errorf("request body field %q must be a JSON object", walked)
+		}
+		if walked != "" {
+			walked += "."
+		}
+		walked += key
+		v, ok := lookupJSONKey(obj, key)
+		if !ok || bytes.Equal(bytes.TrimSpace(v), []byte("null")) {
+			return nil, fmt.Errorf("request body field %q is missing", walked)
+		}
+		raw = v
+	}
+	return raw, nil
+}
+
+// unmappedJSONFields returns the paths of the JSON object keys in raw that
+// `encoding/json` would ignore when decoding into typ.
+func unmappedJSONFields(raw interface{}, typ reflect.Type, prefix string) []string {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	var fields []string
+	switch x := raw.(type) {
+	case []interface{}:
+		if typ.Kind() != reflect.Slice && typ.Kind() != reflect.Array {
+			return nil
+		}
+		for i, v := range x {
+			fields = append(fields, unmappedJSONFields(v, typ.Elem(), prefix+"["+strconv.Itoa(i)+"]")...)
+		}
+	case map[string]interface{}:
+		switch typ.Kind() {
+		case reflect.Map:
+			for k, v := range x {
+				fields = append(fields, unmappedJSONFields(v, typ.Elem(), prefix+"."+k)...)
+			}
+		case reflect.Struct:
+			known := map[string]reflect.Type{}
+			jsonFieldTypes(typ, known, map[reflect.Type]bool{})
+			for k, v := range x {
+				path := strings.TrimPrefix(prefix+"."+k, ".")
+				ft, ok := known[strings.ToLower(k)]
+				if !ok {
+					fields = append(fields, path)
+					continue
+				}
+				fields = append(fields, unmappedJSONFields(v, ft, path)...)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// jsonFieldTypes collects the lower-cased JSON names and the types of the struct fields,
+// including the fields promoted from the embedded structs,
+// visited guards against the structs embedding each other by pointers.
+func jsonFieldTypes(typ reflect.Type, known map[string]reflect.Type, visited map[reflect.Type]bool) {
+	if visited[typ] {
+		return
+	}
+	visited[typ] = true
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get(bindStructTag2), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				jsonFieldTypes(ft, known, visited)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		known[strings.ToLower(name)] = f.Type
+		for _, alias := range strings.Split(f.Tag.Get(bindAliasTag), ",") {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				known[strings.ToLower(alias)] = f.Type
+			}
+		}
+	}
+}
+
+// bindFields binds the struct fields from their sources,
+// the fields without `in` tag are bound from defaultSource.
+// A struct type is not entered again while it is being bound, so that the types referring to each other,
+// e.g. `type A struct{ B *B }; type B struct{ A *A }`, are bound only once on the way down.
+func (b *binder) bindFields(typ reflect.Type, val reflect.Value, c *Context, defaultSource string, state *bindState) {
+	if state.binding[typ] {
+		return
+	}
+	if state.binding == nil {
+		state.binding = make(map[reflect.Type]bool)
+	}
+	state.binding[typ] = true
+	defer delete(state.binding, typ)
+	for i := 0; i < typ.NumField() && !state.stopped(); i++ {
 		typeField := typ.Field(i)
 		structField := val.Field(i)
-		if !structField.CanSet() {
+		structFieldKind := structField.Kind()
+		// the exported fields of an unexported embedded struct are still set, like `encoding/json`
+		if !structField.CanSet() && !(typeField.Anonymous && structFieldKind == reflect.Struct && bindFieldName(typeField, defaultSource) == "") {
 			continue
 		}
-		structFieldKind := structField.Kind()
-		var inputFieldName string
-		inputFieldName = strings.TrimSpace(typeField.Tag.Get(bindStructTag))
-		if inputFieldName == "" {
-			inputFieldName = strings.TrimSpace(typeField.Tag.Get(bindStructTag2))
+		source := strings.TrimSpace(typeField.Tag.Get(bindSourceTag))
+		if source == "" {
+			source = defaultSource
 		}
+		inputFieldName := bindFieldName(typeField, source)
 		if inputFieldName == "-" {
 			continue
 		}
 		if inputFieldName == "" {
 			inputFieldName = typeField.Name
-			// If bindStructTag or bindStructTag2 tag is null, we inspect if the field is a struct or *struct.
-			if structFieldKind == reflect.Ptr {
-				structField = structField.Elem()
-			}
-			if structFieldKind == reflect.Struct {
-				err := b.bindForm(structField.Type(), structField, form)
-				if err != nil {
-					return err
+			// If the name tags are null, we inspect if the field is a struct or *struct.
+			if ft := typeField.Type; ft.Kind() == reflect.Struct && ft != timeType {
+				b.bindFields(ft, structField, c, defaultSource, state)
+				continue
+			} else if ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct && ft.Elem() != timeType {
+				if !structField.IsNil() {
+					b.bindFields(ft.Elem(), structField.Elem(), c, defaultSource, state)
+				} else {
+					// a nil *struct is only allocated if any of its fields is bound
+					elem := reflect.New(ft.Elem())
+					n := len(state.bound)
+					b.bindFields(ft.Elem(), elem.Elem(), c, defaultSource, state)
+					if len(state.bound) > n || !elem.Elem().IsZero() {
+						structField.Set(elem)
+					}
 				}
 				continue
 			}
 		}
+		if source == SourceBody {
+			continue
+		}
 		inputFieldName = strings.TrimSpace(strings.Split(inputFieldName, ",")[0])
-		inputValue, exists := form[inputFieldName]
+		inputValue, exists := bindSourceValues(c, source, inputFieldName)
 		if !exists {
-			continue
+			for _, alias := range strings.Split(typeField.Tag.Get(bindAliasTag), ",") {
+				if alias = strings.TrimSpace(alias); alias == "" {
+					continue
+				}
+				if inputValue, exists = bindSourceValues(c, source, alias); exists {
+					Log.Warn("Bind: %s %s: deprecated %s field %q is used, please use %q instead", c.request.Method, c.request.URL.Path, source, alias, inputFieldName)
+					break
+				}
+			}
+			if !exists {
+				continue
+			}
 		}
 
+		timeFormat := strings.TrimSpace(typeField.Tag.Get(bindTimeTag))
+		if timeFormat == "" {
+			timeFormat = strings.TrimSpace(typeField.Tag.Get(bindLayoutTag))
+		}
+		if timeFormat == "" {
+			timeFormat = b.config.TimeFormat
+		}
 		numElems := len(inputValue)
 		if structFieldKind == reflect.Slice && numElems > 0 {
-			sliceOf := structField.Type().Elem().Kind()
 			slice := reflect.MakeSlice(structField.Type(), numElems, numElems)
-			for i := 0; i < numElems; i++ {
-				if err := setWithProperType(sliceOf, inputValue[i], slice.Index(i)); err != nil {
-					return err
+			var failed bool
+			for j := 0; j < numElems; j++ {
+				if err := setValue(inputValue[j], timeFormat, slice.Index(j)); err != nil {
+					failed = true
+					if !state.add(inputFieldName, source, err) {
+						break
+					}
 				}
 			}
-			val.Field(i).Set(slice)
-		} else {
-			if err := setWithProperType(typeField.Type.Kind(), inputValue[0], structField); err != nil {
-				return err
+			if !failed {
+				val.Field(i).Set(slice)
+				state.markBound(structField)
+			}
+		} else if numElems > 0 {
+			if err := setValue(inputValue[0], timeFormat, structField); err != nil {
+				state.add(inputFieldName, source, err)
+			} else {
+				state.markBound(structField)
 			}
 		}
 	}
-	return nil
+}
+
+// bindFieldName returns the name tag of the field: `bind`, `form` for the form data, or `json`.
+func bindFieldName(f reflect.StructField, source string) string {
+	name := strings.TrimSpace(f.Tag.Get(bindStructTag))
+	if name == "" && source == SourceFormData {
+		name = strings.TrimSpace(f.Tag.Get(bindFormTag))
+	}
+	if name == "" {
+		name = strings.TrimSpace(f.Tag.Get(bindStructTag2))
+	}
+	return name
+}
+
+// checkEnums checks the bound values of the struct fields with the `enum` tag against
+// their allowed sets, walking the nested structs and the elements of slices.
+func (b *binder) checkEnums(val reflect.Value, prefix, defaultSource string, state *bindState) {
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return
+		}
+		val = val.Elem()
+	}
+	switch val.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < val.Len() && !state.stopped(); i++ {
+			b.checkEnums(val.Index(i), prefix+"["+strconv.Itoa(i)+"]", defaultSource, state)
+		}
+		return
+	case reflect.Struct:
+		if val.Type() == timeType {
+			return
+		}
+	default:
+		return
+	}
+	typ := val.Type()
+	for i := 0; i < typ.NumField() && !state.stopped(); i++ {
+		typeField := typ.Field(i)
+		if typeField.PkgPath != "" {
+			continue
+		}
+		source := strings.TrimSpace(typeField.Tag.Get(bindSourceTag))
+		if source == "" {
+			source = defaultSource
+		}
+		name := strings.TrimSpace(strings.Split(bindFieldName(typeField, source), ",")[0])
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = typeField.Name
+		}
+		field := name
+		if prefix != "" {
+			field = prefix + "." + name
+		}
+		enum := typeField.Tag.Get(bindEnumTag)
+		if enum == "" {
+			b.checkEnums(val.Field(i), field, defaultSource, state)
+			continue
+		}
+		allowed := strings.Split(enum, ",")
+		for j := range allowed {
+			allowed[j] = strings.TrimSpace(allowed[j])
+		}
+		fv := val.Field(i)
+		if !state.isBound(fv) {
+			continue
+		}
+		if fv.Kind() == reflect.Slice || fv.Kind() == reflect.Array {
+			for j := 0; j < fv.Len(); j++ {
+				if err := b.checkEnum(fv.Index(j), allowed); err != nil && !state.add(field, source, err) {
+					break
+				}
+			}
+		} else if err := b.checkEnum(fv, allowed); err != nil {
+			state.add(field, source, err)
+		}
+	}
+}
+
+// checkEnum checks the bound value against the allowed set, including the zero value.
+func (b *binder) checkEnum(v reflect.Value, allowed []string) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	var s string
+	if v.Kind() == reflect.String {
+		s = v.String()
+	} else {
+		s = fmt.Sprint(v.Interface())
+	}
+	for _, a := range allowed {
+		if s == a {
+			return nil
+		}
+		if b.config.EnumIgnoreCase && strings.EqualFold(s, a) {
+			if v.Kind() == reflect.String && v.CanSet() {
+				v.SetString(a)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not one of %s", s, strings.Join(allowed, ", "))
+}
+
+// bindSourceValues returns the request values of the name from the source.
+func bindSourceValues(c *Context, source, name string) ([]string, bool) {
+	switch source {
+	case SourcePath:
+		for i, k := range c.pkeys {
+			if k == name && i < len(c.pvalues) {
+				return []string{c.pvalues[i]}, true
+			}
+		}
+		return nil, false
+	case SourceQuery:
+		vs, ok := c.QueryValues()[name]
+		return vs, ok
+	case SourceHeader:
+		vs, ok := c.request.Header[textproto.CanonicalMIMEHeaderKey(name)]
+		return vs, ok
+	case SourceFormData:
+		vs, ok := c.FormValues()[name]
+		return vs, ok
+	}
+	return nil, false
+}
+
+// setValue sets the string value to the field, a nil pointer is allocated,
+// timeFormat is used when the field is `time.Time`.
+func setValue(val, timeFormat string, field reflect.Value) error {
+	if field.Kind() == reflect.Ptr {
+		v := reflect.New(field.Type().Elem())
+		if err := setValue(val, timeFormat, v.Elem()); err != nil {
+			return err
+		}
+		field.Set(v)
+		return nil
+	}
+	if field.Type() == timeType {
+		return setTimeField(val, timeFormat, field)
+	}
+	return setWithProperType(field.Kind(), val, field)
 }
 
 func setWithProperType(valueKind reflect.Kind, val string, structField reflect.Value) error {
@@ -193,3 +1145,35 @@ func setFloatField(value string, bitSize int, field reflect.Value) error {
 	}
 	return err
 }
+
+func setTimeField(value, layout string, field reflect.Value) error {
+	if value == "" {
+		field.Set(reflect.ValueOf(time.Time{}))
+		return nil
+	}
+	var (
+		t   time.Time
+		err error
+	)
+	switch layout {
+	case timeFormatUnix:
+		var sec int64
+		if sec, err = strconv.ParseInt(value, 10, 64); err == nil {
+			t = time.Unix(sec, 0)
+		}
+	case "":
+		for _, l := range defaultTimeFormats {
+			if t, err = time.Parse(l, value); err == nil {
+				break
+			}
+		}
+		layout = "RFC3339 or 2006-01-02"
+	default:
+		t, err = time.Parse(layout, value)
+	}
+	if err != nil {
+		return fmt.Errorf("can not parse %q as time, expected format %q", value, layout)
+	}
+	field.Set(reflect.ValueOf(t))
+	return nil
+}
@@ -0,0 +1,847 @@
+package lessgo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/lessgo/logs"
+)
+
+type bulkItem struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+func (i *bulkItem) Validate() error {
+	if !strings.Contains(i.Email, "@") {
+		return BindErrors{{Field: "email", Source: SourceBody, Reason: "is invalid"}}
+	}
+	return nil
+}
+
+type bulkName string
+
+func (n bulkName) Validate() error {
+	if len(n) == 0 {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+// bindErrors returns the BindErrors of the `*HTTPError` with status 400 returned by the default binder.
+func bindErrors(err error) (BindErrors, bool) {
+	var errs BindErrors
+	he, ok := err.(*HTTPError)
+	return errs, ok && he.Code == http.StatusBadRequest && errors.As(err, &errs)
+}
+
+func newBindContext(method, body string) *Context {
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	req.Header.Set(HeaderContentType, MIMEApplicationJSON)
+	c := app.newContext(new(Response), req)
+	c.init(httptest.NewRecorder(), req)
+	return c
+}
+
+func TestBindJSONArray(t *testing.T) {
+	var items []bulkItem
+	c := newBindContext("POST", `[{"name":"a","email":"a@x.com"},{"name":"b","email":"b@x.com"}]`)
+	if err := c.Bind(&items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[1].Email != "b@x.com" {
+		t.Fatalf("got %+v", items)
+	}
+}
+
+func TestBindTyped(t *testing.T) {
+	item, err := Bind[bulkItem](newBindContext("POST", `{"name":"a","email":"a@x.com"}`))
+	if err != nil || item.Name != "a" || item.Email != "a@x.com" {
+		t.Fatalf("got %+v, %v", item, err)
+	}
+
+	cases := []struct {
+		contentType, body string
+		code              int
+	}{
+		{MIMEApplicationJSON, `{"name":`, http.StatusBadRequest},
+		{"application/x-unknown", `{}`, http.StatusUnsupportedMediaType},
+		{MIMEApplicationJSON, `{"name":"a","email":"a"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tc := range cases {
+		c := newBindContext("POST", tc.body)
+		c.request.Header.Set(HeaderContentType, tc.contentType)
+		_, err := Bind[bulkItem](c)
+		if he, ok := err.(*HTTPError); !ok || he.Code != tc.code {
+			t.Errorf("%s %s: got %#v, want HTTPError %d", tc.contentType, tc.body, err, tc.code)
+		}
+	}
+}
+
+func TestBindJSONArrayValidation(t *testing.T) {
+	c := newBindContext("POST", `[{"name":"a","email":"a@x.com"},{"name":"b","email":"b"},{"name":"c","email":"c@x.com"},{"name":"d"}]`)
+	items, err := Bind[[]bulkItem](c)
+	if len(items) != 4 {
+		t.Fatalf("got %d items, want 4", len(items))
+	}
+	he, ok := err.(*HTTPError)
+	if !ok || he.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %#v, want HTTPError 422", err)
+	}
+	want := `body field "[1].email": is invalid; body field "[3].email": is invalid`
+	if he.Message != want {
+		t.Errorf("got %q, want %q", he.Message, want)
+	}
+
+	c = newBindContext("POST", `[{"name":"a","email":"a@x.com"}]`)
+	if _, err = Bind[[]bulkItem](c); err != nil {
+		t.Errorf("valid array: unexpected error %v", err)
+	}
+}
+
+func TestBindJSONArrayValueValidator(t *testing.T) {
+	c := newBindContext("POST", `["a","","c"]`)
+	_, err := Bind[[]bulkName](c)
+	he, ok := err.(*HTTPError)
+	if !ok || he.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %#v, want HTTPError 422", err)
+	}
+	if want := `body field "[1]": name is required`; he.Message != want {
+		t.Errorf("got %q, want %q", he.Message, want)
+	}
+}
+
+type aliasContact struct {
+	PhoneNumber string `json:"phoneNumber" alias:"phone,mobile"`
+	Address     struct {
+		ZipCode string `json:"zipCode" alias:"zip"`
+	} `json:"address"`
+	Page int `json:"-" bind:"page" in:"query" alias:"p"`
+}
+
+func TestBindAlias(t *testing.T) {
+	cases := []struct {
+		body  string
+		phone string
+	}{
+		{`{"phoneNumber":"1"}`, "1"},
+		{`{"phone":"2"}`, "2"},
+		{`{"mobile":"3"}`, "3"},
+		// the JSON name takes precedence over the aliases, then the first alias in the tag
+		{`{"mobile":"3","phoneNumber":"1","phone":"2"}`, "1"},
+		{`{"mobile":"3","phone":"2"}`, "2"},
+	}
+	for _, tc := range cases {
+		var v aliasContact
+		if err := newBindContext("POST", tc.body).Bind(&v); err != nil {
+			t.Fatalf("%s: %v", tc.body, err)
+		}
+		if v.PhoneNumber != tc.phone {
+			t.Errorf("%s: got %q, want %q", tc.body, v.PhoneNumber, tc.phone)
+		}
+	}
+
+	var v aliasContact
+	c := newBindContext("POST", `{"address":{"zip":"100000"}}`)
+	c.request.URL.RawQuery = "p=3"
+	if err := c.Bind(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Address.ZipCode != "100000" || v.Page != 3 {
+		t.Errorf("nested or query alias: got %+v", v)
+	}
+	// the aliases of the slice elements, in a field or the whole body
+	var book struct {
+		Contacts []aliasContact `json:"contacts"`
+	}
+	if err := newBindContext("POST", `{"contacts":[{"phone":"1"},{"mobile":"2","address":{"zip":"3"}}]}`).Bind(&book); err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Contacts) != 2 || book.Contacts[0].PhoneNumber != "1" || book.Contacts[1].PhoneNumber != "2" || book.Contacts[1].Address.ZipCode != "3" {
+		t.Errorf("slice field: got %+v", book.Contacts)
+	}
+	var contacts []*aliasContact
+	if err := newBindContext("POST", `[{"phone":"4"},{"phoneNumber":"5","mobile":"6"}]`).Bind(&contacts); err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 2 || contacts[0].PhoneNumber != "4" || contacts[1].PhoneNumber != "5" {
+		t.Errorf("slice body: got %+v", contacts)
+	}
+
+	// the type is walked once
+	key := fieldTagKey{reflect.TypeOf(&book), bindAliasTag}
+	if has, ok := fieldTagCache.Load(key); !ok || !has.(bool) {
+		t.Errorf("got cached %v, %v", has, ok)
+	}
+}
+
+func TestContextBody(t *testing.T) {
+	const body = `{"name":"a","email":"a@x.com"}`
+	for _, tc := range []struct {
+		limit int64
+		err   error
+	}{
+		{int64(len(body)), nil},
+		{int64(len(body)) + 1, nil},
+		{0, nil},
+		{int64(len(body)) - 1, ErrBodyTooLarge},
+	} {
+		c := newBindContext("POST", body)
+		b, err := c.Body(tc.limit)
+		if err != tc.err {
+			t.Errorf("limit %d: got error %v, want %v", tc.limit, err, tc.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if string(b) != body {
+			t.Errorf("limit %d: got %q", tc.limit, b)
+		}
+		// the body is still available to the binder
+		var item bulkItem
+		if err = c.Bind(&item); err != nil || item.Email != "a@x.com" {
+			t.Errorf("limit %d: bind after Body: got %+v, %v", tc.limit, item, err)
+		}
+	}
+
+	// the unknown length is checked while reading
+	c := newBindContext("POST", body)
+	c.request.ContentLength = -1
+	if _, err := c.Body(int64(len(body)) - 1); err != ErrBodyTooLarge {
+		t.Errorf("unknown length: got error %v, want %v", err, ErrBodyTooLarge)
+	}
+
+	// a smaller limit applies to the body buffered before
+	c = newBindContext("POST", body)
+	if err := c.BufferBody(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Body(4); err != ErrBodyTooLarge {
+		t.Errorf("buffered: got error %v, want %v", err, ErrBodyTooLarge)
+	}
+}
+
+func TestBindJSONBOM(t *testing.T) {
+	for _, body := range []string{
+		"\xEF\xBB\xBF" + `{"name":"a","email":"a@x.com"}`,
+		"\xEF\xBB\xBF \r\n\t" + `{"name":"a","email":"a@x.com"}`,
+		" \n" + `{"name":"a","email":"a@x.com"}`,
+	} {
+		var item bulkItem
+		c := newBindContext("POST", body)
+		if err := c.Bind(&item); err != nil || item.Email != "a@x.com" {
+			t.Errorf("%q: got %+v, %v", body, item, err)
+		}
+	}
+
+	var names []string
+	c := newBindContext("POST", "\xEF\xBB\xBF"+`[{"name":"a"},{"name":"b"}]`)
+	err := c.BindStream(func(decode func(v interface{}) error) error {
+		for {
+			var item bulkItem
+			if err := decode(&item); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			names = append(names, item.Name)
+		}
+	})
+	if err != nil || strings.Join(names, ",") != "a,b" {
+		t.Errorf("stream: got %v, %v", names, err)
+	}
+}
+
+type enumReq struct {
+	Status string   `json:"status" enum:"active,inactive,pending"`
+	Tags   []string `json:"tags" enum:"a, b"`
+	Sort   string   `json:"-"`
+	Order  string   `bind:"order" in:"query" enum:"asc,desc"`
+	// the zero values are checked if they are bound
+	Priority int  `json:"priority" enum:"1,2,3"`
+	Page     *int `bind:"page" in:"query" enum:"1,2"`
+	Nested   struct {
+		Level string `json:"level" enum:"low,high"`
+	} `json:"nested"`
+}
+
+func TestBindEnum(t *testing.T) {
+	for _, tc := range []struct {
+		body, query string
+		ignoreCase  bool
+		field       string
+	}{
+		{`{"status":"active","tags":["a","b"],"nested":{"level":"low"}}`, "?order=asc", false, ""},
+		{`{}`, "", false, ""}, // the absent fields are not checked
+		{`{"status":null,"priority":null,"tags":[]}`, "", false, ""},
+		{`{"status":""}`, "", false, "status"},
+		{`{}`, "?order=", false, "order"},
+		{`{"priority":2}`, "?page=1", false, ""},
+		{`{"priority":0}`, "", false, "priority"},
+		{`{"Priority":0}`, "", false, "priority"},
+		{`{}`, "?page=0", false, "page"},
+		{`{"status":"deleted"}`, "", false, "status"},
+		{`{"tags":["a","c"]}`, "", false, "tags"},
+		{`{}`, "?order=random", false, "order"},
+		{`{"nested":{"level":"mid"}}`, "", false, "nested.level"},
+		{`{"status":"ACTIVE"}`, "", false, "status"},
+		{`{"status":"ACTIVE"}`, "?order=Desc", true, ""},
+	} {
+		req := httptest.NewRequest("POST", "/"+tc.query, strings.NewReader(tc.body))
+		req.Header.Set(HeaderContentType, MIMEApplicationJSON)
+		c := app.newContext(new(Response), req)
+		c.init(httptest.NewRecorder(), req)
+		var v enumReq
+		err := NewBinder(BindConfig{EnumIgnoreCase: tc.ignoreCase}).Bind(&v, c)
+		if tc.field == "" {
+			if err != nil {
+				t.Errorf("%s%s: got error %v", tc.body, tc.query, err)
+			}
+			continue
+		}
+		errs, ok := bindErrors(err)
+		if !ok || len(errs) != 1 || errs[0].Field != tc.field {
+			t.Errorf("%s%s: got %v, want an error of field %q", tc.body, tc.query, err, tc.field)
+			continue
+		}
+		if tc.field == "status" && !strings.Contains(errs[0].Reason, "active, inactive, pending") {
+			t.Errorf("%s: the allowed values are not reported: %q", tc.body, errs[0].Reason)
+		}
+	}
+
+	// the case-insensitive match is normalized to the spelling in the tag
+	req := httptest.NewRequest("POST", "/?order=DESC", strings.NewReader(`{"status":"Pending"}`))
+	req.Header.Set(HeaderContentType, MIMEApplicationJSON)
+	c := app.newContext(new(Response), req)
+	c.init(httptest.NewRecorder(), req)
+	var v enumReq
+	if err := NewBinder(BindConfig{EnumIgnoreCase: true}).Bind(&v, c); err != nil || v.Status != "pending" || v.Order != "desc" {
+		t.Errorf("got %+v, %v", v, err)
+	}
+
+	// the fields of an XML body are not tracked, its zero values are taken as absent
+	for body, field := range map[string]string{
+		`<enumReq><Priority>0</Priority></enumReq>`: "",
+		`<enumReq><Priority>5</Priority></enumReq>`: "priority",
+	} {
+		req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set(HeaderContentType, MIMEApplicationXML)
+		c = app.newContext(new(Response), req)
+		c.init(httptest.NewRecorder(), req)
+		v = enumReq{}
+		err := NewBinder(BindConfig{}).Bind(&v, c)
+		if errs, ok := bindErrors(err); field == "" && err != nil || field != "" && (!ok || len(errs) != 1 || errs[0].Field != field) {
+			t.Errorf("%s: got %v, want an error of field %q", body, err, field)
+		}
+	}
+}
+
+func TestBindFrom(t *testing.T) {
+	type attrs struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+	type user struct {
+		ID    string `json:"id"`
+		Attrs attrs  `json:"attributes"`
+	}
+
+	var u user
+	c := newBindContext("POST", "\xEF\xBB\xBF"+`{"data":{"id":"7","attributes":{"name":"a","age":3}},"meta":{"page":1}}`)
+	if err := c.BindFrom(&u, "data"); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != "7" || u.Attrs.Name != "a" || u.Attrs.Age != 3 {
+		t.Fatalf("got %+v", u)
+	}
+	// the body can still be read for the other fields
+	var meta struct {
+		Page int `json:"page"`
+	}
+	if err := c.BindFrom(&meta, "Meta"); err != nil || meta.Page != 1 {
+		t.Fatalf("meta: got %+v, %v", meta, err)
+	}
+
+	var a attrs
+	c = newBindContext("POST", `{"data":{"attributes":{"name":"b"}}}`)
+	if err := c.BindFrom(&a, "data.attributes"); err != nil || a.Name != "b" {
+		t.Fatalf("nested: got %+v, %v", a, err)
+	}
+
+	for body, want := range map[string]string{
+		`{"meta":{}}`:           `request body field "data" is missing`,
+		`{"data":null}`:         `request body field "data" is missing`,
+		`{"data":{}}`:           `request body field "data.attributes" is missing`,
+		`{"data":[1]}`:          `request body field "data" must be a JSON object`,
+		`[{"data":{}}]`:         `request body must be a JSON object`,
+		`{"data":{"attributes"`: `unexpected end of JSON input`,
+	} {
+		err := newBindContext("POST", body).BindFrom(&a, "data.attributes")
+		he, ok := err.(*HTTPError)
+		if !ok || he.Code != http.StatusBadRequest || he.Message != want {
+			t.Errorf("%s: got %v, want %q", body, err, want)
+		}
+	}
+
+	c = newBindContext("POST", `{"data":{"attributes":{"age":"x"}}}`)
+	err := c.BindFrom(&a, "data.attributes")
+	errs, ok := bindErrors(err)
+	if !ok || len(errs) != 1 || errs[0].Field != "data.attributes.age" || !strings.Contains(err.Error(), `"data.attributes.age"`) {
+		t.Fatalf("type error: got %v", err)
+	}
+
+	c = newBindContext("POST", `data=1`)
+	c.request.Header.Set(HeaderContentType, MIMEApplicationForm)
+	if err := c.BindFrom(&a, "data"); err != ErrUnsupportedMediaType {
+		t.Fatalf("form: got %v", err)
+	}
+}
+
+type formAddress struct {
+	City string `form:"city"`
+}
+
+type formMeta struct {
+	Source string `form:"source"`
+}
+
+type formReq struct {
+	formMeta
+	Address *formAddress
+	Name    string    `form:"name" json:"full_name" xml:"name"`
+	Age     *int      `form:"age" xml:"age"`
+	Tags    []string  `form:"tag"`
+	Scores  []*int    `form:"score"`
+	Born    time.Time `form:"born" layout:"02/01/2006"`
+	Skipped string    `form:"-"`
+}
+
+func TestBindContentType(t *testing.T) {
+	newContext := func(ctype, body string) *Context {
+		c := newBindContext("POST", body)
+		c.request.Header.Set(HeaderContentType, ctype)
+		return c
+	}
+
+	var v formReq
+	c := newContext(MIMEApplicationForm, "name=a&age=3&tag=x&tag=y&score=1&score=2&born=24/12/2001&source=web&city=paris&Skipped=s")
+	if err := c.Bind(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "a" || v.Age == nil || *v.Age != 3 || len(v.Tags) != 2 || v.Tags[1] != "y" ||
+		len(v.Scores) != 2 || *v.Scores[1] != 2 || v.Source != "web" || v.Address == nil ||
+		v.Address.City != "paris" || v.Skipped != "" || !v.Born.Equal(time.Date(2001, 12, 24, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("form: got %+v", v)
+	}
+
+	// a nil embedded pointer stays nil if none of its fields is sent
+	v = formReq{}
+	if err := newContext(MIMEApplicationForm, "name=a").Bind(&v); err != nil || v.Address != nil || v.Age != nil {
+		t.Fatalf("absent fields: got %+v, %v", v, err)
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("name", "b")
+	w.WriteField("tag", "z")
+	w.Close()
+	v = formReq{}
+	if err := newContext(w.FormDataContentType(), buf.String()).Bind(&v); err != nil || v.Name != "b" || len(v.Tags) != 1 {
+		t.Fatalf("multipart: got %+v, %v", v, err)
+	}
+
+	for _, ctype := range []string{MIMEApplicationXMLCharsetUTF8, "text/xml"} {
+		v = formReq{}
+		if err := newContext(ctype, "<formReq><name>c</name><age>4</age></formReq>").Bind(&v); err != nil || v.Name != "c" || *v.Age != 4 {
+			t.Fatalf("%s: got %+v, %v", ctype, v, err)
+		}
+	}
+
+	if err := newContext("text/csv", "name\nd").Bind(&v); err != ErrUnsupportedMediaType {
+		t.Fatalf("csv: got %v", err)
+	}
+	if errs, ok := bindErrors(newContext(MIMEApplicationForm, "age=x").Bind(&v)); !ok || len(errs) != 1 || errs[0].Field != "age" {
+		t.Fatalf("type error: got %v", errs)
+	}
+
+	// the binding errors are responded with 400 naming the field
+	a := newApp()
+	a.resetRouterBegin()
+	a.addwithlog(false, POST, "/", func(c *Context) error {
+		var v formReq
+		return c.Bind(&v)
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	for body, want := range map[string]int{"age=x": http.StatusBadRequest, "born=2001-12-24": http.StatusBadRequest, "age=1": http.StatusOK} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set(HeaderContentType, MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: got %d, want %d", body, rec.Code, want)
+		}
+		if field := strings.SplitN(body, "=", 2)[0]; want != http.StatusOK && !strings.Contains(rec.Body.String(), `field &#34;`+field+`&#34;`) {
+			t.Errorf("%s: the field is not named: %s", body, rec.Body.String())
+		}
+	}
+}
+
+type csvBinder struct{}
+
+func (csvBinder) Bind(i interface{}, c *Context) error {
+	b, err := io.ReadAll(c.BodyReader())
+	if err != nil {
+		return err
+	}
+	*i.(*[]string) = strings.Split(strings.TrimSpace(string(b)), ",")
+	return nil
+}
+
+type groupBinderStub struct{}
+
+func (groupBinderStub) Bind(i interface{}, c *Context) error {
+	*i.(*[]string) = []string{"group"}
+	return nil
+}
+
+func TestRegisterBinder(t *testing.T) {
+	defer app.RegisterBinder("text/csv", nil)
+	defer app.SetGroupBinder("/import", nil)
+	app.RegisterBinder("Text/CSV", csvBinder{})
+	app.SetGroupBinder("/import/", groupBinderStub{})
+
+	for _, tc := range []struct {
+		path, ctype, body string
+		want              string
+	}{
+		{"/users", "text/csv; charset=utf-8", "a,b", "a,b"},
+		{"/import/users", "text/csv", "c", "c"},
+		{"/import/users", MIMEApplicationJSON, `["d"]`, "group"},
+		{"/import", MIMEApplicationJSON, `["d"]`, "group"},
+		{"/importer", MIMEApplicationJSON, `["e"]`, "e"},
+	} {
+		c := newBindContext("POST", tc.body)
+		c.request.Header.Set(HeaderContentType, tc.ctype)
+		c.path = tc.path
+		var v []string
+		if err := c.Bind(&v); err != nil || strings.Join(v, ",") != tc.want {
+			t.Errorf("%s %s: got %v, %v, want %s", tc.path, tc.ctype, v, err, tc.want)
+		}
+	}
+
+	app.RegisterBinder("text/csv", nil)
+	c := newBindContext("POST", "a,b")
+	c.request.Header.Set(HeaderContentType, "text/csv")
+	var v []string
+	if err := c.Bind(&v); err != ErrUnsupportedMediaType {
+		t.Fatalf("removed: got %v, %v", v, err)
+	}
+}
+
+func TestRegisterBinderConcurrent(t *testing.T) {
+	defer app.RegisterBinder("text/csv", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			app.RegisterBinder("text/csv", csvBinder{})
+			app.RegisterBinder("text/csv", nil)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		c := newBindContext("POST", "a")
+		c.request.Header.Set(HeaderContentType, "text/csv")
+		var v []string
+		if err := c.Bind(&v); err != nil && err != ErrUnsupportedMediaType {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+type cycleA struct {
+	Name string `form:"name"`
+	B    *cycleB
+}
+
+type cycleB struct {
+	Other string `form:"other"`
+	A     *cycleA
+}
+
+func TestBindRecursiveTypes(t *testing.T) {
+	for ctype, body := range map[string]string{
+		MIMEApplicationForm: "name=x&other=y",
+		MIMEApplicationJSON: `{"name":"x"}`,
+	} {
+		c := newBindContext("POST", body)
+		c.request.Header.Set(HeaderContentType, ctype)
+		var a cycleA
+		if err := c.Bind(&a); err != nil {
+			t.Fatalf("%s: %v", ctype, err)
+		}
+		if a.B != nil && a.B.A != nil {
+			t.Errorf("%s: the recursive type is entered again: %+v", ctype, a.B.A)
+		}
+	}
+	c := newBindContext("POST", "name=x&other=y")
+	c.request.Header.Set(HeaderContentType, MIMEApplicationForm)
+	var a cycleA
+	if err := c.Bind(&a); err != nil || a.Name != "x" || a.B == nil || a.B.Other != "y" {
+		t.Fatalf("got %+v, %v", a, err)
+	}
+}
+
+type aggregateReq struct {
+	ID    int    `json:"id" in:"path"`
+	Page  int    `json:"page" in:"query"`
+	Count int    `json:"X-Count" in:"header"`
+	Name  string `json:"name"`
+}
+
+func TestBindAggregateErrors(t *testing.T) {
+	newContext := func() *Context {
+		req := httptest.NewRequest("POST", "/?page=two", strings.NewReader(`{"name":"a"}`))
+		req.Header.Set(HeaderContentType, MIMEApplicationJSON)
+		req.Header.Set("X-Count", "many")
+		c := app.newContext(new(Response), req)
+		c.init(httptest.NewRecorder(), req)
+		c.pkeys, c.pvalues = []string{"id"}, []string{"x"}
+		return c
+	}
+
+	var v aggregateReq
+	errs, ok := bindErrors(NewBinder(BindConfig{AggregateErrors: true}).Bind(&v, newContext()))
+	if !ok || len(errs) != 3 {
+		t.Fatalf("aggregated: got %v", errs)
+	}
+	for i, want := range []BindError{
+		{Field: "id", Source: SourcePath},
+		{Field: "page", Source: SourceQuery},
+		{Field: "X-Count", Source: SourceHeader},
+	} {
+		if errs[i].Field != want.Field || errs[i].Source != want.Source || !strings.Contains(errs[i].Reason, "invalid syntax") {
+			t.Errorf("aggregated error %d: got %+v, want field %q from %s", i, errs[i], want.Field, want.Source)
+		}
+	}
+	if v.Name != "a" {
+		t.Errorf("the valid fields are not bound: %+v", v)
+	}
+
+	// fail-fast by default
+	errs, ok = bindErrors(NewBinder(BindConfig{}).Bind(new(aggregateReq), newContext()))
+	if !ok || len(errs) != 1 || errs[0].Field != "id" {
+		t.Fatalf("fail-fast: got %v", errs)
+	}
+
+	// the errors are answered with 400 listing every field
+	a := newApp()
+	a.SetBinder(NewBinder(BindConfig{AggregateErrors: true}))
+	a.resetRouterBegin()
+	a.addwithlog(false, POST, "/users/:id", func(c *Context) error {
+		var v aggregateReq
+		if err := a.binderOf(c).Bind(&v, c); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+	a.resetChain()
+	a.resetRouterEnd()
+	a.SetStatus(true)
+	req := httptest.NewRequest(POST, "/users/x?page=two", strings.NewReader(`{"name":"a"}`))
+	req.Header.Set(HeaderContentType, MIMEApplicationJSON)
+	req.Header.Set("X-Count", "many")
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want 400", rec.Code)
+	}
+	for _, field := range []string{`path field &#34;id&#34;`, `query field &#34;page&#34;`, `header field &#34;X-Count&#34;`} {
+		if !strings.Contains(rec.Body.String(), field) {
+			t.Errorf("field %s is missing in %q", field, rec.Body.String())
+		}
+	}
+}
+
+type timeFormatItem struct {
+	At time.Time `json:"at" time_format:"2006-01-02 15:04"`
+}
+
+type timeFormatReq struct {
+	timeFormatItem
+	Day     time.Time        `json:"day" time_format:"2006-01-02" alias:"date"`
+	Since   *time.Time       `json:"since" time_format:"unix"`
+	Until   time.Time        `json:"until" layout:"02/01/2006"`
+	Default time.Time        `json:"default"`
+	Items   []timeFormatItem `json:"items"`
+}
+
+func TestBindJSONTimeFormat(t *testing.T) {
+	var v timeFormatReq
+	c := newBindContext("POST", `{"at":"2024-03-01 10:30","DATE":"2024-03-02","since":1700000000,`+
+		`"until":"31/12/2024","default":"2024-03-04T05:06:07Z","items":[{"at":"2024-05-06 07:08"}]}`)
+	if err := c.Bind(&v); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []struct {
+		got  time.Time
+		want string
+	}{
+		{v.At, "2024-03-01T10:30:00Z"},
+		{v.Day, "2024-03-02T00:00:00Z"},
+		{v.Until, "2024-12-31T00:00:00Z"},
+		{v.Default, "2024-03-04T05:06:07Z"},
+	} {
+		if got := x.got.UTC().Format(time.RFC3339); got != x.want {
+			t.Errorf("got %s, want %s", got, x.want)
+		}
+	}
+	if v.Since == nil || v.Since.Unix() != 1700000000 {
+		t.Errorf("since: got %v", v.Since)
+	}
+	if len(v.Items) != 1 || v.Items[0].At.Format("2006-01-02 15:04") != "2024-05-06 07:08" {
+		t.Errorf("items: got %+v", v.Items)
+	}
+
+	for body, field := range map[string]string{
+		`{"day":"2024-03-02T00:00:00Z"}`:     "day",
+		`{"since":"yesterday"}`:              "since",
+		`{"items":[{},{"at":"2024-05-06"}]}`: "items[1].at",
+		`{"day":3}`:                          "day",
+	} {
+		var v timeFormatReq
+		errs, ok := bindErrors(newBindContext("POST", body).Bind(&v))
+		if !ok || len(errs) != 1 || errs[0].Field != field || errs[0].Source != SourceBody {
+			t.Errorf("%s: got %v, want an error of field %q", body, errs, field)
+		}
+	}
+}
+
+// debugLogger records the debug logs and passes the other logs to the embedded Logger.
+type debugLogger struct {
+	logs.Logger
+	debugs []string
+}
+
+func (l *debugLogger) Debug(format string, v ...interface{}) {
+	l.debugs = append(l.debugs, fmt.Sprintf(format, v...))
+}
+
+type (
+	driftUser struct {
+		Name    string `json:"name"`
+		Phone   string `json:"phone" alias:"mobile"`
+		Tags    []driftTag
+		skipped string
+		*DriftBase
+	}
+	driftTag struct {
+		Label string `json:"label"`
+	}
+	// the embedded structs reference each other
+	DriftBase struct {
+		ID int `json:"id"`
+		*DriftMeta
+	}
+	DriftMeta struct {
+		Version int `json:"version"`
+		*DriftBase
+	}
+)
+
+func TestBindUnmappedFields(t *testing.T) {
+	log := &debugLogger{Logger: Log}
+	Log = log
+	debug := app.debug
+	defer func() {
+		Log = log.Logger
+		app.debug = debug
+	}()
+	body := `{"name":"a","mobile":"1","ID":2,"version":3,"userName":"b","Tags":[{"label":"x"},{"colour":"red"}],"skipped":"c"}`
+
+	app.debug = false
+	var v driftUser
+	if err := newBindContext("POST", body).Bind(&v); err != nil {
+		t.Fatal(err)
+	}
+	if len(log.debugs) != 0 {
+		t.Fatalf("release mode: got %q", log.debugs)
+	}
+
+	app.debug = true
+	v = driftUser{}
+	if err := newBindContext("POST", body).Bind(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "a" || v.Phone != "1" || v.DriftBase == nil || v.ID != 2 || v.Version != 3 {
+		t.Errorf("got %+v", v)
+	}
+	want := []string{"Bind: POST /: unmapped JSON fields: Tags[1].colour, skipped, userName"}
+	if !reflect.DeepEqual(log.debugs, want) {
+		t.Errorf("got %q, want %q", log.debugs, want)
+	}
+}
+
+func TestBindStream(t *testing.T) {
+	// read reads at most max elements.
+	read := func(body string, max int) ([]string, error) {
+		var names []string
+		err := newBindContext("POST", body).BindStream(func(decode func(v interface{}) error) error {
+			for len(names) < max {
+				var item bulkItem
+				if err := decode(&item); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				names = append(names, item.Name)
+			}
+			return nil
+		})
+		return names, err
+	}
+	cases := []struct {
+		body  string
+		max   int
+		names string
+		code  int // 0 for no error
+	}{
+		{`[{"name":"a"},{"name":"b"},{"name":"c"}]`, 10, "a,b,c", 0},
+		{"\xEF\xBB\xBF[{\"name\":\"a\"}]", 10, "a", 0},
+		{`[]`, 10, "", 0},
+		// the elements not read are drained and the closing ']' is still checked
+		{`[{"name":"a"},{"name":"b"}]`, 1, "a", 0},
+		{`[{"name":"a"},{"name":"b"}`, 1, "a", http.StatusBadRequest},
+		{`[{"name":"a"},{"name":]`, 10, "a", http.StatusBadRequest},
+		{`{"name":"a"}`, 10, "", http.StatusBadRequest},
+		{``, 10, "", http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		names, err := read(tc.body, tc.max)
+		if strings.Join(names, ",") != tc.names {
+			t.Errorf("%q: got %v, want %s", tc.body, names, tc.names)
+		}
+		if he, ok := err.(*HTTPError); tc.code == 0 && err != nil || tc.code != 0 && (!ok || he.Code != tc.code) {
+			t.Errorf("%q: got %#v, want code %d", tc.body, err, tc.code)
+		}
+	}
+
+	// the error of fn is returned as it is
+	errStop := errors.New("stop")
+	if err := newBindContext("POST", `[1]`).BindStream(func(func(interface{}) error) error { return errStop }); err != errStop {
+		t.Errorf("got %v, want %v", err, errStop)
+	}
+}
@@ -0,0 +1,105 @@
+package lessgo
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certReloader reloads the certificate of listen.HTTPSCertFile and HTTPSKeyFile when the files change,
+// e.g. the short-lived certificates rotated by an internal CA, without restarting the server.
+// The files are checked at most once per certCheckInterval on the TLS handshakes,
+// and a failed reload keeps serving the old certificate.
+type certReloader struct {
+	certFile, keyFile string
+	config            *tls.Config  // the config of the server, the certificate is the last of its Certificates
+	current           atomic.Value // *tls.Config with the reloaded certificate, unset before the first reload
+
+	mu         sync.Mutex
+	checked    time.Time
+	certStamp  fileStamp
+	keyStamp   fileStamp
+	getDefault func(*tls.ClientHelloInfo) (*tls.Config, error) // GetConfigForClient of the base config
+}
+
+// fileStamp tells whether a file has changed since it is loaded.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// certCheckInterval is the minimum interval between two checks of the certificate files.
+const certCheckInterval = time.Second
+
+// newCertReloader hooks the GetConfigForClient of config, whose last certificate is loaded from the files.
+// The GetConfigForClient of the base config still takes precedence if it returns a config.
+func newCertReloader(config *tls.Config, certFile, keyFile string) *certReloader {
+	r := &certReloader{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		config:     config,
+		checked:    time.Now(),
+		certStamp:  statFile(certFile),
+		keyStamp:   statFile(keyFile),
+		getDefault: config.GetConfigForClient,
+	}
+	config.GetConfigForClient = r.getConfigForClient
+	return r
+}
+
+func statFile(name string) fileStamp {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// getConfigForClient returns the config with the reloaded certificate,
+// or nil to use the config of the server if the certificate is never reloaded.
+func (r *certReloader) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if r.getDefault != nil {
+		if config, err := r.getDefault(hello); config != nil || err != nil {
+			return config, err
+		}
+	}
+	r.mu.Lock()
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		if statFile(r.certFile) != r.certStamp || statFile(r.keyFile) != r.keyStamp {
+			if err := r.reload(); err != nil {
+				Log.Error("failed to reload the TLS certificate, the old one is kept: %v", err)
+			}
+		}
+	}
+	r.mu.Unlock()
+	config, _ := r.current.Load().(*tls.Config)
+	return config, nil
+}
+
+// Reload loads the certificate files again whether they have changed or not.
+func (r *certReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = time.Now()
+	return r.reload()
+}
+
+// reload replaces the certificate if the files are loaded, the stamps are updated anyway,
+// so that a half-written pair is retried once the other file changes as well.
+func (r *certReloader) reload() error {
+	r.certStamp, r.keyStamp = statFile(r.certFile), statFile(r.keyFile)
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("%s %s %v", r.certFile, r.keyFile, err)
+	}
+	config := r.config.Clone()
+	config.GetConfigForClient = nil
+	config.Certificates = append([]tls.Certificate(nil), config.Certificates...)
+	config.Certificates[len(config.Certificates)-1] = cert
+	r.current.Store(config)
+	return nil
+}
@@ -0,0 +1,211 @@
+package lessgo
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// 响应压缩中间件的配置
+	CompressConfig struct {
+		Encodings []string       `json:"encodings"` // 启用的编码，同等质量值时按先后顺序优先，未注册压缩器的编码(如未注册Brotli时的"br")被忽略
+		Levels    map[string]int `json:"levels"`    // 各编码的压缩级别，未设置时使用默认级别
+	}
+
+	// 压缩器的构造函数，level为配置的压缩级别
+	CompressorFunc func(w io.Writer, level int) (io.WriteCloser, error)
+
+	// 压缩响应内容的ResponseWriter
+	compressWriter struct {
+		http.ResponseWriter
+		encoding   string
+		level      int
+		compressor CompressorFunc
+		w          io.WriteCloser
+		identity   bool // 不压缩(如204、304或已编码的响应)
+		err        error
+	}
+)
+
+var (
+	compressors = map[string]CompressorFunc{
+		"gzip": func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		"deflate": func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+	}
+	defaultCompressLevels = map[string]int{
+		"gzip":    gzip.DefaultCompression,
+		"deflate": flate.DefaultCompression,
+	}
+	compressorsLock sync.RWMutex
+)
+
+// 注册响应压缩器，如通过第三方库注册Brotli("br")，encoding为Content-Encoding的值，
+// defaultLevel为未配置级别时使用的压缩级别
+func RegisterCompressor(encoding string, defaultLevel int, fn CompressorFunc) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	encoding = strings.ToLower(encoding)
+	compressors[encoding] = fn
+	defaultCompressLevels[encoding] = defaultLevel
+}
+
+func getCompressor(encoding string) (CompressorFunc, int, bool) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	fn, ok := compressors[encoding]
+	return fn, defaultCompressLevels[encoding], ok
+}
+
+// 按Accept-Encoding的质量值从启用的编码中协商，质量值相同时按启用顺序优先
+func negotiateEncoding(acceptEncoding string, encodings []string) string {
+	qs := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := part, 1.0
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			coding = part[:i]
+			if param := strings.TrimSpace(part[i+1:]); strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		qs[strings.ToLower(strings.TrimSpace(coding))] = q
+	}
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, encoding := range encodings {
+		q, ok := qs[encoding]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+func (w *compressWriter) init() {
+	if w.w != nil || w.identity || w.err != nil {
+		return
+	}
+	header := w.ResponseWriter.Header()
+	if header.Get(HeaderContentEncoding) != "" {
+		w.identity = true
+		return
+	}
+	w.w, w.err = w.compressor(w.ResponseWriter, w.level)
+	if w.err != nil {
+		return
+	}
+	header.Set(HeaderContentEncoding, w.encoding)
+	header.Del(HeaderContentLength)
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	switch {
+	case code >= 100 && code < 200:
+		// 信息响应(如103 Early Hints)之后还有最终响应，不影响其压缩
+	case code == http.StatusNoContent || code == http.StatusNotModified || code < 100:
+		w.identity = true
+	default:
+		w.init()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.ResponseWriter.Header().Get(HeaderContentType) == "" {
+		// detect the content type from the uncompressed data
+		w.ResponseWriter.Header().Set(HeaderContentType, http.DetectContentType(b))
+	}
+	w.init()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.identity {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.w.Write(b)
+}
+
+// Flush flushes the compressed data to the client.
+func (w *compressWriter) Flush() {
+	if f, ok := w.w.(interface {
+		Flush() error
+	}); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the original ResponseWriter for http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) close() error {
+	if w.w == nil {
+		return nil
+	}
+	return w.w.Close()
+}
+
+var Compress = ApiMiddleware{
+	Name: "响应压缩",
+	Desc: "按Accept-Encoding的质量值协商压缩响应内容，并设置Vary: Accept-Encoding；" +
+		"内置gzip与deflate；未内置Brotli实现，需通过RegisterCompressor()注册第三方的br压缩器，并将\"br\"加入encodings(如置于首位以优先)后启用",
+	Config: CompressConfig{Encodings: []string{"gzip", "deflate"}},
+	Middleware: func(confObject interface{}) MiddlewareFunc {
+		conf := confObject.(CompressConfig)
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				c.response.Header().Add(HeaderVary, HeaderAcceptEncoding)
+				if c.request.Method == HEAD || c.request.Header.Get(HeaderUpgrade) != "" {
+					return next(c)
+				}
+				var enabled []string
+				for _, encoding := range conf.Encodings {
+					if _, _, ok := getCompressor(strings.ToLower(encoding)); ok {
+						enabled = append(enabled, strings.ToLower(encoding))
+					}
+				}
+				encoding := negotiateEncoding(c.request.Header.Get(HeaderAcceptEncoding), enabled)
+				if encoding == "" {
+					return next(c)
+				}
+				compressor, level, _ := getCompressor(encoding)
+				if l, ok := conf.Levels[encoding]; ok {
+					level = l
+				}
+				w := c.response.Writer()
+				cw := &compressWriter{
+					ResponseWriter: w,
+					encoding:       encoding,
+					level:          level,
+					compressor:     compressor,
+				}
+				c.response.SetWriter(cw)
+				err := next(c)
+				c.response.SetWriter(w)
+				if e := cw.close(); err == nil {
+					err = e
+				}
+				return err
+			}
+		}
+	},
+}.Reg()
@@ -1,11 +1,16 @@
 package lessgo
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	confpkg "github.com/henrylee2cn/lessgo/config"
 	"github.com/henrylee2cn/lessgo/logs"
@@ -14,16 +19,27 @@ import (
 type (
 	// Config is the main struct for Config
 	config struct {
-		AppName     string // Application name
-		Info        Info   // Application info
-		Debug       bool   // enable/disable debug mode.
-		CrossDomain bool
-		MaxMemoryMB int64 // 文件上传默认内存缓存大小，单位MB
-		Listen      Listen
-		Session     SessionConfig
-		Log         LogConfig
-		FileCache   FileCacheConfig
+		AppName        string // Application name
+		Info           Info   // Application info
+		Debug          bool   // enable/disable debug mode.
+		TrustedProxies string // 可信代理的CIDR或IP列表，以逗号分隔，如"10.0.0.0/8,::1"，设置后仅采信其发送的X-Forwarded-For与X-Real-IP，为空时以连接的对端地址为客户端IP
+		TrustAnyProxy  bool   // 未设置TrustedProxies时采信任意来源的X-Real-IP与X-Forwarded-For(首个地址)，即旧版行为，客户端可伪造其IP，仅在服务只能经由代理访问时开启
+		CrossDomain    bool
+		MaxMemoryMB    int64 // 文件上传默认内存缓存大小，单位MB
+		MaxPathLength  int64 // URL路径(解码后)的最大长度，超出时返回414，0表示不限制
+		MaxBodyBytes   int64 // 请求体的最大字节数，Content-Length超出时在路由前返回413，读取超出时返回413，0表示不限制
+		DisablePooling bool  // 禁用Context对象池，每个请求新建对象且不回收，用于排查请求间数据串扰等问题，会增加内存分配与GC开销，仅建议调试时开启，可由环境变量LESSGO_DISABLE_POOL覆盖
+		PoolPoisoning  bool  // 启用对象池时，Context放回池前清除其引用的请求、响应与路由参数，残留的引用只能读到空值而非下一请求的数据，仅建议调试时开启
+		DisableRecover bool  // 禁用请求过程中恐慌的恢复，恐慌将不返回500而是交由http.Server处理(记录日志并关闭连接)，或由Handler()外层自行recover
+		TrustRequestID bool  // 是否沿用客户端(如可信网关)发送的X-Request-Id作为请求ID，否则总是生成新的请求ID
+		Listen         Listen
+		Session        SessionConfig
+		Log            LogConfig
+		FileCache      FileCacheConfig
 	}
+	// 全局配置Config的类型，可用于在包外声明配置变量，如ConfigFromEnv()的返回值
+	AppConfig = config
+
 	Info struct {
 		Version           string
 		Description       string
@@ -34,13 +50,29 @@ type (
 	}
 	// Listen holds for http and https related config
 	Listen struct {
-		Address       string
-		ReadTimeout   int64
-		WriteTimeout  int64
-		EnableTLS     bool
-		TLSAddress    string
-		HTTPSKeyFile  string
-		HTTPSCertFile string
+		Network           string // 监听的网络类型："tcp"(默认)、"tcp4"、"tcp6"或"unix"，为"unix"时Address与TLSAddress为socket文件路径
+		SocketFileMode    string // unix socket文件的权限(八进制)，如"0660"，为空时不修改
+		ReusePort         bool   // 是否以SO_REUSEPORT监听TCP端口，允许多个进程监听同一端口并由内核均衡分配连接(仅linux与darwin)
+		Address           string
+		ReadTimeout       int64 // 读取整个请求(含请求体)的超时时长，单位秒，0表示不限制
+		WriteTimeout      int64 // 自读完请求头起至写完响应的超时时长，单位秒，超时后连接被切断，0表示不限制
+		ReadHeaderTimeout int64 // 读取请求头的超时时长，单位秒，用于切断缓慢发送请求头的连接(slow-loris)，默认10秒，0表示不限制
+		IdleTimeout       int64 // keep-alive连接等待下一个请求的超时时长，单位秒，0表示使用ReadTimeout
+		MaxHeaderBytes    int64 // 请求头(含请求行)的最大字节数，超出时返回431，0表示使用默认值1MB
+		DisableKeepAlive  bool  // 是否禁用HTTP keep-alive，禁用后每个请求处理完即关闭连接，便于负载均衡轮换连接
+		EnableH2C         bool  // 是否在HTTP端口支持明文HTTP/2(h2c，prior knowledge方式)，用于不终结TLS的负载均衡或gRPC网关之后
+		EnableTLS         bool
+		TLSAddress        string
+		HTTPSKeyFile      string
+		HTTPSCertFile     string
+		ClientAuth        string // 双向TLS的客户端证书校验方式：""(不要求)、"request"、"require"、"verify_if_given"、"require_and_verify"
+		ClientCAFile      string // 用于校验客户端证书的CA证书文件(PEM格式)
+
+		UseSystemdSocket     bool   // 是否使用systemd socket activation传入的套接字，而非自行监听Address与TLSAddress(不支持Windows)
+		SystemdSocketName    string // 传入多个套接字时，HTTP服务使用的套接字在LISTEN_FDNAMES中的名称(即socket单元的FileDescriptorName=)
+		SystemdTLSSocketName string // 传入多个套接字时，HTTPS服务使用的套接字在LISTEN_FDNAMES中的名称
+		AcceptProxyProtocol  bool   // 是否解析连接开头的PROXY protocol(v1与v2)头，以负载均衡器(如TCP模式的HAProxy或ELB)传递的客户端地址作为RemoteAddr，缺少或格式错误时关闭连接
+		ProxyHeaderTimeout   int64  // 读取PROXY protocol头的超时时长，单位秒，默认5秒，0表示不限制
 	}
 	// SessionConfig holds session related config
 	SessionConfig struct {
@@ -113,17 +145,41 @@ func newConfig() *config {
 			License:           "MIT",
 			LicenseUrl:        "https://github.com/henrylee2cn/lessgo/raw/master/doc/LICENSE",
 		},
-		Debug:       true,
-		CrossDomain: false,
-		MaxMemoryMB: 64, // 64MB
+		Debug:          true,
+		CrossDomain:    false,
+		MaxMemoryMB:    64, // 64MB
+		MaxPathLength:  0,
+		MaxBodyBytes:   0,
+		DisablePooling: false,
+		PoolPoisoning:  false,
+		DisableRecover: false,
+		TrustRequestID: false,
+		TrustedProxies: "",
+		TrustAnyProxy:  false,
 		Listen: Listen{
-			Address:       "0.0.0.0:8080",
-			ReadTimeout:   0,
-			WriteTimeout:  0,
-			EnableTLS:     false,
-			TLSAddress:    "0.0.0.0:10443",
-			HTTPSCertFile: "",
-			HTTPSKeyFile:  "",
+			Network:           "tcp",
+			SocketFileMode:    "",
+			ReusePort:         false,
+			Address:           "0.0.0.0:8080",
+			ReadTimeout:       0,
+			WriteTimeout:      0,
+			ReadHeaderTimeout: 10, // 10s
+			IdleTimeout:       0,
+			MaxHeaderBytes:    0,
+			DisableKeepAlive:  false,
+			EnableH2C:         false,
+			EnableTLS:         false,
+			TLSAddress:        "0.0.0.0:10443",
+			HTTPSCertFile:     "",
+			HTTPSKeyFile:      "",
+			ClientAuth:        "",
+			ClientCAFile:      "",
+
+			UseSystemdSocket:     false,
+			SystemdSocketName:    "",
+			SystemdTLSSocketName: "",
+			AcceptProxyProtocol:  false,
+			ProxyHeaderTimeout:   5, // 5s
 		},
 		Session: SessionConfig{
 			SessionOn:               false,
@@ -219,7 +275,7 @@ func ReadSingleConfig(section string, p interface{}, iniconf confpkg.Configer) {
 					pf.SetInt(num)
 				}
 			case "filecache::cachesecond", "filecache::singlefileallowmb", "filecache::maxcapmb",
-				"listen::readtimeout", "listen::writetimeout",
+				"listen::readtimeout", "listen::writetimeout", "listen::idletimeout",
 				"session::sessiongcmaxlifetime", "session::sessioncookielifetime":
 				if num > 0 {
 					pf.SetInt(num)
@@ -274,6 +330,193 @@ func WriteSingleConfig(section string, p interface{}, iniconf confpkg.Configer)
 	}
 }
 
+// 从带前缀的环境变量读取配置，覆盖已有的配置值，未设置的环境变量保持原值，适用于十二要素应用通过环境变量部署；
+// 变量名为"前缀_分组_字段"的大写下划线形式，其中系统与监听配置不含分组，如：
+// LESSGO_DEBUG、LESSGO_ADDRESS、LESSGO_READ_TIMEOUT、LESSGO_HTTPS_CERT_FILE、LESSGO_LOG_LEVEL、LESSGO_SESSION_ON、LESSGO_FILE_CACHE_MAX_CAP_MB；
+// 时长字段(*Timeout、*Second、*Lifetime/*LifeTime)支持"30s"、"2m"等格式或整数秒，
+// 容量字段(*MB)支持"512MB"、"2GB"等格式或整数MB，字节数字段(*Bytes)支持"512KB"、"10MB"、"1GB"等格式或整数字节，日志级别支持"debug"等名称；
+// 存在格式错误的值时返回汇总的错误，且不修改这些字段；
+// 注：Debug、日志、会话与文件缓存配置在包初始化时即已生效，运行时修改仅监听配置会在Run()时生效
+func (this *config) LoadEnvConfig(prefix string) error {
+	var errs []string
+	loadEnvStruct(reflect.ValueOf(this).Elem(), strings.ToUpper(prefix), "", &errs)
+	if len(errs) > 0 {
+		return errors.New("invalid environment config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// 以默认配置为基础从带前缀的环境变量读取配置(不读取配置文件)，变量名规则见LoadEnvConfig；
+// 返回的配置不影响全局配置Config，需要时可整体赋值(*lessgo.Config = *c)或直接调用Config.LoadEnvConfig()
+func ConfigFromEnv(prefix string) (*AppConfig, error) {
+	c := newConfig()
+	return c, c.LoadEnvConfig(prefix)
+}
+
+// 依据结构体字段读取环境变量，prefix为不含末尾下划线的变量名前缀，section为分组名
+func loadEnvStruct(v reflect.Value, prefix, section string, errs *[]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		fv := v.Field(i)
+		if !fv.CanSet() {
+			continue
+		}
+		name := t.Field(i).Name
+		if fv.Kind() == reflect.Struct {
+			if name == "Listen" {
+				loadEnvStruct(fv, prefix, "", errs)
+			} else {
+				sub := envFieldName(name)
+				loadEnvStruct(fv, joinEnvName(prefix, sub), sub, errs)
+			}
+			continue
+		}
+		key := envFieldName(name)
+		// 避免重复的分组名，如SESSION_SESSION_ON
+		if section != "" && strings.HasPrefix(key, section+"_") {
+			key = key[len(section)+1:]
+		}
+		key = joinEnvName(prefix, key)
+		str, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		if err := setEnvField(fv, name, strings.TrimSpace(str)); err != nil {
+			*errs = append(*errs, fmt.Sprintf("%s=%q: %v", key, str, err))
+		}
+	}
+}
+
+func setEnvField(fv reflect.Value, name, str string) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(str)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return errors.New("not a bool")
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		var (
+			num int64
+			err error
+		)
+		switch {
+		case name == "Level":
+			num = int64(logLevelInt(str))
+			if num == -10 {
+				num, err = strconv.ParseInt(str, 10, 64)
+				if err != nil || logLevelInt(logLevelString(int(num))) != int(num) {
+					return errors.New("unknown log level")
+				}
+			}
+		case strings.HasSuffix(name, "Timeout") || strings.HasSuffix(name, "Second") ||
+			strings.HasSuffix(name, "Lifetime") || strings.HasSuffix(name, "LifeTime"):
+			num, err = parseEnvSeconds(str)
+		case strings.HasSuffix(name, "MB"):
+			num, err = parseEnvMB(str)
+		case strings.HasSuffix(name, "Bytes"):
+			num, err = parseEnvBytes(str)
+		default:
+			num, err = strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				err = errors.New("not an integer")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if fv.OverflowInt(num) {
+			return errors.New("out of range")
+		}
+		fv.SetInt(num)
+	}
+	return nil
+}
+
+// 解析时长，整数表示秒数
+func parseEnvSeconds(str string) (int64, error) {
+	if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return n, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, errors.New("not a duration")
+	}
+	if d%time.Second != 0 {
+		return 0, errors.New("duration must be whole seconds")
+	}
+	return int64(d / time.Second), nil
+}
+
+// 解析容量，整数表示MB
+func parseEnvMB(str string) (int64, error) {
+	if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return n, nil
+	}
+	upper := strings.ToUpper(str)
+	for _, unit := range []struct {
+		suffix string
+		mb     int64
+	}{{"TB", 1 << 20}, {"GB", 1 << 10}, {"MB", 1}} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSpace(upper[:len(upper)-len(unit.suffix)]), 10, 64)
+			if err != nil {
+				break
+			}
+			return n * unit.mb, nil
+		}
+	}
+	return 0, errors.New("not a size in MB, GB or TB")
+}
+
+// 解析字节数，整数表示字节
+func parseEnvBytes(str string) (int64, error) {
+	if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return n, nil
+	}
+	upper := strings.ToUpper(str)
+	for _, unit := range []struct {
+		suffix string
+		bytes  int64
+	}{{"GB", 1 << 30}, {"MB", MB}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSpace(upper[:len(upper)-len(unit.suffix)]), 10, 64)
+			if err != nil {
+				break
+			}
+			if n > math.MaxInt64/unit.bytes || n < math.MinInt64/unit.bytes {
+				return 0, errors.New("out of range")
+			}
+			return n * unit.bytes, nil
+		}
+	}
+	return 0, errors.New("not a size in bytes, KB, MB or GB")
+}
+
+// 将字段名转换为大写下划线形式，如HTTPSKeyFile转换为HTTPS_KEY_FILE
+func envFieldName(name string) string {
+	rs := []rune(name)
+	var b strings.Builder
+	for i, r := range rs {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(rs[i-1]) || unicode.IsDigit(rs[i-1]) ||
+				i+1 < len(rs) && unicode.IsLower(rs[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func joinEnvName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "_" + name
+}
+
 // section name and key name case insensitive
 func getfullname(section, name string) string {
 	if section == "" {
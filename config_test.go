@@ -0,0 +1,117 @@
+package lessgo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/henrylee2cn/lessgo/logs"
+)
+
+func TestEnvFieldName(t *testing.T) {
+	for name, want := range map[string]string{
+		"Address":               "ADDRESS",
+		"ReadTimeout":           "READ_TIMEOUT",
+		"EnableTLS":             "ENABLE_TLS",
+		"HTTPSKeyFile":          "HTTPS_KEY_FILE",
+		"MaxMemoryMB":           "MAX_MEMORY_MB",
+		"SessionGCMaxLifetime":  "SESSION_GC_MAX_LIFETIME",
+		"EnableSidInHttpHeader": "ENABLE_SID_IN_HTTP_HEADER",
+	} {
+		if got := envFieldName(name); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestLoadEnvConfig(t *testing.T) {
+	t.Setenv("LESSGO_ADDRESS", "127.0.0.1:9090")
+	t.Setenv("LESSGO_READ_TIMEOUT", "1m30s")
+	t.Setenv("LESSGO_WRITE_TIMEOUT", "15")
+	t.Setenv("LESSGO_ENABLE_TLS", "true")
+	t.Setenv("LESSGO_HTTPS_CERT_FILE", "/etc/tls/cert.pem")
+	t.Setenv("LESSGO_MAX_MEMORY_MB", "1GB")
+	t.Setenv("LESSGO_LOG_LEVEL", "warn")
+	t.Setenv("LESSGO_SESSION_ON", "1")
+	t.Setenv("LESSGO_FILE_CACHE_MAX_CAP_MB", "512MB")
+	t.Setenv("LESSGO_MAX_BODY_BYTES", "10MB")
+	t.Setenv("LESSGO_MAX_HEADER_BYTES", "64kb")
+
+	var c *AppConfig
+	c, err := ConfigFromEnv("lessgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen.Address != "127.0.0.1:9090" || c.Listen.ReadTimeout != 90 || c.Listen.WriteTimeout != 15 ||
+		!c.Listen.EnableTLS || c.Listen.HTTPSCertFile != "/etc/tls/cert.pem" {
+		t.Errorf("listen: got %+v", c.Listen)
+	}
+	if c.MaxMemoryMB != 1024 || c.Log.Level != logs.WARN || !c.Session.SessionOn || c.FileCache.MaxCapMB != 512 {
+		t.Errorf("got MaxMemoryMB %d, Log %+v, SessionOn %v, MaxCapMB %d",
+			c.MaxMemoryMB, c.Log, c.Session.SessionOn, c.FileCache.MaxCapMB)
+	}
+	if c.MaxBodyBytes != 10<<20 || c.Listen.MaxHeaderBytes != 64<<10 {
+		t.Errorf("got MaxBodyBytes %d, MaxHeaderBytes %d", c.MaxBodyBytes, c.Listen.MaxHeaderBytes)
+	}
+	for str, want := range map[string]int64{"1024": 1024, "512B": 512, "512KB": 512 << 10, "2 GB": 2 << 30} {
+		if n, err := parseEnvBytes(str); err != nil || n != want {
+			t.Errorf("%q: got %d, %v, want %d", str, n, err, want)
+		}
+	}
+	for _, str := range []string{"lots", "10TB", "MB", "9223372036854775807GB"} {
+		if _, err := parseEnvBytes(str); err == nil {
+			t.Errorf("%q is accepted", str)
+		}
+	}
+	// the unset variables keep the defaults
+	if c.Listen.ReadHeaderTimeout != 10 || c.AppName != "lessgo" {
+		t.Errorf("defaults were overwritten: %+v", c.Listen)
+	}
+	// the exported type is the type of the global config
+	var global *AppConfig = Config
+	if global == c {
+		t.Error("the global config is returned")
+	}
+}
+
+func TestLoadEnvConfigInvalid(t *testing.T) {
+	t.Setenv("LESSGO_READ_TIMEOUT", "soon")
+	t.Setenv("LESSGO_ENABLE_TLS", "maybe")
+	t.Setenv("LESSGO_MAX_MEMORY_MB", "lots")
+	t.Setenv("LESSGO_LOG_LEVEL", "loud")
+	t.Setenv("LESSGO_ADDRESS", ":9090")
+
+	c := newConfig()
+	err := c.LoadEnvConfig("LESSGO")
+	if err == nil {
+		t.Fatal("malformed values were accepted")
+	}
+	for _, key := range []string{"LESSGO_READ_TIMEOUT", "LESSGO_ENABLE_TLS", "LESSGO_MAX_MEMORY_MB", "LESSGO_LOG_LEVEL"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error does not report %s: %v", key, err)
+		}
+	}
+	if c.Listen.ReadTimeout != 0 || c.Listen.EnableTLS || c.MaxMemoryMB != 64 {
+		t.Errorf("malformed values were applied: %+v", c.Listen)
+	}
+	if c.Listen.Address != ":9090" {
+		t.Errorf("valid value was not applied: got %q", c.Listen.Address)
+	}
+}
+
+func TestDisablePoolingFromEnv(t *testing.T) {
+	if !disablePoolingFromEnv(true) || disablePoolingFromEnv(false) {
+		t.Error("the config is not used without LESSGO_DISABLE_POOL")
+	}
+	t.Setenv("LESSGO_DISABLE_POOL", "1")
+	if !disablePoolingFromEnv(false) {
+		t.Error("LESSGO_DISABLE_POOL=1 is not used")
+	}
+	t.Setenv("LESSGO_DISABLE_POOL", "false")
+	if disablePoolingFromEnv(true) {
+		t.Error("LESSGO_DISABLE_POOL=false is not used")
+	}
+	t.Setenv("LESSGO_DISABLE_POOL", "yes")
+	if !disablePoolingFromEnv(true) {
+		t.Error("the invalid LESSGO_DISABLE_POOL overrides the config")
+	}
+}
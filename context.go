@@ -2,8 +2,12 @@ package lessgo
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,6 +20,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,12 +41,23 @@ type (
 		realRemoteAddr string
 		query          url.Values
 		form           url.Values
+		formErr        error          // the error of parsing the form, see MultipartForm
+		cookies        []*http.Cookie // the parsed cookies of the request, nil until Cookies is called
+		cookieErr      error
 		pkeys          []string
 		pvalues        []string
 		store          store
 		cruSession     session.Store
 		socket         *websocket.Conn
 		failureHandler FailureHandlerFunc
+		body           []byte // the buffered request body, see BufferBody
+		bodyBuffered   bool
+		poolData       interface{} // kept across requests, see App.SetContextNewHook
+		aborted        bool
+		trace          traceContext
+		apiVersion     apiVersion
+		stage          PanicSource // the middleware or handler being run
+		requestID      string
 	}
 
 	store map[string]interface{}
@@ -48,6 +65,28 @@ type (
 	// Common message format of JSON and JSONP.
 	CommJSON Result
 
+	// UploadOptions holds the validation options of `Context.SaveUploadedFile()`.
+	UploadOptions struct {
+		// MaxSize is the max size of the file in bytes, 0 means no limit.
+		MaxSize int64
+		// AllowedTypes are the allowed MIME types detected from the content,
+		// e.g. "image/png" or "image/*", empty means any type.
+		AllowedTypes []string
+	}
+
+	// UploadSizeError is returned when the uploaded file exceeds the max size.
+	UploadSizeError struct {
+		Filename string
+		MaxSize  int64
+	}
+
+	// UploadTypeError is returned when the detected type of the uploaded file is not allowed.
+	UploadTypeError struct {
+		Filename string
+		Type     string
+		Allowed  []string
+	}
+
 	ReverseProxys struct {
 		list map[string]*httputil.ReverseProxy
 		sync.RWMutex
@@ -68,6 +107,7 @@ var (
 	}
 )
 
+// Request returns the underlying *http.Request, e.g. for http.ServeContent or third-party SDKs.
 func (c *Context) Request() *http.Request {
 	return c.request
 }
@@ -76,8 +116,13 @@ func (c *Context) SetRequestBody(reader io.Reader) {
 	c.request.Body = ioutil.NopCloser(reader)
 }
 
+// ResponseWriter returns the http.ResponseWriter to pass to standard handlers,
+// which writes through the Response, so that its status and size are recorded.
+// It implements http.Flusher, http.Hijacker and http.Pusher only if the underlying writer does,
+// e.g. for the WebSocket upgraders or the server-sent events, and io.ReaderFrom,
+// and unwraps to the underlying writer for http.ResponseController.
 func (c *Context) ResponseWriter() http.ResponseWriter {
-	return c
+	return newStdResponseWriter(c)
 }
 
 func (c *Context) Response() *Response {
@@ -88,30 +133,175 @@ func (c *Context) SetResponse(resp *Response) {
 	c.response = resp
 }
 
+// IsTLS reports whether the client has sent the request over HTTPS, see Scheme.
+// Use TLSState for the TLS connection of the server itself.
 func (c *Context) IsTLS() bool {
-	return c.request.TLS != nil
+	return c.Scheme() == "https"
+}
+
+// ClientCertificates returns the certificates sent by the client over TLS,
+// the first one is the leaf certificate. It returns nil if the request is not over TLS
+// or the client has sent no certificate.
+// The certificates are verified only if `Listen.ClientAuth` asks for verification.
+func (c *Context) ClientCertificates() []*x509.Certificate {
+	if c.request.TLS == nil {
+		return nil
+	}
+	return c.request.TLS.PeerCertificates
+}
+
+// TLSState returns the state of the TLS connection of the request, or nil if it is not over TLS.
+func (c *Context) TLSState() *tls.ConnectionState {
+	return c.request.TLS
 }
 
+// VerifiedClientCertificate returns the leaf client certificate verified against
+// `Listen.ClientCAFile`, e.g. to map its Subject.CommonName or DNSNames to an identity.
+// It returns nil if the request is not over TLS, or the client certificate is not verified.
+func (c *Context) VerifiedClientCertificate() *x509.Certificate {
+	if c.request.TLS == nil || len(c.request.TLS.VerifiedChains) == 0 || len(c.request.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return c.request.TLS.VerifiedChains[0][0]
+}
+
+// Scheme returns "https" or "http", the scheme the client has used, e.g. to build absolute URLs.
+// Behind a TLS-terminating proxy trusted by App.SetTrustedProxies, it is taken from
+// X-Forwarded-Proto, X-Forwarded-Ssl or the proto of Forwarded; these headers from any other
+// peer are ignored, so the scheme of a request to the server directly is that of the connection.
 func (c *Context) Scheme() string {
-	if c.IsTLS() {
+	if c.request.TLS != nil {
 		return "https"
 	}
+	if proto := app.forwardedProto(c.request); proto != "" {
+		return proto
+	}
 	return "http"
 }
 
-// 获取客户端真实IP
+// ContentLength returns the length of the request body, -1 if it is unknown, e.g. chunked.
+func (c *Context) ContentLength() int64 {
+	return c.request.ContentLength
+}
+
+// UserAgent returns the `User-Agent` header of the request.
+func (c *Context) UserAgent() string {
+	return c.request.UserAgent()
+}
+
+// Referer returns the `Referer` header of the request.
+func (c *Context) Referer() string {
+	return c.request.Referer()
+}
+
+// BasicAuth returns the username and password of the `Authorization: Basic` header,
+// whose scheme is case-insensitive. ok is false if the header is absent or malformed.
+// Compare the password with crypto/subtle.ConstantTimeCompare.
+func (c *Context) BasicAuth() (username, password string, ok bool) {
+	return c.request.BasicAuth()
+}
+
+// BearerToken returns the token of the `Authorization: Bearer` header, see RFC 6750,
+// whose scheme is case-insensitive. ok is false if the header is absent, of another scheme,
+// or the token is missing or not a valid token68, e.g. with embedded whitespace.
+func (c *Context) BearerToken() (token string, ok bool) {
+	scheme, token, found := strings.Cut(c.request.Header.Get(HeaderAuthorization), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || !isToken68(token) {
+		return "", false
+	}
+	return token, true
+}
+
+// isToken68 reports whether s is a token68 of RFC 7235: 1*( ALPHA / DIGIT / "-" / "." / "_" / "~" / "+" / "/" ) *"=".
+func isToken68(s string) bool {
+	s = strings.TrimRight(s, "=")
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		case b == '-', b == '.', b == '_', b == '~', b == '+', b == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// KeepAlive reports whether the client wants the connection to be reused after the response.
+// HTTP/1.0 clients must ask for it with `Connection: keep-alive`,
+// HTTP/1.1 and later keep the connection alive unless `Connection: close` is sent.
+func (c *Context) KeepAlive() bool {
+	conn := c.request.Header[HeaderConnection]
+	for _, v := range conn {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), "close") {
+				return false
+			}
+		}
+	}
+	if c.request.ProtoAtLeast(1, 1) {
+		return true
+	}
+	for _, v := range conn {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), "keep-alive") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequestID returns the ID of the request, which is also set in the X-Request-Id response header,
+// see App.SetRequestIDGenerator. It is empty if the request is not served by ServeHTTP.
+func (c *Context) RequestID() string {
+	return c.requestID
+}
+
+// StdContext returns the context.Context of the request, which is canceled when the client
+// goes away, the HTTP/2 stream is reset or the server is shut down, e.g. to pass to
+// database queries or outbound calls, or to select on its Done channel and abort the handler.
+func (c *Context) StdContext() context.Context {
+	return c.request.Context()
+}
+
+// SetStdContext replaces the context.Context of the request, e.g. to add a deadline or values
+// for the later handlers. It lasts for the current request only.
+func (c *Context) SetStdContext(ctx context.Context) {
+	c.request = c.request.WithContext(ctx)
+}
+
+// Conn returns the underlying network connection of the request.
+// On the HTTPS server it is the `*tls.Conn` wrapping the TCP connection, whose ConnectionState
+// tells the negotiated TLS version, the server name and the client certificates.
+// It is only available when the request is served by the lessgo server, otherwise nil.
+func (c *Context) Conn() net.Conn {
+	conn, _ := c.request.Context().Value(connContextKey{}).(net.Conn)
+	return conn
+}
+
+// SetReadDeadline sets the deadline for reading the entire request, including the body.
+// For example, a handler that reads a large upload can extend the server default.
+func (c *Context) SetReadDeadline(deadline time.Time) error {
+	return http.NewResponseController(c.response.writer).SetReadDeadline(deadline)
+}
+
+// SetWriteDeadline sets the deadline for writing the response.
+// For example, a handler that streams for minutes can extend the server default.
+func (c *Context) SetWriteDeadline(deadline time.Time) error {
+	return http.NewResponseController(c.response.writer).SetWriteDeadline(deadline)
+}
+
+// 获取客户端真实IP，设置可信代理(App.SetTrustedProxies)后仅采信可信代理发送的X-Forwarded-For与X-Real-IP，
+// 未设置时为连接的对端地址，开启App.SetTrustAnyProxy时采信任意来源的转发头
 func (c *Context) RealRemoteAddr() string {
 	if len(c.realRemoteAddr) > 0 {
 		return c.realRemoteAddr
 	}
-	var ip string
-	if ip = c.request.Header.Get(HeaderXRealIP); len(ip) == 0 {
-		if ip = c.request.Header.Get(HeaderXForwardedFor); len(ip) == 0 {
-			ip, _, _ = net.SplitHostPort(c.request.RemoteAddr)
-		}
-	}
-	c.realRemoteAddr = ip
-	return ip
+	c.realRemoteAddr = app.realIP(c.request)
+	return c.realRemoteAddr
 }
 
 // Path returns the registered path for the handler.
@@ -124,6 +314,14 @@ func (c *Context) SetPath(p string) {
 	c.path = p
 }
 
+// SetURLPath rewrites the path of the request URL, e.g. from "/old/x" to "/new/x" by a middleware
+// registered before the router, so that the request is routed by the new path.
+// The change is local to the request, the original path is not kept.
+func (c *Context) SetURLPath(p string) {
+	c.request.URL.Path = p
+	c.request.URL.RawPath = ""
+}
+
 // PathParamKeys returns path param keys.
 func (c *Context) PathParamKeys() []string {
 	return c.pkeys
@@ -183,7 +381,9 @@ func (c *Context) SetPathParam(key, value string) {
 // 	}
 // }
 
-// QueryValues returns all query params.
+// QueryValues returns all query params, which are parsed once per request and cached
+// until the Context is freed. The values of a repeated key are kept in order, and
+// the malformed pairs, like a bad percent-encoding, are skipped instead of failing the others.
 func (c *Context) QueryValues() url.Values {
 	if c.query == nil {
 		c.query = c.request.URL.Query()
@@ -193,45 +393,41 @@ func (c *Context) QueryValues() url.Values {
 
 // QueryParams returns the query param with "[]string".
 func (c *Context) QueryParams(key string) []string {
-	if c.query == nil {
-		c.query = c.request.URL.Query()
-	}
-	return c.query[key]
+	return c.QueryValues()[key]
 }
 
 // QueryParam returns the query param for the provided key.
 func (c *Context) QueryParam(key string) string {
-	if c.query == nil {
-		c.query = c.request.URL.Query()
-	}
-	return c.query.Get(key)
+	return c.QueryValues().Get(key)
 }
 
 // SetQueryParam sets the query param. It replaces any existing
-// values.
+// values. The query of the request URL is re-encoded, sorted by key.
 func (c *Context) SetQueryParam(key string, value string) {
-	if c.query == nil {
-		c.query = c.request.URL.Query()
-	}
-	c.query.Set(key, value)
+	c.QueryValues().Set(key, value)
+	c.request.URL.RawQuery = c.query.Encode()
 }
 
 // AddQueryParam adds the the query param. It appends to any existing
-// values associated with key.
+// values associated with key. The query of the request URL is re-encoded, sorted by key.
 func (c *Context) AddQueryParam(key string, value string) {
-	if c.query == nil {
-		c.query = c.request.URL.Query()
-	}
-	c.query.Add(key, value)
+	c.QueryValues().Add(key, value)
+	c.request.URL.RawQuery = c.query.Encode()
+}
+
+// SetQueryString replaces the raw query of the request URL, e.g. "a=1&b=2" without "?",
+// the query params are parsed again on the next access.
+func (c *Context) SetQueryString(rawQuery string) {
+	c.request.URL.RawQuery = rawQuery
+	c.query = nil
 }
 
 // DelQueryParam deletes the values associated with key.
-// func (c *Context) DelQueryParam(key string) {
-// 	if c.query == nil {
-// 		c.query = c.request.URL.Query()
-// 	}
-// 	c.query.Del(key)
-// }
+// The query of the request URL is re-encoded, sorted by key.
+func (c *Context) DelQueryParam(key string) {
+	c.QueryValues().Del(key)
+	c.request.URL.RawQuery = c.query.Encode()
+}
 
 // HeaderValues returns the request header.
 func (c *Context) HeaderValues() http.Header {
@@ -264,7 +460,20 @@ func (c *Context) AddHeaderParam(key string, value string) {
 // 	c.request.Header.Del(key)
 // }
 
-// FormValues returns the form params as url.Values.
+// ParseForm parses the form of the request body once, like FormValues, and returns the error:
+// ErrBodyTooLarge if the body exceeds Config.MaxBodyBytes, or the error of a malformed body.
+// The url-encoded bodies are parsed for any method, DELETE included, and multipart/form-data
+// ones as well, with MaxMemory; the `charset` of the Content-Type is accepted but not converted.
+func (c *Context) ParseForm() error {
+	c.parseForm()
+	if c.formErr == http.ErrNotMultipart {
+		return nil
+	}
+	return c.formErr
+}
+
+// FormValues returns the form params of the request body as url.Values,
+// without the query params, see ParseForm.
 func (c *Context) FormValues() url.Values {
 	c.parseForm()
 	return c.form
@@ -288,6 +497,15 @@ func (c *Context) FormParam(key string) string {
 	return ""
 }
 
+// FormValue returns the first value for the provided key of the form of the request body,
+// or of the query if the body has none, like http.Request.FormValue.
+func (c *Context) FormValue(key string) string {
+	if vs := c.FormParams(key); len(vs) > 0 {
+		return vs[0]
+	}
+	return c.QueryParam(key)
+}
+
 // SetFormParam sets the form param. It replaces any existing values.
 func (c *Context) SetFormParam(key string, value string) {
 	c.parseForm()
@@ -313,6 +531,15 @@ func (c *Context) FormFile(key string) (multipart.File, *multipart.FileHeader, e
 	return c.request.FormFile(key)
 }
 
+// MultipartForm returns the parsed multipart form, including the uploaded files.
+// The files are kept in memory up to MaxMemory (Config.MaxMemoryMB) in total and stored in
+// temporary files beyond, which are removed when the request is done.
+// It returns http.ErrNotMultipart if the request is not multipart/form-data.
+func (c *Context) MultipartForm() (*multipart.Form, error) {
+	c.parseForm()
+	return c.request.MultipartForm, c.formErr
+}
+
 // SaveFile saves the file *Context.FormFile to UPLOADS_DIR,
 // character "?" indicates that the original file name.
 // for example newfname="a/?" -> UPLOADS_DIR/a/fname.
@@ -376,6 +603,89 @@ func (c *Context) SaveFile(key string, cover bool, newfname ...string) (fileUrl
 	return
 }
 
+// Error makes it compatible with `error` interface.
+func (e *UploadSizeError) Error() string {
+	return fmt.Sprintf("uploaded file %q exceeds the max size of %d bytes", e.Filename, e.MaxSize)
+}
+
+// Error makes it compatible with `error` interface.
+func (e *UploadTypeError) Error() string {
+	return fmt.Sprintf("type %q of uploaded file %q is not allowed, want %s", e.Type, e.Filename, strings.Join(e.Allowed, ", "))
+}
+
+// SaveUploadedFile streams the uploaded file to dst after validating it with the options.
+// The type is detected from the content by `http.DetectContentType`, not taken from the
+// declared Content-Type, so a client can not lie about it.
+// It returns `*UploadSizeError` if the file is larger than MaxSize and `*UploadTypeError` if
+// the detected type is not allowed; the size is checked while copying as well, in which case
+// the part that has been written to dst should be discarded.
+//
+//	_, fh, err := c.FormFile("avatar")
+//	...
+//	err = c.SaveUploadedFile(fh, w, lessgo.UploadOptions{MaxSize: 2 * lessgo.MB, AllowedTypes: []string{"image/*"}})
+func (c *Context) SaveUploadedFile(fileHeader *multipart.FileHeader, dst io.Writer, opts ...UploadOptions) (err error) {
+	var opt UploadOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.MaxSize > 0 && fileHeader.Size > opt.MaxSize {
+		return &UploadSizeError{Filename: fileHeader.Filename, MaxSize: opt.MaxSize}
+	}
+	f, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+
+	var r io.Reader = f
+	if opt.MaxSize > 0 {
+		r = io.LimitReader(f, opt.MaxSize+1)
+	}
+	// sniff the type from the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	head = head[:n]
+	if len(opt.AllowedTypes) > 0 {
+		detected := http.DetectContentType(head)
+		if i := strings.IndexByte(detected, ';'); i >= 0 {
+			detected = detected[:i]
+		}
+		if !mimeTypeAllowed(detected, opt.AllowedTypes) {
+			return &UploadTypeError{Filename: fileHeader.Filename, Type: detected, Allowed: opt.AllowedTypes}
+		}
+	}
+	if _, err = dst.Write(head); err != nil {
+		return err
+	}
+	size, err := io.Copy(dst, r)
+	if err != nil {
+		return err
+	}
+	if opt.MaxSize > 0 && int64(n)+size > opt.MaxSize {
+		return &UploadSizeError{Filename: fileHeader.Filename, MaxSize: opt.MaxSize}
+	}
+	return nil
+}
+
+// mimeTypeAllowed reports whether the MIME type matches any of the allowed types,
+// which may be wildcards like "image/*".
+func mimeTypeAllowed(typ string, allowed []string) bool {
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == typ || a == "*/*" || strings.HasSuffix(a, "/*") && strings.HasPrefix(typ, a[:len(a)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
 // CookieParams returns the HTTP cookies sent with the request.
 func (c *Context) CookieParams() []*http.Cookie {
 	return c.request.Cookies()
@@ -390,12 +700,251 @@ func (c *Context) CookieParam(key string) *http.Cookie {
 // AddCookieParam adds a cookie to the request.
 func (c *Context) AddCookieParam(cookie *http.Cookie) {
 	c.request.AddCookie(cookie)
+	c.cookies, c.cookieErr = nil, nil
+}
+
+// Cookie returns the named cookie of the request, or http.ErrNoCookie if it is not sent.
+// Unlike CookieParam, a malformed Cookie header is reported by the error, see Cookies.
+func (c *Context) Cookie(name string) (*http.Cookie, error) {
+	cookies, err := c.Cookies()
+	if err != nil {
+		return nil, err
+	}
+	for _, cookie := range cookies {
+		if cookie.Name == name {
+			return cookie, nil
+		}
+	}
+	return nil, http.ErrNoCookie
+}
+
+// Cookies returns the cookies of the request, which are parsed at the first call only.
+// Unlike CookieParams, which skips the invalid ones silently, it returns an error
+// if any Cookie header is malformed, together with the cookies of the valid headers.
+func (c *Context) Cookies() ([]*http.Cookie, error) {
+	if c.cookies != nil {
+		return c.cookies, c.cookieErr
+	}
+	c.cookies = []*http.Cookie{}
+	for _, line := range c.request.Header[HeaderCookie] {
+		cookies, err := http.ParseCookie(line)
+		if err != nil {
+			if c.cookieErr == nil {
+				c.cookieErr = fmt.Errorf("malformed cookie header %q: %v", line, err)
+			}
+			continue
+		}
+		c.cookies = append(c.cookies, cookies...)
+	}
+	return c.cookies, c.cookieErr
 }
 
 // Bind binds the request body into provided type `container`. The default binder
-// does it based on Content-Type header.
+// does it based on Content-Type header, see NewBinder. A malformed request is returned
+// as `*HTTPError` with status 400 naming the fields, which unwraps to `BindErrors`,
+// or with status 415 for an unsupported Content-Type.
+// The binders registered by RegisterBinder and SetGroupBinder are used in place of the default one.
 func (c *Context) Bind(container interface{}) error {
-	return app.binder.Bind(container, c)
+	return app.binderOf(c).Bind(container, c)
+}
+
+// BindFrom binds the value at the dotted path of the JSON body into `container`,
+// unwrapping an envelope like `{"data": {...}, "meta": {...}}`, for example:
+//
+//	err := c.BindFrom(&user, "data")
+//	err := c.BindFrom(&attrs, "data.attributes")
+//
+// The keys are matched like `encoding/json`. The rest is bound like `Bind()`, from the inner value
+// and the other sources, and the body fields of the returned `BindErrors` are prefixed by the path.
+// A malformed body, a missing or null path, or a path through a non-object value is rejected with status 400,
+// and a body that is not JSON with status 415.
+// The body is buffered by `BufferBody()`, so that it can still be read afterwards, e.g. for the `meta` field.
+func (c *Context) BindFrom(container interface{}, path string) error {
+	if !strings.HasPrefix(c.request.Header.Get(HeaderContentType), MIMEApplicationJSON) {
+		return ErrUnsupportedMediaType
+	}
+	if err := c.BufferBody(0); err != nil {
+		return err
+	}
+	raw, err := lookupJSONPath(bytes.TrimPrefix(c.body, utf8BOM), path)
+	if err != nil {
+		return NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	body := c.body
+	c.body = raw
+	err = c.Bind(container)
+	c.body = body
+	c.BodyReader()
+	var errs BindErrors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			if e.Source != SourceBody {
+				continue
+			}
+			switch {
+			case len(e.Field) == 0:
+				e.Field = path
+			case e.Field[0] == '[':
+				e.Field = path + e.Field
+			default:
+				e.Field = path + "." + e.Field
+			}
+		}
+		err = errs.httpError()
+	}
+	return err
+}
+
+// BindStream decodes a JSON array body element by element without loading the whole body
+// into memory. fn is called once with decode, each call of decode reads the next element
+// into v and returns `io.EOF` after the last one, for example:
+//
+//	err := c.BindStream(func(decode func(v interface{}) error) error {
+//		for {
+//			var item Item
+//			if err := decode(&item); err == io.EOF {
+//				return nil
+//			} else if err != nil {
+//				return err
+//			}
+//			// handle item
+//		}
+//	})
+//
+// The opening '[' is read by `json.Decoder.Token` before fn is called, a body that is not
+// a JSON array is rejected with status 400. A malformed element makes decode return
+// the decoding error as `*HTTPError` with status 400, and the stream can not be read any further.
+// After fn returns nil, the closing ']' is checked.
+func (c *Context) BindStream(fn func(decode func(v interface{}) error) error) error {
+	if c.request.Body == nil {
+		return NewHTTPError(http.StatusBadRequest, "request body can't be empty")
+	}
+	dec := json.NewDecoder(skipBOM(c.BodyReader()))
+	if tok, err := dec.Token(); err != nil {
+		return NewHTTPError(http.StatusBadRequest, err.Error())
+	} else if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return NewHTTPError(http.StatusBadRequest, "request body must be a JSON array")
+	}
+	var done bool
+	decode := func(v interface{}) error {
+		if done {
+			return io.EOF
+		}
+		if !dec.More() {
+			done = true
+			if _, err := dec.Token(); err != nil {
+				return NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			return io.EOF
+		}
+		if err := dec.Decode(v); err != nil {
+			return NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return nil
+	}
+	if err := fn(decode); err != nil {
+		return err
+	}
+	if !done {
+		// drain the elements that fn did not read
+		var skip json.RawMessage
+		for {
+			if err := decode(&skip); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BufferBody reads the whole request body into memory once, so that it can be
+// consumed several times, e.g. by a signature-verification middleware and then by `Bind()`.
+// Every consumer should read it by `BodyReader()`, which returns a fresh reader each time.
+// The body is held in memory until the request is finished, so keep the limit small;
+// a body larger than limit bytes is rejected with `ErrBodyTooLarge`,
+// limit <= 0 means no limit. Streaming uploads should not be buffered.
+func (c *Context) BufferBody(limit int64) error {
+	if c.bodyBuffered {
+		return nil
+	}
+	if c.request.Body == nil {
+		c.bodyBuffered = true
+		return nil
+	}
+	if limit > 0 && c.request.ContentLength > limit {
+		return ErrBodyTooLarge
+	}
+	r := io.Reader(c.request.Body)
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	b, err := ioutil.ReadAll(r)
+	if isBodyTooLarge(err) {
+		return ErrBodyTooLarge
+	}
+	if err != nil {
+		return err
+	}
+	if limit > 0 && int64(len(b)) > limit {
+		return ErrBodyTooLarge
+	}
+	c.request.Body.Close()
+	c.body = b
+	c.bodyBuffered = true
+	c.request.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return nil
+}
+
+// Body reads the raw request body of at most limit bytes, e.g. to verify the signature of a webhook,
+// returning `ErrBodyTooLarge` if it is larger. The body is buffered by `BufferBody()`,
+// so that `Bind()` and the other consumers can still read it afterwards.
+func (c *Context) Body(limit int64) ([]byte, error) {
+	if err := c.BufferBody(limit); err != nil {
+		return nil, err
+	}
+	// it may have been buffered before with a larger limit
+	if limit > 0 && int64(len(c.body)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	return c.body, nil
+}
+
+// BodyReader returns a fresh reader of the request body if it has been buffered by `BufferBody()`,
+// and resets the request body to a fresh reader as well for the next consumer;
+// otherwise it returns the request body itself, which can be read only once.
+func (c *Context) BodyReader() io.ReadCloser {
+	if !c.bodyBuffered {
+		return c.request.Body
+	}
+	c.request.Body = ioutil.NopCloser(bytes.NewReader(c.body))
+	return ioutil.NopCloser(bytes.NewReader(c.body))
+}
+
+// bodyEmpty reports whether the request carries an empty body.
+// A body of unknown length, e.g. chunked, is peeked by one byte, which is put back.
+func (c *Context) bodyEmpty() bool {
+	if c.bodyBuffered {
+		return len(c.body) == 0
+	}
+	body := c.request.Body
+	if body == nil || body == http.NoBody {
+		return true
+	}
+	if c.request.ContentLength >= 0 {
+		return c.request.ContentLength == 0
+	}
+	var b [1]byte
+	n, _ := io.ReadFull(body, b[:])
+	if n == 0 {
+		return true
+	}
+	c.request.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b[:n]), body), body}
+	return false
 }
 
 // Header returns the response header.
@@ -404,31 +953,56 @@ func (c *Context) Header() http.Header {
 }
 
 // SetHeader sets header for response. It replaces any existing values.
+// A warning is logged if the response has been committed, since the header would be ignored.
 func (c *Context) SetHeader(key string, value string) {
+	c.checkHeaderWritable(key)
 	c.response.Header().Set(key, value)
 }
 
 // AddHeader sets header for response. It appends to any existing
 // values associated with key.
+// A warning is logged if the response has been committed, since the header would be ignored.
 func (c *Context) AddHeader(key string, value string) {
+	c.checkHeaderWritable(key)
 	c.response.Header().Add(key, value)
 }
 
 // DelHeader deletes the values associated with key for response.
+// A warning is logged if the response has been committed, since the deletion would be ignored.
 func (c *Context) DelHeader(key string) {
+	c.checkHeaderWritable(key)
 	c.response.Header().Del(key)
 }
 
+// checkHeaderWritable logs a warning with the caller position
+// if the response header is modified after the response has been committed.
+func (c *Context) checkHeaderWritable(key string) {
+	if !c.response.committed {
+		return
+	}
+	if _, file, line, ok := runtime.Caller(2); ok {
+		Log.Warn("response already committed, the change of header %q at %s:%d is ignored", key, file, line)
+	} else {
+		Log.Warn("response already committed, the change of header %q is ignored", key)
+	}
+}
+
 // AddCookie adds cookie for response.
-// The provided cookie must have a valid Name. Invalid cookies may be
-// silently dropped.
+// The provided cookie must have a valid Name. Invalid cookies are
+// dropped with a warning, and so are the cookies added after the response is committed.
 func (c *Context) AddCookie(cookie *http.Cookie) {
-	c.response.Header().Add("Set-Cookie", cookie.String())
+	c.checkHeaderWritable(HeaderSetCookie)
+	addCookie(c.response.Header(), cookie, false)
 }
 
-// SetCookie sets cookie for response.
+// SetCookie sets cookie for response, replacing the cookies of the same name, path
+// and domain set before, e.g. the session cookie renewed by a middleware, while the others are kept.
+// SameSite is sent as Lax, Strict or None, and a cookie with a negative MaxAge is
+// sent with `Max-Age=0` to delete it on the client.
+// Like AddCookie, it is dropped with a warning after the response is committed.
 func (c *Context) SetCookie(cookie *http.Cookie) {
-	c.response.Header().Set("Set-Cookie", cookie.String())
+	c.checkHeaderWritable(HeaderSetCookie)
+	addCookie(c.response.Header(), cookie, true)
 }
 
 // DelCookie deletes cookie for response.
@@ -442,7 +1016,24 @@ func (c *Context) DelCookie() {
 // Content-Type line, Write adds a Content-Type set to the result of passing
 // the initial 512 bytes of written data to DetectContentType.
 func (c *Context) Write(b []byte) (int, error) {
-	return c.response.writer.Write(b)
+	return c.response.Write(b)
+}
+
+// Push initiates an HTTP/2 server push of target, e.g. "/static/app.css", with the header
+// of the push request, which may be nil. See Response.Push.
+func (c *Context) Push(target string, header http.Header) error {
+	return c.response.Push(target, &http.PushOptions{Header: header})
+}
+
+// Flush implements the http.Flusher interface, so that the standard handlers
+// wrapped by WrapHandler can flush too.
+func (c *Context) Flush() {
+	c.response.Flush()
+}
+
+// FlushError flushes buffered data to the client, see Response.FlushError.
+func (c *Context) FlushError() error {
+	return c.response.FlushError()
 }
 
 // WriteHeader sends an HTTP response header with status code.
@@ -452,15 +1043,41 @@ func (c *Context) Write(b []byte) (int, error) {
 // send error codes.
 func (c *Context) WriteHeader(code int) {
 	if c.response.committed {
-		Log.Warn("response already committed")
+		c.response.ignoreWriteHeader(code)
 		return
 	}
 	c.freeSession()
 	c.response.status = code
+	c.response.firstByte = time.Now()
 	c.response.writer.WriteHeader(code)
 	c.response.committed = true
 }
 
+// EarlyHints sends a `103 Early Hints` informational response with the `Link` headers
+// before the final response, so that the browser can start preloading the critical assets
+// while the handler is still working. A link is either a full `Link` value like
+// `</app.css>; rel=preload; as=style`, or a bare URL which is preloaded, e.g. "/app.js".
+// The links are kept in the header of the final response as well.
+// It is a no-op for the HTTP/1.0 clients, which can't handle the informational responses,
+// and returns `ErrResponseCommitted` if the final response has been sent.
+func (c *Context) EarlyHints(links ...string) error {
+	if c.response.committed {
+		return ErrResponseCommitted
+	}
+	if !c.request.ProtoAtLeast(1, 1) {
+		return nil
+	}
+	header := c.response.Header()
+	for _, link := range links {
+		if !strings.HasPrefix(link, "<") {
+			link = "<" + link + ">; rel=preload"
+		}
+		header.Add(HeaderLink, link)
+	}
+	c.response.writer.WriteHeader(http.StatusEarlyHints)
+	return nil
+}
+
 // Render renders a template with data and sends a text/html response with status
 // code. Templates can be registered using `App.SetRenderer()`.
 func (c *Context) Render(code int, name string, data interface{}) error {
@@ -543,7 +1160,7 @@ func (c *Context) JSONBlob(code int, b []byte) error {
 }
 
 // JSONP sends a JSONP response with status code. It uses `callback` to construct
-// the JSONP payload.
+// the JSONP payload, see JSONPBlob.
 func (c *Context) JSONP(code int, callback string, i interface{}) error {
 	var (
 		b   []byte
@@ -557,16 +1174,7 @@ func (c *Context) JSONP(code int, callback string, i interface{}) error {
 	if err != nil {
 		return err
 	}
-	c.response.Header().Set(HeaderContentType, MIMEApplicationJavaScriptCharsetUTF8)
-	c.WriteHeader(code)
-	if _, err = c.response.Write(utils.String2Bytes(callback + "(")); err != nil {
-		return err
-	}
-	if _, err = c.response.Write(b); err != nil {
-		return err
-	}
-	_, err = c.response.Write(utils.String2Bytes(");"))
-	return err
+	return c.JSONPBlob(code, callback, b)
 }
 
 // JSONP with default format.
@@ -587,18 +1195,45 @@ func (c *Context) JSONPMsg(code int, callback string, msgcode int, info interfac
 	if err != nil {
 		return err
 	}
+	return c.JSONPBlob(code, callback, b)
+}
+
+// JSONPBlob sends a JSONP blob response with status code as `callback(b);`.
+// The callback, usually taken from a query param, may only consist of letters, digits and `._$[]`,
+// so that no script can be injected by it; otherwise nothing is sent and
+// `*HTTPError` with status 400 is returned.
+func (c *Context) JSONPBlob(code int, callback string, b []byte) error {
+	if !isJSONPCallback(callback) {
+		return NewHTTPError(http.StatusBadRequest, "invalid JSONP callback")
+	}
 	c.response.Header().Set(HeaderContentType, MIMEApplicationJavaScriptCharsetUTF8)
 	c.WriteHeader(code)
-	if _, err = c.response.Write(utils.String2Bytes(callback + "(")); err != nil {
+	if _, err := c.response.Write(utils.String2Bytes(callback + "(")); err != nil {
 		return err
 	}
-	if _, err = c.response.Write(b); err != nil {
+	if _, err := c.response.Write(b); err != nil {
 		return err
 	}
-	_, err = c.response.Write(utils.String2Bytes(");"))
+	_, err := c.response.Write(utils.String2Bytes(");"))
 	return err
 }
 
+// isJSONPCallback reports whether the callback is a non-empty name like `jQuery123_456` or `cbs[0].done`.
+func isJSONPCallback(callback string) bool {
+	if callback == "" {
+		return false
+	}
+	for i := 0; i < len(callback); i++ {
+		switch ch := callback[i]; {
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9':
+		case ch == '.', ch == '_', ch == '$', ch == '[', ch == ']':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // XML sends an XML response with status code.
 func (c *Context) XML(code int, i interface{}) error {
 	b, err := xml.Marshal(i)
@@ -623,13 +1258,239 @@ func (c *Context) XMLBlob(code int, b []byte) error {
 	return err
 }
 
-// File sends a response with the content of the file.
+// Negotiate sends the value with status code in the format the client prefers
+// according to the `Accept` header, XML if it is preferred to JSON, otherwise JSON.
+func (c *Context) Negotiate(code int, i interface{}) error {
+	switch c.Accepts(MIMEApplicationJSON, MIMEApplicationXML, "text/xml") {
+	case MIMEApplicationXML, "text/xml":
+		return c.XML(code, i)
+	}
+	return c.JSON(code, i)
+}
+
+// Accepts returns the offered media type the client prefers according to the `Accept` header,
+// e.g. c.Accepts("application/json", "text/html"), or "" if none is acceptable.
+// The media ranges like "text/*" and "*/*" and their q-values are taken into account; the most
+// specific range matching an offer decides its quality, and the earlier offer wins a tie.
+// The first offer is returned without the header, and the malformed entries are ignored.
+func (c *Context) Accepts(offers ...string) string {
+	return acceptsOffer(c.request.Header.Get(HeaderAccept), offers)
+}
+
+func acceptsOffer(accept string, offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value of the most specific media range of the `Accept` header
+// matching the offer, 0 if none matches. It parses the header in place without allocating.
+func acceptQuality(accept, offer string) float64 {
+	offerType, offerParams, _ := strings.Cut(offer, ";")
+	offerType = strings.TrimSpace(offerType)
+	var (
+		q           float64
+		specificity = -1
+	)
+	for accept != "" {
+		var part string
+		part, accept, _ = strings.Cut(accept, ",")
+		mediaRange, params, _ := strings.Cut(part, ";")
+		mediaRange = strings.TrimSpace(mediaRange)
+		if mediaRange == "*" {
+			// sent by some old clients for */*
+			mediaRange = "*/*"
+		}
+		typ, subtype, ok := strings.Cut(mediaRange, "/")
+		if !ok || typ == "" || subtype == "" || (typ == "*" && subtype != "*") {
+			continue
+		}
+		var n int
+		switch {
+		case typ == "*":
+			n = 0
+		case !strings.EqualFold(typ, offerType[:strings.IndexByte(offerType+"/", '/')]):
+			continue
+		case subtype == "*":
+			n = 1
+		case strings.EqualFold(mediaRange, offerType):
+			n = 2
+		default:
+			continue
+		}
+		rangeQ, matched, valid := 1.0, true, true
+		for params != "" {
+			var param string
+			param, params, _ = strings.Cut(params, ";")
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			k, v = strings.TrimSpace(k), strings.Trim(strings.TrimSpace(v), `"`)
+			if strings.EqualFold(k, "q") {
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil || f < 0 || f > 1 {
+					valid = false
+				}
+				rangeQ = f
+				// the parameters after q are accept-extensions
+				break
+			}
+			if k == "" {
+				continue
+			}
+			n++
+			if !hasMediaParam(offerParams, k, v) {
+				matched = false
+			}
+		}
+		if !valid || !matched {
+			continue
+		}
+		if n > specificity {
+			q, specificity = rangeQ, n
+		}
+	}
+	return q
+}
+
+// hasMediaParam reports whether the parameters of a media type contain k=v, case-insensitively.
+func hasMediaParam(params, k, v string) bool {
+	for params != "" {
+		var param string
+		param, params, _ = strings.Cut(params, ";")
+		pk, pv, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(strings.TrimSpace(pk), k) && strings.EqualFold(strings.Trim(strings.TrimSpace(pv), `"`), v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Blob sends a blob response with status code and content type, e.g. an image or a PDF in memory.
+// It returns `ErrResponseCommitted` without writing anything if the response has been sent.
+func (c *Context) Blob(code int, contentType string, b []byte) error {
+	if c.response.committed {
+		return ErrResponseCommitted
+	}
+	c.response.Header().Set(HeaderContentType, contentType)
+	c.WriteHeader(code)
+	_, err := c.response.Write(b)
+	return err
+}
+
+// streamBufPool holds the buffers of Stream.
+var streamBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32<<10)
+		return &b
+	},
+}
+
+// Stream sends a response with status code and content type, copying the content of r
+// in chunks of 32KB and flushing each one to the client, e.g. a large CSV export
+// generated on the fly, so that the memory is constant whatever the size.
+// It stops when r returns io.EOF, or with the error when r fails, a write fails,
+// or the client goes away. It blocks until the copy is done, before the Context is freed.
+// It returns `ErrResponseCommitted` without reading r if the response has been sent.
+func (c *Context) Stream(code int, contentType string, r io.Reader) error {
+	if c.response.committed {
+		return ErrResponseCommitted
+	}
+	bufp := streamBufPool.Get().(*[]byte)
+	defer streamBufPool.Put(bufp)
+	var (
+		buf     = *bufp
+		readErr error
+	)
+	err := c.StreamFunc(code, contentType, func(w io.Writer) bool {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return false
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			return false
+		}
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	return err
+}
+
+// StreamFunc sends a response with status code and content type, calling step repeatedly
+// to write the next chunk to w, which is flushed to the client after each call,
+// until step returns false. step is not called any more once a write has failed
+// or the client has gone away, whose error is returned, e.g. context.Canceled.
+// It returns `ErrResponseCommitted` without calling step if the response has been sent.
+func (c *Context) StreamFunc(code int, contentType string, step func(w io.Writer) bool) error {
+	if c.response.committed {
+		return ErrResponseCommitted
+	}
+	c.response.Header().Set(HeaderContentType, contentType)
+	c.WriteHeader(code)
+	ctx := c.request.Context()
+	w := &streamWriter{w: c.response}
+	for w.err == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		more := step(w)
+		if w.err == nil {
+			if err := c.response.FlushError(); err != nil && err != ErrFlushNotSupported {
+				w.err = err
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return w.err
+}
+
+// streamWriter records the first error of the writes of a stream, after which it writes nothing.
+type streamWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(b)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// File sends a response with the content of the file, see ServeContent.
+// An `ETag` of the size and modification time is set unless the header is set already,
+// so that the `If-None-Match` and `If-Range` requests are answered as well.
 func (c *Context) File(file string) error {
 	if app.CanMemoryCache() {
 		b, fi, exist := app.memoryCache.GetCacheFile(file)
 		if !exist {
 			return c.Failure(404, nil)
 		}
+		c.setFileETag(fi)
 		return c.ServeContent(bytes.NewReader(b), fi.Name(), fi.ModTime())
 	}
 	f, err := os.Open(file)
@@ -645,11 +1506,23 @@ func (c *Context) File(file string) error {
 		if err != nil {
 			return c.Failure(404, nil)
 		}
+		defer f.Close()
 		fi, _ = f.Stat()
 	}
+	c.setFileETag(fi)
 	return c.ServeContent(f, fi.Name(), fi.ModTime())
 }
 
+// setFileETag sets the strong `ETag` of the file, like `"5f3c2a1b-1a2b"` of its modification time
+// and size, unless the header is set already, e.g. by a middleware with a content hash.
+func (c *Context) setFileETag(fi os.FileInfo) {
+	header := c.response.Header()
+	if _, ok := header[HeaderETag]; ok {
+		return
+	}
+	header.Set(HeaderETag, fmt.Sprintf(`"%x-%x"`, fi.ModTime().Unix(), fi.Size()))
+}
+
 // Markdown parses markdown file and generates html in github style
 func (c *Context) Markdown(file string, hasCatalog ...bool) error {
 	var catalog bool
@@ -694,19 +1567,115 @@ func (c *Context) Markdown(file string, hasCatalog ...bool) error {
 }
 
 // Attachment sends a response from `io.ReaderSeeker` as attachment, prompting
-// client to save the file.
+// client to save the file. The Content-Type is inferred from the extension of name,
+// which is encoded in the `Content-Disposition`, see AttachmentFile, and the `Range`
+// requests are answered like ServeContent.
 func (c *Context) Attachment(r io.ReadSeeker, name string) error {
-	c.response.Header().Set(HeaderContentType, ContentTypeByExtension(name))
-	c.response.Header().Set(HeaderContentDisposition, "attachment; filename="+name)
+	return c.serveDisposition("attachment", r, name, nil)
+}
 
-	c.WriteHeader(http.StatusOK)
-	_, err := io.Copy(c.response, r)
-	return err
+// Inline sends a response from `io.ReaderSeeker` to be displayed by the client, e.g. a PDF
+// in the browser, which saves it as name; see Attachment.
+func (c *Context) Inline(r io.ReadSeeker, name string) error {
+	return c.serveDisposition("inline", r, name, nil)
+}
+
+// AttachmentFile sends the file as attachment like File, prompting client to save it as name,
+// or as the base name of the file if name is empty. A non-ASCII name is encoded as the UTF-8
+// `filename*` of RFC 5987 with an ASCII `filename` fallback for the old clients.
+// It returns `ErrNotFound` if the file can not be opened or is a directory.
+func (c *Context) AttachmentFile(file, name string) error {
+	return c.dispositionFile("attachment", file, name)
+}
+
+// InlineFile sends the file to be displayed by the client like File, which saves it as name,
+// or as the base name of the file if name is empty; see AttachmentFile.
+func (c *Context) InlineFile(file, name string) error {
+	return c.dispositionFile("inline", file, name)
+}
+
+func (c *Context) dispositionFile(disposition, file, name string) error {
+	if name == "" {
+		name = filepath.Base(file)
+	}
+	if app.CanMemoryCache() {
+		b, fi, exist := app.memoryCache.GetCacheFile(file)
+		if !exist || fi.IsDir() {
+			return ErrNotFound
+		}
+		return c.serveDisposition(disposition, bytes.NewReader(b), name, fi)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return ErrNotFound
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return ErrNotFound
+	}
+	return c.serveDisposition(disposition, f, name, fi)
+}
+
+// serveDisposition sends the content with the `Content-Disposition` of name, and the `ETag`
+// and `Last-Modified` of the file if fi is not nil.
+func (c *Context) serveDisposition(disposition string, r io.ReadSeeker, name string, fi os.FileInfo) error {
+	header := c.response.Header()
+	header.Set(HeaderContentType, ContentTypeByExtension(name))
+	header.Set(HeaderContentDisposition, contentDisposition(disposition, name))
+	var modtime time.Time
+	if fi != nil {
+		c.setFileETag(fi)
+		modtime = fi.ModTime()
+	}
+	return c.ServeContent(r, name, modtime)
+}
+
+// contentDisposition returns the `Content-Disposition` like `attachment; filename="a b.txt"`,
+// with the percent-encoded UTF-8 `filename*` as well if the name is not printable ASCII,
+// whose fallback has the other characters replaced by '_'.
+func contentDisposition(disposition, name string) string {
+	var (
+		fallback = make([]byte, 0, len(name))
+		ascii    = true
+	)
+	for i := 0; i < len(name); i++ {
+		switch ch := name[i]; {
+		case ch < 0x20 || ch >= 0x7f:
+			ascii = false
+			if ch < 0x80 || ch >= 0xc0 {
+				// one '_' per control character or UTF-8 sequence
+				fallback = append(fallback, '_')
+			}
+		case ch == '"' || ch == '\\':
+			fallback = append(fallback, '\\', ch)
+		default:
+			fallback = append(fallback, ch)
+		}
+	}
+	v := disposition + `; filename="` + string(fallback) + `"`
+	if ascii {
+		return v
+	}
+	const hex = "0123456789ABCDEF"
+	encoded := make([]byte, 0, len(name)*3)
+	for i := 0; i < len(name); i++ {
+		switch ch := name[i]; {
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9',
+			strings.IndexByte("!#$&+-.^_`|~", ch) >= 0:
+			// attr-char of RFC 5987
+			encoded = append(encoded, ch)
+		default:
+			encoded = append(encoded, '%', hex[ch>>4], hex[ch&15])
+		}
+	}
+	return v + "; filename*=UTF-8''" + string(encoded)
 }
 
 // ServeContent sends static content from `io.ReadSeeker` and handles caching
 // via `If-Modified-Since` request header. It automatically sets `Content-Type`
-// and `Last-Modified` response headers.
+// and `Last-Modified` response headers. The `Range` requests are answered with 206,
+// e.g. for video seeking, and with an `ETag` set before, `If-None-Match` and `If-Range` too.
 func (c *Context) ServeContent(content io.ReadSeeker, name string, modtime time.Time) error {
 	http.ServeContent(c.response, c.request, name, modtime, content)
 	return nil
@@ -779,6 +1748,8 @@ func (c *Context) ReverseProxy(targetUrlBase string, pathAppend bool) error {
 	if !pathAppend {
 		c.request.URL.Path = ""
 	}
+	// propagate the trace context to the upstream
+	c.SetTraceHeaders(c.request.Header)
 	rp.ServeHTTP(c, c.request)
 	return nil
 }
@@ -893,6 +1864,34 @@ func (c *Context) Del(key string) {
 	delete(c.store, key)
 }
 
+// Abort stops the middleware chain: the downstream middleware and the handler are not executed,
+// even if the middleware that calls Abort still calls `next`, which then returns nil at once.
+// The middleware that aborts should write the response itself, for example:
+//
+//	if !authorized {
+//		c.Abort()
+//		return c.NoContent(401)
+//	}
+func (c *Context) Abort() {
+	c.aborted = true
+}
+
+// IsAborted reports whether `Abort()` has been called in the current request.
+func (c *Context) IsAborted() bool {
+	return c.aborted
+}
+
+// PoolData returns the data attached to the pooled Context, see `App.SetContextNewHook()`.
+// Unlike the store, it is not reset between requests, so the owner must reset its content.
+func (c *Context) PoolData() interface{} {
+	return c.poolData
+}
+
+// SetPoolData attaches the data to the pooled Context, normally in the hook set by `App.SetContextNewHook()`.
+func (c *Context) SetPoolData(v interface{}) {
+	c.poolData = v
+}
+
 // Contains checks if the key exists in the context.
 func (c *Context) Contains(key string) bool {
 	_, ok := c.store[key]
@@ -908,17 +1907,44 @@ func (c *Context) parseForm() {
 	if c.form != nil {
 		return
 	}
-	c.request.ParseMultipartForm(MaxMemory)
-	c.form = c.request.PostForm
-	if c.request.MultipartForm != nil {
-		for k, v := range c.request.MultipartForm.Value {
-			if _, ok := c.form[k]; ok {
-				c.form[k] = append(c.form[k], v...)
-			} else {
-				c.form[k] = v
-			}
+	if c.bodyBuffered {
+		c.BodyReader()
+	}
+	req := c.request
+	if req.PostForm == nil && req.Method != POST && req.Method != PUT && req.Method != PATCH && req.Body != nil {
+		// net/http parses the body of POST, PUT and PATCH only
+		if ct, _, _ := mime.ParseMediaType(req.Header.Get(HeaderContentType)); ct == MIMEApplicationForm {
+			req.PostForm, c.formErr = parseFormBody(req.Body)
 		}
 	}
+	// the error of ParseForm is not returned by ParseMultipartForm for the url-encoded bodies
+	if err := req.ParseForm(); c.formErr == nil {
+		c.formErr = err
+	}
+	if err := req.ParseMultipartForm(MaxMemory); c.formErr == nil {
+		c.formErr = err
+	}
+	if isBodyTooLarge(c.formErr) {
+		c.formErr = ErrBodyTooLarge
+	}
+	// the values of MultipartForm are merged into PostForm by net/http
+	c.form = c.request.PostForm
+}
+
+// maxFormSize is the max size of the url-encoded bodies parsed by parseFormBody, the same as net/http.
+const maxFormSize = 10 << 20
+
+// parseFormBody parses the url-encoded body which net/http does not, the values parsed so far
+// are returned with the error of a malformed body.
+func parseFormBody(body io.Reader) (url.Values, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxFormSize+1))
+	if err != nil {
+		return make(url.Values), err
+	}
+	if len(b) > maxFormSize {
+		return make(url.Values), errors.New("http: POST too large")
+	}
+	return url.ParseQuery(string(b))
 }
 
 func (c *Context) freeSession() {
@@ -932,6 +1958,10 @@ func (c *Context) init(rw http.ResponseWriter, req *http.Request) error {
 	var err error
 	c.pkeys = c.pkeys[:0]
 	c.pvalues = c.pvalues[:0]
+	// set before the session starts, which may fail or panic
+	c.request = req
+	c.response.init(rw)
+	c.store = make(store)
 	if app.sessions != nil {
 		c.cruSession, err = app.sessions.SessionStart(rw, req)
 		if err != nil {
@@ -939,22 +1969,54 @@ func (c *Context) init(rw http.ResponseWriter, req *http.Request) error {
 			return err
 		}
 	}
-	c.request = req
-	c.response.init(rw)
-	c.store = make(store)
+	if req.ProtoMajor == 1 && !c.KeepAlive() {
+		// tell legacy clients explicitly that the connection is not persistent
+		c.response.Header().Set(HeaderConnection, "close")
+	}
 	return err
 }
 
 func (c *Context) free() {
 	c.freeSession()
+	if c.request != nil && c.request.MultipartForm != nil {
+		// the temporary files of the uploads, in case the app is not served by net/http
+		c.request.MultipartForm.RemoveAll()
+	}
+	c.request = nil
+	for i := range c.pvalues {
+		c.pvalues[i] = ""
+	}
+	c.pkeys = c.pkeys[:0]
+	c.pvalues = c.pvalues[:0]
+	c.failureHandler = nil
 	c.socket = nil
 	c.store = nil
+	c.path = ""
 	c.realRemoteAddr = ""
 	c.query = nil
 	c.form = nil
+	c.formErr = nil
+	c.cookies = nil
+	c.cookieErr = nil
+	c.body = nil
+	c.bodyBuffered = false
+	c.aborted = false
+	c.trace = traceContext{}
+	c.apiVersion = apiVersion{}
+	c.stage = PanicSource{}
+	c.requestID = ""
 	c.response.free()
 }
 
+// poison detaches the freed Context from anything a stale reference may still hold, see App.SetPoolPoisoning.
+func (c *Context) poison() {
+	c.request = &http.Request{URL: new(url.URL), Header: make(http.Header)}
+	// the old arrays are cleared by free, and no longer reused
+	c.pkeys, c.pvalues = nil, nil
+	c.response.poison()
+	c.response = new(Response)
+}
+
 // ContentTypeByExtension returns the MIME type associated with the file based on
 // its extension. It returns `application/octet-stream` incase MIME type is not
 // found.
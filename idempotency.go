@@ -0,0 +1,215 @@
+package lessgo
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// 幂等请求的响应存储接口，可替换为redis等共享存储
+	IdempotencyStore interface {
+		// 获取未过期的响应
+		Get(key string) (*IdempotentResponse, bool)
+		// 保存响应，ttl为有效时长
+		Set(key string, resp *IdempotentResponse, ttl time.Duration)
+	}
+
+	// 被记录的幂等请求的原始响应
+	IdempotentResponse struct {
+		Status int
+		Header http.Header
+		Body   []byte
+	}
+
+	// 幂等请求中间件的配置
+	IdempotencyConfig struct {
+		TTL         int64 `json:"ttl"`           // 响应的保存时长，单位秒
+		Wait        int64 `json:"wait"`          // 相同key的首个请求仍在执行时最多等待的时长，单位秒，超时返回409，0表示不等待直接返回409
+		MaxBodySize int64 `json:"max_body_size"` // 可记录的响应内容的最大字节数，超出时照常响应但不记录，0表示不限制
+	}
+
+	// 默认的内存存储
+	memoryIdempotencyStore struct {
+		items map[string]*idempotencyItem
+		lock  sync.Mutex
+	}
+	idempotencyItem struct {
+		resp    *IdempotentResponse
+		expires time.Time
+	}
+
+	// 记录响应内容的ResponseWriter
+	idempotencyRecorder struct {
+		http.ResponseWriter
+		status   int
+		body     bytes.Buffer
+		limit    int64
+		overflow bool // 响应内容超出limit，不被记录
+	}
+)
+
+var (
+	idempotencyStore IdempotencyStore = &memoryIdempotencyStore{
+		items: map[string]*idempotencyItem{},
+	}
+
+	// 执行中的幂等请求，相同key的请求在此排队等待
+	idempotencyInflight     = map[string]chan struct{}{}
+	idempotencyInflightLock sync.Mutex
+)
+
+// 相同key的首个请求仍在执行，且等待超时
+var errIdempotencyInProgress = NewHTTPError(http.StatusConflict, "a request with the same Idempotency-Key is in progress")
+
+// 设置幂等请求的响应存储(内部有默认的内存实现)
+func SetIdempotencyStore(store IdempotencyStore) {
+	idempotencyStore = store
+}
+
+func (m *memoryIdempotencyStore) Get(key string) (*IdempotentResponse, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	item, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(item.expires) {
+		delete(m.items, key)
+		return nil, false
+	}
+	return item.resp, true
+}
+
+func (m *memoryIdempotencyStore) Set(key string, resp *IdempotentResponse, ttl time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	for k, item := range m.items {
+		if now.After(item.expires) {
+			delete(m.items, k)
+		}
+	}
+	m.items[key] = &idempotencyItem{resp: resp, expires: now.Add(ttl)}
+}
+
+func (r *idempotencyRecorder) WriteHeader(code int) {
+	if code >= 200 && r.status == 0 {
+		// 信息响应(如103 Early Hints)不是最终响应
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the original ResponseWriter for http.ResponseController.
+func (r *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if !r.overflow {
+		if r.limit > 0 && int64(r.body.Len()+len(b)) > r.limit {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// 占用key的执行权，若已有相同key的请求在执行，则返回其完成通知的通道
+func acquireIdempotencyKey(key string) (wait <-chan struct{}, release func()) {
+	idempotencyInflightLock.Lock()
+	defer idempotencyInflightLock.Unlock()
+	if ch, ok := idempotencyInflight[key]; ok {
+		return ch, nil
+	}
+	ch := make(chan struct{})
+	idempotencyInflight[key] = ch
+	return nil, func() {
+		idempotencyInflightLock.Lock()
+		delete(idempotencyInflight, key)
+		idempotencyInflightLock.Unlock()
+		close(ch)
+	}
+}
+
+// 重放已记录的响应，响应头的值被复制，避免与记录及其他重放共享
+func replayIdempotentResponse(c *Context, resp *IdempotentResponse) error {
+	header := c.response.Header()
+	for k, v := range resp.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	header.Set(HeaderIdempotentReplayed, "true")
+	c.WriteHeader(resp.Status)
+	_, err := c.response.Write(resp.Body)
+	return err
+}
+
+var Idempotency = ApiMiddleware{
+	Name: "幂等请求",
+	Desc: "携带Idempotency-Key请求头的请求在有效期内重复提交时，直接返回首次请求的原始响应(状态码、响应头与内容)而不再执行操作；" +
+		"相同key的并发请求排队执行，首个请求执行期间其余请求最多等待wait秒，其完成后重放，超时返回409，客户端断开时放弃等待；" +
+		"状态码>=500、返回错误或内容超出max_body_size的响应不被记录",
+	Config: IdempotencyConfig{TTL: 86400, Wait: 30, MaxBodySize: 1 * MB},
+	Middleware: func(confObject interface{}) MiddlewareFunc {
+		conf := confObject.(IdempotencyConfig)
+		ttl := time.Duration(conf.TTL) * time.Second
+		maxWait := time.Duration(conf.Wait) * time.Second
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				idemKey := c.request.Header.Get(HeaderIdempotencyKey)
+				if len(idemKey) == 0 {
+					return next(c)
+				}
+				key := c.request.Method + " " + c.request.URL.Path + " " + idemKey
+				var timeout <-chan time.Time
+				for {
+					if resp, ok := idempotencyStore.Get(key); ok {
+						return replayIdempotentResponse(c, resp)
+					}
+					wait, release := acquireIdempotencyKey(key)
+					if wait == nil {
+						defer release()
+						break
+					}
+					// 首个请求仍在执行，等待其完成后重放
+					if maxWait <= 0 {
+						return errIdempotencyInProgress
+					}
+					if timeout == nil {
+						timer := time.NewTimer(maxWait)
+						defer timer.Stop()
+						timeout = timer.C
+					}
+					select {
+					case <-wait:
+					case <-timeout:
+						return errIdempotencyInProgress
+					case <-c.request.Context().Done():
+						return c.request.Context().Err()
+					}
+				}
+
+				w := c.response.Writer()
+				rec := &idempotencyRecorder{ResponseWriter: w, limit: conf.MaxBodySize}
+				c.response.SetWriter(rec)
+				err := next(c)
+				c.response.SetWriter(w)
+				if err == nil && rec.status > 0 && rec.status < 500 && !rec.overflow {
+					idempotencyStore.Set(key, &IdempotentResponse{
+						Status: rec.status,
+						Header: w.Header().Clone(),
+						Body:   rec.body.Bytes(),
+					}, ttl)
+				}
+				return err
+			}
+		}
+	},
+}.Reg()
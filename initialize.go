@@ -3,7 +3,10 @@ package lessgo
 import (
 	"encoding/json"
 	"mime"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/henrylee2cn/lessgo/session"
@@ -46,6 +49,26 @@ func newLessgo() *Lessgo {
 	// 设置上传文件允许的最大尺寸
 	MaxMemory = Config.MaxMemoryMB * MB
 
+	// 设置URL路径的最大长度
+	l.App.SetMaxPathLength(int(Config.MaxPathLength))
+	l.App.SetMaxBodyBytes(Config.MaxBodyBytes)
+
+	// 设置是否禁用Context对象池，环境变量LESSGO_DISABLE_POOL优先，便于临时排查而不修改配置文件
+	l.App.SetDisablePooling(disablePoolingFromEnv(Config.DisablePooling))
+	l.App.SetPoolPoisoning(Config.PoolPoisoning)
+
+	// 设置是否禁用恐慌的恢复
+	l.App.SetDisableRecover(Config.DisableRecover)
+
+	// 设置是否沿用客户端发送的请求ID
+	l.App.SetTrustRequestID(Config.TrustRequestID)
+
+	// 设置可信代理，客户端真实IP仅采信其发送的转发头
+	if err := l.App.SetTrustedProxies(strings.Split(Config.TrustedProxies, ",")...); err != nil {
+		Log.Fatal("%v", err)
+	}
+	l.App.SetTrustAnyProxy(Config.TrustAnyProxy)
+
 	// 初始化sessions管理实例
 	sessions, err := newSessions()
 	if err != nil {
@@ -117,3 +140,17 @@ func registerStatics() {
 func registerFiles() {
 	File("/favicon.ico", IMG_DIR+"/favicon.ico")
 }
+
+// 读取环境变量LESSGO_DISABLE_POOL("1"、"true"等)，未设置或格式错误时使用配置的值
+func disablePoolingFromEnv(disable bool) bool {
+	s, ok := os.LookupEnv("LESSGO_DISABLE_POOL")
+	if !ok {
+		return disable
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(s))
+	if err != nil {
+		Log.Warn("invalid LESSGO_DISABLE_POOL=%q: %v", s, err)
+		return disable
+	}
+	return b
+}
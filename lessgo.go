@@ -7,13 +7,18 @@ Author2: https://github.com/changyu72
 package lessgo
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"runtime"
 	"sync"
+	"time"
 
 	_ "github.com/henrylee2cn/lessgo/_fixture"
 	"github.com/henrylee2cn/lessgo/logs"
@@ -115,7 +120,7 @@ func ServerEnable() bool {
 	return lessgo.serverEnable
 }
 
-//  开启网站服务
+// 开启网站服务
 func EnableServer() {
 	lessgo.lock.Lock()
 	lessgo.serverEnable = true
@@ -139,16 +144,135 @@ func SetPanicStackFunc(fn func(rcv interface{}) string) {
 	app.SetPanicStackFunc(fn)
 }
 
+// 设置请求过程中恐慌被恢复后的回调函数，source为恐慌发生所在的中间件或处理函数
+func SetPanicHook(fn func(c *Context, rcv interface{}, source PanicSource)) {
+	app.SetPanicHook(fn)
+}
+
 // 设置失败状态默认的响应操作(内部有默认实现)
 func SetFailureHandler(fn func(c *Context, code int, errString string) error) {
 	app.SetFailureHandler(fn)
 }
 
+// 设置指定路径前缀下路由的失败状态响应操作，如"/api"返回JSON错误、"/admin"返回HTML错误页面；
+// 按已注册路由路径最长匹配的前缀选用，无匹配前缀或请求未匹配任何路由(如404)时使用默认的响应操作；fn为nil时移除该前缀的设置
+func SetGroupFailureHandler(prefix string, fn func(c *Context, code int, errString string) error) {
+	app.SetGroupFailureHandler(prefix, fn)
+}
+
+// 追加错误钩子，处理函数返回错误后、渲染失败响应前按注册顺序依次调用；
+// 每个钩子接收上一个钩子返回的错误并可将其转换(如添加请求ID、将业务错误转换为*HTTPError、上报错误)，
+// 若某个钩子返回nil，则视为错误已被处理，跳过后续钩子且不再渲染失败响应
+func UseOnError(hooks ...ErrorHookFunc) {
+	app.UseOnError(hooks...)
+}
+
+// 设置路由是否忽略大小写匹配，开启后无法精确匹配的路径将忽略大小写再次匹配(不重定向)，
+// 如/Users/123可匹配/users/:id，路径参数保留原有大小写；默认关闭
+func SetCaseInsensitiveRouting(on bool) {
+	app.SetCaseInsensitiveRouting(on)
+}
+
+// 设置路由是否规范化路径后匹配，开启后无法精确匹配的路径将清理多余斜杠、.与..后再次匹配(不重定向)，
+// 如//users//123可匹配/users/:id；默认关闭
+func SetCleanPathRouting(on bool) {
+	app.SetCleanPathRouting(on)
+}
+
+// 设置每个响应默认携带的响应头(如Server、版本号、安全相关头部)，在中间件与处理函数执行前设置，因此仍可被覆盖；
+// 会替换之前的设置，nil表示清除
+func SetDefaultHeaders(headers map[string]string) {
+	app.SetDefaultHeaders(headers)
+}
+
+// 设置是否禁用Context对象池，禁用后每个请求新建Context且不回收，
+// 可用于排查持有Context引用导致的请求间数据串扰，但会增加内存分配与GC开销，仅建议调试时开启
+func SetDisablePooling(disable bool) {
+	app.SetDisablePooling(disable)
+}
+
+// 设置是否在Context放回对象池前清除其引用的请求、响应与路由参数(毒化)，启用对象池时生效，
+// 残留的Context、Response或路由参数引用只能读到空值而非下一请求的数据，仅建议调试时开启
+func SetPoolPoisoning(poison bool) {
+	app.SetPoolPoisoning(poison)
+}
+
+// 设置是否禁用请求过程中恐慌的恢复，禁用后恐慌不再返回500与调用恐慌回调，在清理Context并调用响应回调后继续抛出，
+// 交由http.Server处理(记录日志并关闭连接)，或由Handler()外层自行recover
+func SetDisableRecover(disable bool) {
+	app.SetDisableRecover(disable)
+}
+
+// 设置是否丢弃错误响应(状态码>=400)已提交后，再次调用WriteHeader所写入的响应体，如中间件已返回403而处理函数仍返回200及其内容，
+// 否则其内容将被追加在错误响应之后；多余的WriteHeader调用总是被忽略，并记录调用位置的警告日志
+func SetDiscardSuperfluousWrites(discard bool) {
+	app.SetDiscardSuperfluousWrites(discard)
+}
+
+// 设置请求ID的生成函数，请求ID在会话、回调与中间件之前分配，可由Context.RequestID()获取，
+// 记录在恐慌与错误日志中，并通过X-Request-Id响应头返回；默认为进程随机前缀加递增序号，nil表示恢复默认
+func SetRequestIDGenerator(fn func() string) {
+	app.SetRequestIDGenerator(fn)
+}
+
+// 设置是否沿用客户端(如可信网关)发送的X-Request-Id作为请求ID，便于关联两端日志；
+// 超过128字节或含不可打印字符的值被忽略并生成新的请求ID
+func SetTrustRequestID(trust bool) {
+	app.SetTrustRequestID(trust)
+}
+
+// 设置可信代理的CIDR或IP，客户端真实IP(RealRemoteAddr)仅采信可信代理发送的X-Forwarded-For与X-Real-IP，
+// 自右向左跳过可信代理取首个不可信地址，以防客户端伪造；未设置时以连接的对端地址为客户端IP(见SetTrustAnyProxy)，CIDR或IP无效时返回错误；
+// 请求的协议(Scheme)同样仅采信可信代理发送的X-Forwarded-Proto、X-Forwarded-Ssl与Forwarded
+func SetTrustedProxies(cidrs ...string) error {
+	return app.SetTrustedProxies(cidrs...)
+}
+
+// 设置未配置可信代理时是否采信任意来源的X-Real-IP与X-Forwarded-For(首个地址)作为客户端真实IP，即旧版行为；
+// 客户端可借此伪造其IP，仅在服务只能经由代理访问时开启
+func SetTrustAnyProxy(trust bool) {
+	app.SetTrustAnyProxy(trust)
+}
+
+// 设置未设置处理函数的路由(如未设置Handler的ApiHandler)的响应状态码，默认为503
+func SetMissingHandlerStatus(code int) {
+	app.SetMissingHandlerStatus(code)
+}
+
+// 设置Context对象池新建对象时的回调函数，可用于附加对象级数据(Context.SetPoolData)或预分配缓冲区；
+// 框架字段在每次请求前后仍会被重置，而对象级数据随池中对象长期保留，需由使用者自行重置
+func SetContextNewHook(fn func(*Context)) {
+	app.SetContextNewHook(fn)
+}
+
+// 设置每个请求开始时(设置默认响应头、路由与执行中间件之前)的回调函数，如开始计时或创建追踪span
+func SetRequestHook(fn func(*Context)) {
+	app.SetRequestHook(fn)
+}
+
+// 设置每个请求结束时的回调函数(恐慌被恢复并渲染失败响应后同样调用)，如记录状态码、响应字节数与耗时，
+// latency包含从对象池获取与初始化Context的时间；回调返回后Context即被重置并放回对象池，不可在回调外持有
+func SetResponseHook(fn func(c *Context, latency time.Duration)) {
+	app.SetResponseHook(fn)
+}
+
 // 设置捆绑数据处理接口(内部有默认实现)
 func SetBinder(b Binder) {
 	app.SetBinder(b)
 }
 
+// 注册指定媒体类型(如"application/vnd.acme+json"、"text/csv")的数据捆绑接口，忽略Content-Type的参数匹配，
+// 优先于分组与默认的捆绑接口；b为nil时移除该媒体类型的注册；可在运行中(如热重载路由时)调用
+func RegisterBinder(contentType string, b Binder) {
+	app.RegisterBinder(contentType, b)
+}
+
+// 设置指定路径前缀下路由的数据捆绑接口，替代默认的捆绑接口，按最长前缀匹配，按媒体类型注册的捆绑接口仍然优先；
+// b为nil时移除该前缀的设置；可在运行中调用
+func SetGroupBinder(prefix string, b Binder) {
+	app.SetGroupBinder(prefix, b)
+}
+
 // 设置html模板处理接口(内部有默认实现)
 func SetRenderer(r Renderer) {
 	app.SetRenderer(r)
@@ -163,6 +287,11 @@ func Debug() bool {
 	return app.Debug()
 }
 
+// 正在处理中的请求数，可用于观察优雅关闭时的排空进度
+func InflightRequests() int {
+	return app.InflightRequests()
+}
+
 // 设置运行模式
 func SetDebug(on bool) {
 	app.SetDebug(on)
@@ -218,6 +347,11 @@ func RealRoutes() []Route {
 	return app.RealRoutes()
 }
 
+// 返回指定请求方法与路径将匹配的真实路由(不执行处理)，用于测试与排查路由优先级
+func MatchRoute(method, path string) (Route, bool) {
+	return app.MatchRoute(method, path)
+}
+
 // 虚拟路由根节点
 func RootRouter() *VirtRouter {
 	return lessgo.virtRouter
@@ -393,9 +527,21 @@ func Leaf(prefix string, apiHandler *ApiHandler, middlewares ...*ApiMiddleware)
 	return vr
 }
 
+// 转换标准库的http.Handler为操作函数，使用c.Request()与c.ResponseWriter()作为原始的请求与响应对象
+func WrapHandler(h http.Handler) HandlerFunc {
+	return func(c *Context) error {
+		h.ServeHTTP(c.ResponseWriter(), c.Request())
+		return nil
+	}
+}
+
 // 自动转换某些允许的函数为中间件函数.
+// 支持标准库的http.Handler与func(http.ResponseWriter, *http.Request)，其已写入响应时不再执行后续操作.
 func WrapMiddleware(h interface{}) MiddlewareFunc {
-	var x HandlerFunc
+	var (
+		x   HandlerFunc
+		std bool
+	)
 	switch t := h.(type) {
 	case MiddlewareFunc:
 		return t
@@ -405,6 +551,10 @@ func WrapMiddleware(h interface{}) MiddlewareFunc {
 		x = t
 	case func(*Context) error:
 		x = HandlerFunc(t)
+	case http.Handler:
+		x, std = WrapHandler(t), true
+	case func(http.ResponseWriter, *http.Request):
+		x, std = WrapHandler(http.HandlerFunc(t)), true
 	default:
 		panic("[" + utils.ObjectName(h) + "] can not be converted to MiddlewareFunc.")
 	}
@@ -413,6 +563,9 @@ func WrapMiddleware(h interface{}) MiddlewareFunc {
 			if err := x(c); err != nil {
 				return err
 			}
+			if std && c.response.committed {
+				return nil
+			}
 			return next(c)
 		}
 	}
@@ -507,6 +660,111 @@ func ReregisterRouter(reasons ...string) {
 // 运行服务
 // @param graceExitCallback设置优雅关闭或重启时的收尾函数
 func Run(graceExitCallback ...func() error) {
+	prepare(graceExitCallback...)
+
+	// 启动服务
+	lessgo.App.run(Config.Listen)
+}
+
+// 异步运行服务，返回的通道在服务终止时接收其错误(正常关闭时为nil)，
+// 便于与信号处理、关闭计时等一同select。
+// @param graceExitCallback设置优雅关闭或重启时的收尾函数
+func RunAsync(graceExitCallback ...func() error) <-chan error {
+	prepare(graceExitCallback...)
+
+	// 启动服务
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- lessgo.App.serve(Config.Listen)
+	}()
+	return errChan
+}
+
+// 优雅关闭正在运行的服务：立即停止接受新连接，并等待进行中的请求处理完毕(其Context回收等收尾照常执行)；
+// 若ctx先结束则强制关闭剩余连接并返回ctx.Err()(如context.DeadlineExceeded)，服务未运行时返回nil。
+// Run()与RunAsync()启动的服务收到SIGINT/SIGTERM时会自动调用，等待时长由SetShutdownTimeout()设置
+func Shutdown(ctx context.Context) error {
+	return app.Shutdown(ctx)
+}
+
+// 设置HTTPS服务的基础TLS配置，用于设置最低版本(MinVersion)、限制加密套件(CipherSuites)或添加ALPN协议(NextProtos)等；
+// 启动时复制使用，Listen中配置的证书文件会追加到其Certificates，ClientAuth与ClientCAFile已配置时覆盖其对应设置；
+// 开启EnableTLS后，配置证书文件或在该配置中提供证书(Certificates、GetCertificate)均可启动HTTPS服务
+func SetTLSConfig(config *tls.Config) {
+	app.SetTLSConfig(config)
+}
+
+// 返回框架的http.Handler，可交由其他服务处理请求(如github.com/quic-go/quic-go/http3提供的HTTP/3服务)，
+// 中间件与Context对象池的行为不变；可通过SetDefaultHeaders()设置Alt-Svc响应头向客户端通告HTTP/3服务，
+// 该响应头由所有服务(Run()启动的HTTP与HTTPS服务及经由Handler()的服务)一同返回
+func Handler() http.Handler {
+	return app
+}
+
+// 添加额外的监听配置，由Run()与Config.Listen一同启动并一同关闭，用于在多个地址上提供相同的路由；
+// 各字段按原样使用，可复制Config.Listen后修改以保留ReadHeaderTimeout等默认值；Address非空时启动HTTP服务，开启EnableTLS时启动HTTPS服务
+func AddListen(listen Listen) {
+	app.AddListen(listen)
+}
+
+// 设置HTTP服务(不含HTTPS服务)处理函数的包装函数，如接入其他ACME客户端响应HTTP-01验证请求；优先于SetAutoTLS()设置的处理函数
+func SetHTTPHandlerWrapper(fn func(http.Handler) http.Handler) {
+	app.SetHTTPHandlerWrapper(fn)
+}
+
+// 设置自动申请HTTPS证书(如Let's Encrypt)的管理器，如golang.org/x/crypto/acme/autocert的*autocert.Manager，
+// 允许的域名(HostPolicy: autocert.HostWhitelist(...))与证书缓存目录(Cache: autocert.DirCache(...))在管理器中设置；
+// 用于开启EnableTLS但未配置证书文件或SetTLSConfig()证书的服务，其HTTP服务(Address，为空时为":80")
+// 响应HTTP-01验证请求并将其余请求重定向至HTTPS；须在服务启动前设置
+func SetAutoTLS(m AutoTLSManager) {
+	app.SetAutoTLS(m)
+}
+
+// 返回服务的统计计数：打开的连接数(含空闲连接)、进行中的请求数与累计处理的请求数，可用于就绪探针或下线排空逻辑
+func Stats() ServerStats {
+	return app.Stats()
+}
+
+// 运行时开启或禁用正在运行的服务的HTTP keep-alive，如在下线排空时使连接轮换；之后启动的服务仍按Listen.DisableKeepAlive配置
+func SetKeepAlivesEnabled(enabled bool) {
+	app.SetKeepAlivesEnabled(enabled)
+}
+
+// 设置客户端连接状态变化时的回调函数(见http.Server.ConnState)，需在服务启动前设置
+func SetConnStateHook(fn func(net.Conn, http.ConnState)) {
+	app.SetConnStateHook(fn)
+}
+
+// 返回正在运行的服务实际监听的地址(HTTPS在前，其后为HTTP及AddListen添加的服务)，如监听":0"时由内核分配的端口；未运行时返回nil
+func ListenerAddrs() []net.Addr {
+	return app.ListenerAddrs()
+}
+
+// 立即重新加载正在运行的HTTPS服务的证书文件(HTTPSCertFile与HTTPSKeyFile)，如在SIGHUP的处理函数中调用；
+// 证书文件变更后也会在一秒内的TLS握手时自动重新加载，加载失败时继续使用旧证书并返回首个错误；未运行时返回nil
+func ReloadTLS() error {
+	return app.ReloadTLS()
+}
+
+// 设置服务启动并开始接受连接后，以各监听地址调用的回调函数，如注册服务或在测试中等待服务就绪而无需sleep
+func SetOnListen(fn func(net.Addr)) {
+	app.SetOnListen(fn)
+}
+
+// 优雅重启正在运行的服务(同SIGUSR2信号)，如替换可执行文件后：以相同的路径、参数与环境变量启动新进程，
+// 新进程通过LISTEN_FDS环境变量继承监听的端口，开始服务后向当前进程发送SIGTERM，当前进程随即停止接受新连接并排空进行中的请求；
+// 启动前调用优雅关闭或重启的收尾函数，其返回错误时取消重启；返回新进程的pid，不支持Windows
+func Restart() (int, error) {
+	return app.Restart()
+}
+
+// 设置收到SIGINT/SIGTERM信号优雅关闭服务时，等待进行中请求的最长时长，默认1分钟
+func SetShutdownTimeout(timeout time.Duration) {
+	app.SetShutdownTimeout(timeout)
+}
+
+// 运行服务前的准备
+func prepare(graceExitCallback ...func() error) {
 	// 添加系统预设的路由操作前的中间件
 	registerBefore()
 
@@ -528,27 +786,7 @@ func Run(graceExitCallback ...func() error) {
 	// 开启最大核心数运行
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	// 配置服务器引擎
-	var (
-		tlsCertfile string
-		tlsKeyfile  string
-	)
-	if Config.Listen.EnableTLS {
-		tlsCertfile = Config.Listen.HTTPSCertFile
-		tlsKeyfile = Config.Listen.HTTPSKeyFile
-	}
-
 	if len(graceExitCallback) > 0 {
 		lessgo.App.SetGraceExitFunc(graceExitCallback[0])
 	}
-
-	// 启动服务
-	lessgo.App.run(
-		Config.Listen.Address,
-		Config.Listen.TLSAddress,
-		tlsCertfile,
-		tlsKeyfile,
-		Config.Listen.ReadTimeout,
-		Config.Listen.WriteTimeout,
-	)
 }
@@ -144,7 +144,9 @@ func NewLogger(channelLen int64) *BeeLogger {
 func (bl *BeeLogger) SetMsgChan(channelLen int64) {
 	bl.lock.Lock()
 	defer bl.lock.Unlock()
-	bl.flush()
+	// stop the running goroutine before the chans are replaced
+	bl.signalChan <- "stop"
+	bl.wg.Wait()
 	bl.signalChan = make(chan string, 1)
 	bl.msgChan = make(chan *logMsg, channelLen)
 	bl.wg.Add(1)
@@ -258,9 +260,11 @@ func (bl *BeeLogger) startLogger() {
 			bl.writeToLoggers(bm)
 			logMsgPool.Put(bm)
 		case sg := <-bl.signalChan:
-			// Now should only send "flush" or "close" to bl.signalChan
+			// Now should only send "flush", "stop" or "close" to bl.signalChan
 			bl.flush()
-			if sg == "close" {
+			if sg == "stop" {
+				gameOver = true
+			} else if sg == "close" {
 				for _, l := range bl.outputs {
 					l.Destroy()
 				}
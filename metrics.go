@@ -0,0 +1,197 @@
+package lessgo
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// 请求与响应大小统计中间件的配置
+	SizeMetricsConfig struct {
+		Buckets []int64 `json:"buckets"` // 直方图的桶上限(升序)，单位字节
+	}
+
+	// 字节数直方图
+	sizeHistogram struct {
+		counts []uint64 // 各桶计数(非累计)，最后一个为+Inf桶
+		sum    int64
+		count  uint64
+	}
+
+	// 按路由统计的直方图集合
+	sizeMetrics struct {
+		buckets  []int64
+		request  map[[2]string]*sizeHistogram
+		response map[[2]string]*sizeHistogram
+		lock     sync.Mutex
+	}
+
+	// 计算已读取字节数的请求body
+	countingReader struct {
+		io.ReadCloser
+		n int64
+	}
+)
+
+var (
+	defaultSizeBuckets = []int64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+	// 各桶配置的统计([]*sizeMetrics，按创建顺序)，新的桶配置追加时整体替换
+	globalSizeMetrics     atomic.Value
+	globalSizeMetricsLock sync.Mutex
+)
+
+func init() {
+	globalSizeMetrics.Store([]*sizeMetrics{newSizeMetrics(defaultSizeBuckets)})
+}
+
+// 返回指定桶配置的统计，不同的桶配置各自统计，均由WriteSizeMetrics()输出
+func sizeMetricsOf(buckets []int64) *sizeMetrics {
+	globalSizeMetricsLock.Lock()
+	defer globalSizeMetricsLock.Unlock()
+	list := globalSizeMetrics.Load().([]*sizeMetrics)
+	m := newSizeMetrics(buckets)
+	for _, current := range list {
+		if fmt.Sprint(m.buckets) == fmt.Sprint(current.buckets) {
+			return current
+		}
+	}
+	globalSizeMetrics.Store(append(list[:len(list):len(list)], m))
+	return m
+}
+
+func newSizeMetrics(buckets []int64) *sizeMetrics {
+	b := make([]int64, len(buckets))
+	copy(b, buckets)
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	return &sizeMetrics{
+		buckets:  b,
+		request:  map[[2]string]*sizeHistogram{},
+		response: map[[2]string]*sizeHistogram{},
+	}
+}
+
+func (h *sizeHistogram) observe(buckets []int64, v int64) {
+	i := sort.Search(len(buckets), func(i int) bool { return buckets[i] >= v })
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (m *sizeMetrics) observe(method, route string, reqSize, respSize int64) {
+	key := [2]string{method, route}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, x := range []struct {
+		hs map[[2]string]*sizeHistogram
+		v  int64
+	}{{m.request, reqSize}, {m.response, respSize}} {
+		h := x.hs[key]
+		if h == nil {
+			h = &sizeHistogram{counts: make([]uint64, len(m.buckets)+1)}
+			x.hs[key] = h
+		}
+		h.observe(m.buckets, x.v)
+	}
+}
+
+// 输出请求(response为false)或响应的直方图，跳过written中已输出的路由并将输出的路由记入其中
+func (m *sizeMetrics) write(w io.Writer, name string, response bool, written map[[2]string]bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	hs := m.request
+	if response {
+		hs = m.response
+	}
+	keys := make([][2]string, 0, len(hs))
+	for k := range hs {
+		if !written[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][1] < keys[j][1] || keys[i][1] == keys[j][1] && keys[i][0] < keys[j][0]
+	})
+	for _, k := range keys {
+		written[k] = true
+		h := hs[k]
+		labels := fmt.Sprintf("method=%q,route=%q", k[0], k[1])
+		var cumulative uint64
+		for i, c := range h.counts {
+			cumulative += c
+			le := "+Inf"
+			if i < len(m.buckets) {
+				le = strconv.FormatInt(m.buckets[i], 10)
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, le, cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum{%s} %d\n%s_count{%s} %d\n", name, labels, h.sum, name, labels, h.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// 以Prometheus文本格式输出按路由统计的请求与响应大小直方图，包括各桶配置的统计；
+// 同一路由先后使用了不同的桶配置时，只输出最新桶配置的统计
+func WriteSizeMetrics(w io.Writer) error {
+	list := globalSizeMetrics.Load().([]*sizeMetrics)
+	for _, x := range []struct {
+		name, help string
+		response   bool
+	}{
+		{"lessgo_request_size_bytes", "Size of HTTP request bodies in bytes.", false},
+		{"lessgo_response_size_bytes", "Size of HTTP response bodies in bytes.", true},
+	} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", x.name, x.help, x.name); err != nil {
+			return err
+		}
+		written := map[[2]string]bool{}
+		for i := len(list) - 1; i >= 0; i-- {
+			if err := list[i].write(w, x.name, x.response, written); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var SizeMetrics = ApiMiddleware{
+	Name:   "请求响应大小统计",
+	Desc:   "按路由统计请求与响应body大小的直方图，可通过WriteSizeMetrics()以Prometheus文本格式输出",
+	Config: SizeMetricsConfig{Buckets: defaultSizeBuckets},
+	Middleware: func(confObject interface{}) MiddlewareFunc {
+		metrics := sizeMetricsOf(confObject.(SizeMetricsConfig).Buckets)
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				body := &countingReader{ReadCloser: c.request.Body}
+				if c.request.Body != nil {
+					c.request.Body = body
+				}
+				err := next(c)
+				reqSize := body.n
+				if c.request.ContentLength > reqSize {
+					reqSize = c.request.ContentLength
+				}
+				route := c.path
+				if len(route) == 0 {
+					route = "unmatched"
+				}
+				metrics.observe(c.request.Method, route, reqSize, c.response.Size())
+				return err
+			}
+		}
+	},
+}.Reg()
@@ -0,0 +1,80 @@
+package lessgo
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CheckPrecondition evaluates the conditional request headers `If-Match`, `If-Unmodified-Since`
+// and `If-None-Match` against the current state of the resource, in the order of RFC 7232,
+// to implement the optimistic concurrency of writes like PUT and PATCH:
+//
+//	if ok, err := c.CheckPrecondition(article.ETag()); !ok {
+//		return err
+//	}
+//
+// currentETag is the entity tag of the current representation, quoted or not, and should be
+// the same one sent in the `ETag` header of the GETs, so that the clients can echo it back;
+// it is empty if the resource does not exist. The optional modtime is compared with `If-Unmodified-Since`.
+// It returns false with `ErrPreconditionFailed` if the request must be rejected with 412;
+// for a GET or HEAD matching `If-None-Match`, it responds 304 itself and returns false with a nil error.
+func (c *Context) CheckPrecondition(currentETag string, modtime ...time.Time) (bool, error) {
+	header := c.request.Header
+	etag := quoteETag(currentETag)
+
+	if im := header.Get(HeaderIfMatch); im != "" {
+		if !matchETag(im, etag, false) {
+			return false, ErrPreconditionFailed
+		}
+	} else if len(modtime) > 0 && !modtime[0].IsZero() {
+		// If-Unmodified-Since is ignored when If-Match is present
+		if t, err := http.ParseTime(header.Get(HeaderIfUnmodifiedSince)); err == nil && modtime[0].Truncate(time.Second).After(t) {
+			return false, ErrPreconditionFailed
+		}
+	}
+
+	if inm := header.Get(HeaderIfNoneMatch); inm != "" && matchETag(inm, etag, true) {
+		if m := c.request.Method; m == GET || m == HEAD {
+			if etag != "" {
+				c.response.Header().Set(HeaderETag, etag)
+			}
+			return false, c.NoContent(http.StatusNotModified)
+		}
+		return false, ErrPreconditionFailed
+	}
+	return true, nil
+}
+
+// quoteETag returns the entity tag in the quoted form, e.g. `"v1"` or `W/"v1"`.
+func quoteETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/"`) {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// matchETag reports whether the entity tag matches any entity tag in the list of a
+// conditional header, "*" matches any existing entity. The weak comparison ignores
+// the weak indicator, while the strong comparison never matches a weak entity tag.
+func matchETag(list, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	opaque := strings.TrimPrefix(etag, "W/")
+	isWeak := len(opaque) != len(etag)
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tagOpaque := strings.TrimPrefix(tag, "W/")
+		if tagOpaque != opaque {
+			continue
+		}
+		if weak || !isWeak && len(tagOpaque) == len(tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package lessgo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckPrecondition(t *testing.T) {
+	modtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		method string
+		header map[string]string
+		etag   string
+		ok     bool
+		err    error
+		code   int
+	}{
+		{PUT, nil, `"v1"`, true, nil, 0},
+		{PUT, map[string]string{HeaderIfMatch: `"v1"`}, "v1", true, nil, 0},
+		{PUT, map[string]string{HeaderIfMatch: `"v0", "v1"`}, `"v1"`, true, nil, 0},
+		{PUT, map[string]string{HeaderIfMatch: `"v0"`}, `"v1"`, false, ErrPreconditionFailed, 0},
+		{PUT, map[string]string{HeaderIfMatch: `W/"v1"`}, `"v1"`, false, ErrPreconditionFailed, 0}, // strong comparison
+		{PUT, map[string]string{HeaderIfMatch: `*`}, `"v1"`, true, nil, 0},
+		{PUT, map[string]string{HeaderIfMatch: `*`}, "", false, ErrPreconditionFailed, 0}, // the resource does not exist
+		{PUT, map[string]string{HeaderIfNoneMatch: `*`}, "", true, nil, 0},                // create only if absent
+		{PUT, map[string]string{HeaderIfNoneMatch: `*`}, `"v1"`, false, ErrPreconditionFailed, 0},
+		{PATCH, map[string]string{HeaderIfNoneMatch: `W/"v1"`}, `"v1"`, false, ErrPreconditionFailed, 0}, // weak comparison
+		{GET, map[string]string{HeaderIfNoneMatch: `"v1"`}, `"v1"`, false, nil, http.StatusNotModified},
+		{GET, map[string]string{HeaderIfNoneMatch: `"v0"`}, `"v1"`, true, nil, 0},
+		{PUT, map[string]string{HeaderIfUnmodifiedSince: modtime.Format(http.TimeFormat)}, `"v1"`, true, nil, 0},
+		{PUT, map[string]string{HeaderIfUnmodifiedSince: modtime.Add(-time.Hour).Format(http.TimeFormat)}, `"v1"`, false, ErrPreconditionFailed, 0},
+		{PUT, map[string]string{HeaderIfUnmodifiedSince: "garbage"}, `"v1"`, true, nil, 0},
+		// If-Unmodified-Since is ignored when If-Match is present
+		{PUT, map[string]string{HeaderIfMatch: `"v1"`, HeaderIfUnmodifiedSince: modtime.Add(-time.Hour).Format(http.TimeFormat)}, `"v1"`, true, nil, 0},
+	} {
+		req := httptest.NewRequest(tc.method, "/", nil)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		c := app.newContext(new(Response), req)
+		c.init(rec, req)
+		ok, err := c.CheckPrecondition(tc.etag, modtime)
+		if ok != tc.ok || err != tc.err {
+			t.Errorf("%s %v with %q: got %v, %v, want %v, %v", tc.method, tc.header, tc.etag, ok, err, tc.ok, tc.err)
+		}
+		if tc.code != 0 && rec.Code != tc.code {
+			t.Errorf("%s %v with %q: got status %d, want %d", tc.method, tc.header, tc.etag, rec.Code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package lessgo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// proxyListener wraps a net.Listener to accept the connections prefixed by the PROXY protocol
+	// header of a load balancer in TCP mode, like HAProxy or AWS ELB,
+	// see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+	proxyListener struct {
+		net.Listener
+		timeout time.Duration
+	}
+
+	// proxyConn reads the PROXY protocol header on the first Read or RemoteAddr call,
+	// which is made by the goroutine serving the connection, so that a slow client does not block Accept.
+	proxyConn struct {
+		net.Conn
+		r          *bufio.Reader
+		timeout    time.Duration
+		once       sync.Once
+		remoteAddr net.Addr
+		localAddr  net.Addr
+		err        error
+	}
+)
+
+// the version 1 header has at most 107 bytes, including the CRLF
+const proxyV1MaxLen = 107
+
+// the signature of the PROXY protocol version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// newProxyListener returns a listener whose connections read the PROXY protocol header
+// within the timeout, 0 for no timeout.
+func newProxyListener(l net.Listener, timeout time.Duration) net.Listener {
+	return &proxyListener{Listener: l, timeout: timeout}
+}
+
+// Accept waits for and returns the next connection, whose PROXY protocol header is not read yet.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+// Read reads the data after the PROXY protocol header.
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address of the PROXY protocol header,
+// or the address of the peer if the header says nothing about the client, e.g. for health checks.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the PROXY protocol header,
+// or the local address of the connection.
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readHeader reads the PROXY protocol header, the connection is closed if it is missing or malformed.
+func (c *proxyConn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+	c.remoteAddr, c.localAddr, c.err = readProxyHeader(c.r)
+	if c.err != nil {
+		Log.Warn("PROXY protocol: %v, the connection from %v is closed", c.err, c.Conn.RemoteAddr())
+		c.Conn.Close()
+	}
+}
+
+// readProxyHeader reads the PROXY protocol header of version 1 or 2, and returns the source
+// and destination addresses, which are nil for the UNKNOWN (v1) or LOCAL (v2) connections.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case proxyV2Signature[0]:
+		return readProxyHeaderV2(r)
+	default:
+		return nil, nil, errors.New("missing header")
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("malformed v1 header: no CRLF within 107 bytes")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, errors.New("missing header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, fmt.Errorf("malformed v1 header: unknown protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, nil, fmt.Errorf("malformed v1 header: %q", line)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil ||
+		(fields[1] == "TCP4") != (srcIP.To4() != nil) || (fields[1] == "TCP4") != (dstIP.To4() != nil) {
+		return nil, nil, fmt.Errorf("malformed v1 header: %q", line)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, nil, errors.New("missing header")
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("malformed v2 header: unknown version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	switch header[12] & 0xf {
+	case 0: // LOCAL, e.g. the health checks of the proxy itself
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("malformed v2 header: unknown command %d", header[12]&0xf)
+	}
+	var ipLen int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC or AF_UNIX, the addresses are ignored
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("malformed v2 header: short addresses")
+	}
+	src = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
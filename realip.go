@@ -0,0 +1,174 @@
+package lessgo
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For and X-Real-IP headers are trusted
+// by `Context.RealRemoteAddr()`, and the X-Forwarded-Proto, X-Forwarded-Ssl and Forwarded headers
+// by `Context.Scheme()`, in CIDRs like "10.0.0.0/8" or single IPs like "::1".
+// The headers sent by any other peer are ignored, so that a client can not spoof its address or scheme.
+// If none is set, the address headers are ignored and the peer of the connection is the client,
+// unless SetTrustAnyProxy is set. It returns an error for an invalid CIDR or IP.
+func (this *App) SetTrustedProxies(cidrs ...string) error {
+	var prefixes []netip.Prefix
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy: %s", s)
+			}
+			addr = addr.WithZone("").Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy: %s", s)
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	this.trustedProxies = prefixes
+	return nil
+}
+
+// SetTrustAnyProxy trusts the X-Real-IP and the first hop of X-Forwarded-For from any peer
+// if no trusted proxy is set, which was the behavior before the trusted proxies.
+// It is only safe if the server is never reached without the proxy, since any client can spoof its address.
+func (this *App) SetTrustAnyProxy(trust bool) {
+	this.trustAnyProxy = trust
+}
+
+// isTrustedProxy reports whether the address is in one of the trusted proxies.
+func (this *App) isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range this.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP returns the address of the client: the X-Forwarded-For is walked from right to left
+// past the trusted proxies to the first untrusted address, or the X-Real-IP is used without it,
+// both only if the peer of the connection is a trusted proxy; otherwise it is the peer itself.
+// Without any trusted proxy, it is the peer, or with SetTrustAnyProxy, the X-Real-IP
+// or the first hop of X-Forwarded-For taken as it is.
+func (this *App) realIP(req *http.Request) string {
+	if len(this.trustedProxies) == 0 && this.trustAnyProxy {
+		if ip := req.Header.Get(HeaderXRealIP); ip != "" {
+			return ip
+		}
+		if hops := forwardedFor(req.Header); len(hops) > 0 {
+			return hops[0]
+		}
+	}
+	peer, ok := parseIP(req.RemoteAddr)
+	if !ok {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr
+		}
+		return host
+	}
+	if !this.isTrustedProxy(peer) {
+		return peer.String()
+	}
+	if hops := forwardedFor(req.Header); len(hops) > 0 {
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, ok := parseIP(hops[i])
+			if !ok {
+				// the hops on the left of a malformed one can not be told apart from a spoof
+				break
+			}
+			client = addr
+			if !this.isTrustedProxy(addr) {
+				break
+			}
+		}
+		return client.String()
+	}
+	if addr, ok := parseIP(req.Header.Get(HeaderXRealIP)); ok {
+		return addr.String()
+	}
+	return peer.String()
+}
+
+// forwardedProto returns "https" or "http" of the X-Forwarded-Proto, X-Forwarded-Ssl or Forwarded header
+// sent by a trusted proxy, or "" if there is none.
+func (this *App) forwardedProto(req *http.Request) string {
+	if peer, ok := parseIP(req.RemoteAddr); !ok || !this.isTrustedProxy(peer) {
+		return ""
+	}
+	if v := req.Header.Get(HeaderXForwardedProto); v != "" {
+		// the first proxy has seen the scheme of the client
+		return httpScheme(strings.Split(v, ",")[0])
+	}
+	if v := req.Header.Get(HeaderXForwardedSsl); v != "" {
+		if strings.EqualFold(strings.TrimSpace(v), "on") {
+			return "https"
+		}
+		return "http"
+	}
+	if v := req.Header.Get(HeaderForwarded); v != "" {
+		// e.g. `for=192.0.2.60;proto=https;by=203.0.113.43, for=...`, see RFC 7239
+		for _, pair := range strings.Split(strings.Split(v, ",")[0], ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && strings.EqualFold(k, "proto") {
+				return httpScheme(strings.Trim(v, `"`))
+			}
+		}
+	}
+	return ""
+}
+
+// httpScheme returns the lower-case "https" or "http", or "" for any other scheme.
+func httpScheme(s string) string {
+	switch s = strings.ToLower(strings.TrimSpace(s)); s {
+	case "https", "http":
+		return s
+	}
+	return ""
+}
+
+// forwardedFor returns the hops of all the X-Forwarded-For headers, from the client to the last proxy.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	for _, line := range header[HeaderXForwardedFor] {
+		for _, hop := range strings.Split(line, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// parseIP parses an IP with an optional port, like "192.0.2.1", "192.0.2.1:80",
+// "2001:db8::1", "[2001:db8::1]:80" or "fe80::1%eth0", dropping the zone.
+// An IPv4-mapped IPv6 address is returned as IPv4.
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		host, _, err := net.SplitHostPort(s)
+		if err != nil {
+			host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		}
+		if addr, err = netip.ParseAddr(host); err != nil {
+			return netip.Addr{}, false
+		}
+	}
+	return addr.WithZone("").Unmap(), true
+}
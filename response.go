@@ -2,8 +2,15 @@ package lessgo
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"runtime"
+	"strings"
+	"time"
 )
 
 // Response wraps an http.ResponseWriter and implements its interface to be used
@@ -14,6 +21,12 @@ type Response struct {
 	status    int
 	size      int64
 	committed bool
+	hijacked  bool
+	firstByte time.Time
+	trailer   http.Header
+	// a WriteHeader is ignored after an error response, and whether to discard the writes after it
+	superfluous        bool
+	discardSuperfluous bool
 }
 
 var _ http.ResponseWriter = new(Response)
@@ -39,6 +52,12 @@ func (resp *Response) Header() http.Header {
 // Content-Type line, Write adds a Content-Type set to the result of passing
 // the initial 512 bytes of written data to DetectContentType.
 func (resp *Response) Write(b []byte) (int, error) {
+	if resp.superfluous && resp.discardSuperfluous {
+		// the body of a second response, see App.SetDiscardSuperfluousWrites
+		return len(b), nil
+	}
+	// the underlying writer sends the header implicitly
+	resp.commit()
 	n, err := resp.writer.Write(b)
 	resp.size += int64(n)
 	return n, err
@@ -48,27 +67,98 @@ func (resp *Response) Write(b []byte) (int, error) {
 // If WriteHeader is not called explicitly, the first call to Write
 // will trigger an implicit WriteHeader(http.StatusOK).
 // Thus explicit calls to WriteHeader are mainly used to
-// send error codes.
+// send error codes. Only the first call takes effect, the later ones are logged
+// with the position of the caller and ignored.
 func (resp *Response) WriteHeader(code int) {
 	if resp.committed {
-		Log.Warn("response already committed")
+		resp.ignoreWriteHeader(code)
 		return
 	}
 	resp.status = code
+	resp.firstByte = time.Now()
 	resp.writer.WriteHeader(code)
 	resp.committed = true
 }
 
+// commit marks the response committed by a write without WriteHeader,
+// for which the underlying writer sends the status 200 implicitly.
+func (resp *Response) commit() {
+	if !resp.committed {
+		resp.status = http.StatusOK
+		resp.firstByte = time.Now()
+		resp.committed = true
+	}
+}
+
+// ignoreWriteHeader logs a superfluous WriteHeader with the position of the caller, e.g. a handler
+// responding again after a middleware has sent an error, whose body is discarded if configured.
+func (resp *Response) ignoreWriteHeader(code int) {
+	Log.Warn("response already committed with %d, the superfluous WriteHeader(%d) at %s is ignored", resp.status, code, callerOutside())
+	if resp.status >= 400 {
+		resp.superfluous = true
+	}
+}
+
+// callerOutside returns the position of the first caller outside Context and Response,
+// e.g. the handler calling c.String rather than String itself.
+func callerOutside() string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.Contains(frame.Function, "lessgo.(*Context).") &&
+			!strings.Contains(frame.Function, "lessgo.(*Response).") &&
+			!strings.Contains(frame.Function, "lessgo.(*stdResponseWriter).") {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
+		if !more {
+			return "unknown position"
+		}
+	}
+}
+
 // AddCookie adds a Set-Cookie header.
-// The provided cookie must have a valid Name. Invalid cookies may be
-// silently dropped.
+// The provided cookie must have a valid Name. Invalid cookies are
+// dropped with a warning, and so are the cookies added after the response is committed.
 func (r *Response) AddCookie(cookie *http.Cookie) {
-	r.Header().Add("Set-Cookie", cookie.String())
+	if r.committed {
+		Log.Warn("response already committed, cookie %q is dropped", cookie.Name)
+		return
+	}
+	addCookie(r.Header(), cookie, false)
 }
 
-// SetCookie sets a Set-Cookie header.
+// SetCookie sets a Set-Cookie header, replacing the ones of the same name, path and domain
+// set before, while the other cookies are kept. See Context.SetCookie.
 func (r *Response) SetCookie(cookie *http.Cookie) {
-	r.Header().Set("Set-Cookie", cookie.String())
+	if r.committed {
+		Log.Warn("response already committed, cookie %q is dropped", cookie.Name)
+		return
+	}
+	addCookie(r.Header(), cookie, true)
+}
+
+// addCookie adds the Set-Cookie header of the cookie, after removing the cookies
+// of the same name, path and domain if replace is set.
+func addCookie(header http.Header, cookie *http.Cookie, replace bool) {
+	v := cookie.String()
+	if v == "" {
+		Log.Warn("invalid cookie %q is dropped", cookie.Name)
+		return
+	}
+	if replace {
+		var kept []string
+		for _, line := range header[HeaderSetCookie] {
+			old, err := http.ParseSetCookie(line)
+			if err == nil && old.Name == cookie.Name && old.Path == cookie.Path &&
+				strings.EqualFold(old.Domain, strings.TrimPrefix(cookie.Domain, ".")) {
+				continue
+			}
+			kept = append(kept, line)
+		}
+		header[HeaderSetCookie] = kept
+	}
+	header[HeaderSetCookie] = append(header[HeaderSetCookie], v)
 }
 
 // DelCookie sets Set-Cookie header.
@@ -77,15 +167,82 @@ func (r *Response) DelCookie() {
 }
 
 // Flush implements the http.Flusher interface to allow an HTTP handler to flush
-// buffered data to the client.
+// buffered data to the client. It does nothing if the writer does not support flushing,
+// see FlushError.
 func (resp *Response) Flush() {
-	resp.writer.(http.Flusher).Flush()
+	resp.FlushError()
+}
+
+// FlushError flushes buffered data to the client, e.g. the partial output of a long-polling
+// or progress endpoint, and sends the header if it is not sent yet.
+// It returns ErrFlushNotSupported if the writer, or any writer it wraps, does not support flushing.
+func (resp *Response) FlushError() error {
+	err := http.NewResponseController(resp.writer).Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return ErrFlushNotSupported
+	}
+	if err == nil {
+		resp.commit()
+	}
+	return err
+}
+
+// Push implements the http.Pusher interface to initiate an HTTP/2 server push,
+// e.g. of the CSS and JS of an HTML page, before the response is committed.
+// It returns ErrPushNotSupported if the connection is not HTTP/2 or the client disables push,
+// and ErrResponseCommitted after the response is committed.
+func (resp *Response) Push(target string, opts *http.PushOptions) error {
+	if resp.committed {
+		return ErrResponseCommitted
+	}
+	w, ok := underlying(resp.writer, func(w http.ResponseWriter) bool { _, ok := w.(http.Pusher); return ok })
+	if !ok {
+		return ErrPushNotSupported
+	}
+	err := w.(http.Pusher).Push(target, opts)
+	if err == http.ErrNotSupported {
+		return ErrPushNotSupported
+	}
+	return err
 }
 
 // Hijack implements the http.Hijacker interface to allow an HTTP handler to
-// take over the connection.
+// take over the connection. A hijacked Response, and the Context of it, are not
+// put back to the pool, since the hijacker may keep using them after the handler returns.
+// It returns an error wrapping http.ErrNotSupported if the writer, e.g. of HTTP/2, can not be hijacked.
 func (resp *Response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return resp.writer.(http.Hijacker).Hijack()
+	conn, rw, err := http.NewResponseController(resp.writer).Hijack()
+	if err == nil {
+		resp.hijacked = true
+		resp.committed = true
+	}
+	return conn, rw, err
+}
+
+// ReadFrom implements the io.ReaderFrom interface, so that io.Copy from a file
+// may be sent by sendfile if the underlying writer supports it.
+func (resp *Response) ReadFrom(r io.Reader) (int64, error) {
+	if resp.superfluous && resp.discardSuperfluous {
+		return io.Copy(ioutil.Discard, r)
+	}
+	resp.commit()
+	var (
+		n   int64
+		err error
+	)
+	if rf, ok := resp.writer.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		// hide the ReadFrom of Response itself from io.Copy
+		n, err = io.Copy(struct{ io.Writer }{resp.writer}, r)
+	}
+	resp.size += n
+	return n, err
+}
+
+// Hijacked reports whether the connection has been hijacked.
+func (resp *Response) Hijacked() bool {
+	return resp.hijacked
 }
 
 // CloseNotify implements the http.CloseNotifier interface to allow detecting
@@ -96,7 +253,8 @@ func (resp *Response) CloseNotify() <-chan bool {
 	return resp.writer.(http.CloseNotifier).CloseNotify()
 }
 
-// Status returns the HTTP status code of the response.
+// Status returns the HTTP status code of the response. It is 0 until the response is committed,
+// so that a handler that never writes can be told apart, and 200 after an implicit commit by Write.
 func (resp *Response) Status() int {
 	return resp.status
 }
@@ -111,6 +269,35 @@ func (resp *Response) Committed() bool {
 	return resp.committed
 }
 
+// FirstByteTime returns the time of the first WriteHeader or Write call,
+// from which the time to first byte can be told apart from the total latency,
+// e.g. of a streaming response. It is zero if the response has not been committed.
+func (resp *Response) FirstByteTime() time.Time {
+	return resp.firstByte
+}
+
+// Trailer returns the header map of the trailers, which may be set after writing the body,
+// e.g. the grpc-status of a gRPC-web response, and are sent when the handler returns.
+// They are sent on chunked HTTP/1.1 and HTTP/2 responses only; the trailers can also be declared
+// by the `Trailer` header before the body, or set directly with the http.TrailerPrefix.
+func (resp *Response) Trailer() http.Header {
+	if resp.trailer == nil {
+		resp.trailer = make(http.Header)
+	}
+	return resp.trailer
+}
+
+// writeTrailer passes the trailers to the writer, which sends them after the body.
+func (resp *Response) writeTrailer() {
+	if len(resp.trailer) == 0 {
+		return
+	}
+	header := resp.writer.Header()
+	for k, vs := range resp.trailer {
+		header[http.TrailerPrefix+k] = vs
+	}
+}
+
 // Writer returns the http.ResponseWriter instance for this Response.
 func (resp *Response) Writer() http.ResponseWriter {
 	return resp.writer
@@ -124,10 +311,39 @@ func (resp *Response) SetWriter(w http.ResponseWriter) {
 func (resp *Response) init(rw http.ResponseWriter) {
 	resp.writer = rw
 	resp.size = 0
-	resp.status = http.StatusOK
+	resp.status = 0
 	resp.committed = false
+	resp.hijacked = false
+	resp.firstByte = time.Time{}
+	resp.trailer = nil
+	resp.superfluous = false
+	resp.discardSuperfluous = false
 }
 
+// poison zeroes the freed Response for the stale references, which read an empty header
+// and whose writes fail with errPoisoned, see App.SetPoolPoisoning.
+func (resp *Response) poison() {
+	*resp = Response{writer: poisonedWriter{}}
+}
+
+// errPoisoned is returned by the writes to a Response after its request is done.
+var errPoisoned = errors.New("lessgo: write to the response of a finished request")
+
+// poisonedWriter is the writer of a poisoned Response.
+type poisonedWriter struct{}
+
+func (poisonedWriter) Header() http.Header        { return make(http.Header) }
+func (poisonedWriter) Write([]byte) (int, error)  { return 0, errPoisoned }
+func (poisonedWriter) WriteHeader(statusCode int) {}
+
 func (resp *Response) free() {
 	resp.writer = nil
+	resp.size = 0
+	resp.status = 0
+	resp.committed = false
+	resp.hijacked = false
+	resp.firstByte = time.Time{}
+	resp.trailer = nil
+	resp.superfluous = false
+	resp.discardSuperfluous = false
 }
@@ -0,0 +1,139 @@
+package lessgo
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+type (
+	// stdResponseWriter is the http.ResponseWriter passed to the standard handlers by WrapHandler,
+	// which writes through the Context, so that the session is released before the header is sent
+	// and the status and size are recorded by the Response.
+	stdResponseWriter struct {
+		c *Context
+	}
+
+	// stdWriter is the part of stdResponseWriter that is always exposed, the optional interfaces
+	// are embedded beside it only if the underlying writer supports them, see Context.ResponseWriter.
+	stdWriter interface {
+		http.ResponseWriter
+		io.ReaderFrom
+		Unwrap() http.ResponseWriter
+	}
+)
+
+// Header returns the header map of the response.
+func (w *stdResponseWriter) Header() http.Header {
+	return w.c.Header()
+}
+
+// Write writes the data as part of the response.
+func (w *stdResponseWriter) Write(b []byte) (int, error) {
+	return w.c.Write(b)
+}
+
+// WriteHeader sends the response header with status code.
+func (w *stdResponseWriter) WriteHeader(code int) {
+	w.c.WriteHeader(code)
+}
+
+// ReadFrom implements io.ReaderFrom, so that io.Copy from a file may use sendfile, see Response.ReadFrom.
+func (w *stdResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.c.response.ReadFrom(r)
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (w *stdResponseWriter) Unwrap() http.ResponseWriter {
+	return w.c.response.writer
+}
+
+// Flush implements http.Flusher, e.g. for the server-sent events.
+func (w *stdResponseWriter) Flush() {
+	w.c.Flush()
+}
+
+// Hijack implements http.Hijacker, e.g. for the WebSocket upgraders.
+func (w *stdResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.c.response.Hijack()
+}
+
+// Push implements http.Pusher for HTTP/2 server push.
+func (w *stdResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.c.response.Push(target, opts)
+}
+
+// newStdResponseWriter returns the stdResponseWriter of c, which implements http.Flusher,
+// http.Hijacker and http.Pusher only if the underlying writer does, so that the standard
+// handlers probing for them behave as if they were served by net/http directly.
+func newStdResponseWriter(c *Context) http.ResponseWriter {
+	w := &stdResponseWriter{c: c}
+	u := c.response.writer
+	_, f := underlying(u, func(w http.ResponseWriter) bool { _, ok := w.(http.Flusher); return ok })
+	_, h := underlying(u, func(w http.ResponseWriter) bool { _, ok := w.(http.Hijacker); return ok })
+	_, p := underlying(u, func(w http.ResponseWriter) bool { _, ok := w.(http.Pusher); return ok })
+	var base stdWriter = w
+	switch {
+	case f && h && p:
+		return struct {
+			stdWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{base, w, w, w}
+	case f && h:
+		return struct {
+			stdWriter
+			http.Flusher
+			http.Hijacker
+		}{base, w, w}
+	case f && p:
+		return struct {
+			stdWriter
+			http.Flusher
+			http.Pusher
+		}{base, w, w}
+	case h && p:
+		return struct {
+			stdWriter
+			http.Hijacker
+			http.Pusher
+		}{base, w, w}
+	case f:
+		return struct {
+			stdWriter
+			http.Flusher
+		}{base, w}
+	case h:
+		return struct {
+			stdWriter
+			http.Hijacker
+		}{base, w}
+	case p:
+		return struct {
+			stdWriter
+			http.Pusher
+		}{base, w}
+	default:
+		return struct {
+			stdWriter
+		}{base}
+	}
+}
+
+// underlying returns the first writer in the Unwrap chain of w, w included, that satisfies ok.
+func underlying(w http.ResponseWriter, ok func(http.ResponseWriter) bool) (http.ResponseWriter, bool) {
+	for {
+		if ok(w) {
+			return w, true
+		}
+		u, isWrapper := w.(interface {
+			Unwrap() http.ResponseWriter
+		})
+		if !isWrapper {
+			return nil, false
+		}
+		w = u.Unwrap()
+	}
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package lessgo
+
+import (
+	"syscall"
+)
+
+// reusePortControl sets SO_REUSEPORT on the socket before it is bound,
+// so that several processes can listen on the same port.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); e != nil {
+		return e
+	}
+	return err
+}
@@ -0,0 +1,7 @@
+package lessgo
+
+import (
+	"syscall"
+)
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -37,6 +37,17 @@ type Router struct {
 	// handler.
 	HandleMethodNotAllowed bool
 
+	// If enabled, a request path that can't be matched exactly is matched
+	// case-insensitively, without a redirection, e.g. /Users/123 is handled by
+	// /users/:id. The parameter values keep their original case.
+	// Disabled by default, since the paths are case-sensitive per spec.
+	CaseInsensitive bool
+
+	// If enabled, a request path that can't be matched exactly is cleaned
+	// before matching, without a redirection, e.g. //users/../users/123 is
+	// handled by /users/:id. Disabled by default.
+	MatchCleanPath bool
+
 	// If enabled, the router automatically replies to OPTIONS requests.
 	// Custom OPTIONS handlers take priority over automatic replies.
 	HandleOPTIONS bool
@@ -81,6 +92,46 @@ func (r *Router) Handle(method, path string, handle HandlerFunc) {
 	root.addRoute(path, handle)
 }
 
+// getLeaf looks up the path in the tree, then the normalized path
+// if CaseInsensitive or MatchCleanPath is enabled.
+func (r *Router) getLeaf(root *node, path string, pkeys, pvalues []string) (*node, []string, []string, bool) {
+	leaf, pkeys, pvalues, tsr := root.getLeaf(path, pkeys, pvalues)
+	if leaf != nil || !r.CaseInsensitive && !r.MatchCleanPath {
+		return leaf, pkeys, pvalues, tsr
+	}
+	fixed := path
+	if r.MatchCleanPath {
+		fixed = CleanPath(fixed)
+	}
+	if r.CaseInsensitive {
+		if ciPath, found := root.findCaseInsensitivePath(fixed, false); found {
+			fixed = utils.Bytes2String(ciPath)
+		}
+	}
+	if fixed == path {
+		return leaf, pkeys, pvalues, tsr
+	}
+	if leaf2, pkeys2, pvalues2, _ := root.getLeaf(fixed, pkeys[:0], pvalues[:0]); leaf2 != nil {
+		return leaf2, pkeys2, pvalues2, false
+	}
+	return leaf, pkeys, pvalues, tsr
+}
+
+// match returns the registered path of the route which would handle the request.
+func (r *Router) match(method, path string) (string, bool) {
+	r.RLock()
+	root := r.trees[method]
+	r.RUnlock()
+	if root == nil {
+		return "", false
+	}
+	leaf, _, _, _ := r.getLeaf(root, path, nil, nil)
+	if leaf == nil {
+		return "", false
+	}
+	return leaf.route, true
+}
+
 func (r *Router) allowed(path, reqMethod string, pkeys, pvalues []string) string {
 	var allow string
 	if path == "*" { // server-wide
@@ -132,11 +183,11 @@ func (r *Router) process(next HandlerFunc) HandlerFunc {
 		var path = req.URL.Path
 
 		if root != nil {
-			var handle HandlerFunc
+			var leaf *node
 			var tsr bool
-			handle, c.pkeys, c.pvalues, tsr = root.getValue(path, c.pkeys, c.pvalues)
-			if handle != nil {
-				if err := handle(c); err != nil {
+			leaf, c.pkeys, c.pvalues, tsr = r.getLeaf(root, path, c.pkeys, c.pvalues)
+			if leaf != nil {
+				if err := leaf.handle(c); err != nil {
 					return err
 				}
 				return next(c)
@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package lessgo
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/facebookgo/grace/gracenet"
+)
+
+// handleSignals shuts down the server gracefully on SIGINT or SIGTERM until done is closed.
+// On SIGUSR2, it restarts the server gracefully by starting a new process that inherits
+// the listeners, which sends SIGTERM to this one once it is serving.
+func (this *App) handleSignals(gnet *gracenet.Net, done <-chan struct{}) {
+	sig := make(chan os.Signal, 10)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGUSR2 {
+				if this.graceExitCallback == nil || this.graceExitCallback() == nil {
+					if _, err := gnet.StartProcess(); err != nil {
+						Log.Error("graceful restart: %v", err)
+					}
+					continue
+				}
+			}
+			// a subsequent signal terminates the process as usual
+			signal.Stop(sig)
+			this.shutdownOnSignal()
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// terminateParent sends SIGTERM to the parent process after a graceful restart,
+// unless this process is started by init or by the systemd socket activation,
+// which sets LISTEN_PID to this process.
+func terminateParent() error {
+	if os.Getenv("LISTEN_FDS") == "" || os.Getppid() == 1 || os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	return syscall.Kill(os.Getppid(), syscall.SIGTERM)
+}
@@ -0,0 +1,29 @@
+package lessgo
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/facebookgo/grace/gracenet"
+)
+
+// handleSignals shuts down the server gracefully on SIGINT or SIGTERM until done is closed,
+// the graceful restart is not supported on Windows.
+func (this *App) handleSignals(gnet *gracenet.Net, done <-chan struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case <-sig:
+		// a subsequent signal terminates the process as usual
+		signal.Stop(sig)
+		this.shutdownOnSignal()
+	case <-done:
+	}
+}
+
+// terminateParent is a no-op, the graceful restart is not supported on Windows.
+func terminateParent() error {
+	return nil
+}
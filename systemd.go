@@ -0,0 +1,104 @@
+//go:build !windows
+// +build !windows
+
+package lessgo
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/facebookgo/grace/gracenet"
+)
+
+// listenFdsStart is the first file descriptor passed by the systemd socket activation.
+const listenFdsStart = 3
+
+// listenSystemd listens on the socket passed by the systemd socket activation,
+// which is named name by FileDescriptorName= of the socket unit, or the only one if name is empty.
+// The socket is taken over by gnet, so that it is inherited again after a graceful restart.
+// It also returns the name of the socket in LISTEN_FDNAMES.
+func listenSystemd(gnet *gracenet.Net, name string) (net.Listener, string, error) {
+	fd, err := systemdFd(name)
+	if err != nil {
+		return nil, "", err
+	}
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return nil, "", fmt.Errorf("systemd socket activation: fd %d: %v", fd, err)
+	}
+	if typ != syscall.SOCK_STREAM {
+		return nil, "", fmt.Errorf("systemd socket activation: fd %d is not a stream socket", fd)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return nil, "", fmt.Errorf("systemd socket activation: fd %d: %v", fd, err)
+	}
+	var network, address string
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		network, address = "tcp", net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrInet6:
+		network, address = "tcp", net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrUnix:
+		network, address = "unix", sa.Name
+	default:
+		return nil, "", fmt.Errorf("systemd socket activation: fd %d is not a TCP or unix socket", fd)
+	}
+	// gracenet inherits all the sockets of LISTEN_FDS, and picks the one of the same address
+	l, err := gnet.Listen(network, address)
+	if err != nil {
+		return nil, "", err
+	}
+	return l, systemdFdNames()[fd-listenFdsStart], nil
+}
+
+// systemdFd returns the file descriptor of the socket named name in LISTEN_FDNAMES,
+// or the only one if name is empty. LISTEN_PID may also be the pid of the parent process,
+// which has passed the sockets to this one by a graceful restart.
+func systemdFd(name string) (int, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" {
+		return 0, errors.New("systemd socket activation: LISTEN_PID or LISTEN_FDS is not set, is the process started by a socket unit?")
+	}
+	if pid != strconv.Itoa(os.Getpid()) && pid != strconv.Itoa(os.Getppid()) {
+		return 0, fmt.Errorf("systemd socket activation: LISTEN_PID=%s is not this process %d", pid, os.Getpid())
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("systemd socket activation: invalid LISTEN_FDS=%s", fds)
+	}
+	if name == "" {
+		if n != 1 {
+			return 0, fmt.Errorf("systemd socket activation: %d sockets are passed, set the socket name to pick one of LISTEN_FDNAMES=%s", n, os.Getenv("LISTEN_FDNAMES"))
+		}
+		return listenFdsStart, nil
+	}
+	for i, s := range systemdFdNames() {
+		if s == name && i < n {
+			return listenFdsStart + i, nil
+		}
+	}
+	return 0, fmt.Errorf("systemd socket activation: no socket named %q in LISTEN_FDNAMES=%s", name, os.Getenv("LISTEN_FDNAMES"))
+}
+
+// systemdFdNames returns the names of LISTEN_FDNAMES, padded to LISTEN_FDS.
+func systemdFdNames() []string {
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for len(names) < n {
+		names = append(names, "")
+	}
+	return names
+}
+
+// setSystemdEnv rewrites LISTEN_PID and LISTEN_FDNAMES for the new process of a graceful restart,
+// which inherits the listeners of gnet in the order of names.
+func setSystemdEnv(names []string) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDNAMES", strings.Join(names, ":"))
+}
@@ -0,0 +1,16 @@
+package lessgo
+
+import (
+	"errors"
+	"net"
+
+	"github.com/facebookgo/grace/gracenet"
+)
+
+// listenSystemd fails, the systemd socket activation is not supported on Windows.
+func listenSystemd(gnet *gracenet.Net, name string) (net.Listener, string, error) {
+	return nil, "", errors.New("systemd socket activation is not supported on Windows")
+}
+
+// setSystemdEnv is a no-op, the graceful restart is not supported on Windows.
+func setSystemdEnv(names []string) {}
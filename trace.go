@@ -0,0 +1,132 @@
+package lessgo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+type (
+	// traceContext holds the W3C trace context of a request,
+	// see https://www.w3.org/TR/trace-context/
+	traceContext struct {
+		traceID      string
+		spanID       string // the span of the current request
+		parentSpanID string // the span of the caller, empty if the trace starts here
+		flags        string
+		state        string
+		inited       bool
+	}
+)
+
+// TraceID returns the W3C trace ID of the request, taken from the `traceparent` header,
+// or generated if the header is absent or malformed.
+func (c *Context) TraceID() string {
+	c.initTrace()
+	return c.trace.traceID
+}
+
+// SpanID returns the span ID generated for the current request.
+func (c *Context) SpanID() string {
+	c.initTrace()
+	return c.trace.spanID
+}
+
+// ParentSpanID returns the span ID of the caller from the `traceparent` header,
+// or empty if the trace starts at the current request.
+func (c *Context) ParentSpanID() string {
+	c.initTrace()
+	return c.trace.parentSpanID
+}
+
+// Traceparent returns the `traceparent` header value to propagate on outbound calls,
+// with the span of the current request as the parent.
+func (c *Context) Traceparent() string {
+	c.initTrace()
+	return "00-" + c.trace.traceID + "-" + c.trace.spanID + "-" + c.trace.flags
+}
+
+// Tracestate returns the incoming `tracestate` header value to propagate on outbound calls,
+// it is dropped if the `traceparent` header is absent or malformed.
+func (c *Context) Tracestate() string {
+	c.initTrace()
+	return c.trace.state
+}
+
+// SetTraceHeaders sets the trace context headers on the outbound request header.
+func (c *Context) SetTraceHeaders(header http.Header) {
+	c.initTrace()
+	header[HeaderTraceparent] = []string{c.Traceparent()}
+	if c.trace.state != "" {
+		header[HeaderTracestate] = []string{c.trace.state}
+	} else {
+		delete(header, HeaderTracestate)
+	}
+}
+
+func (c *Context) initTrace() {
+	if c.trace.inited {
+		return
+	}
+	c.trace.inited = true
+	c.trace.spanID = newTraceHexID(8)
+	traceID, parentSpanID, flags, ok := parseTraceparent(c.request.Header.Get(HeaderTraceparent))
+	if !ok {
+		c.trace.traceID = newTraceHexID(16)
+		c.trace.flags = "00"
+		return
+	}
+	c.trace.traceID = traceID
+	c.trace.parentSpanID = parentSpanID
+	c.trace.flags = flags
+	c.trace.state = strings.Join(c.request.Header[HeaderTracestate], ",")
+}
+
+// parseTraceparent parses the `traceparent` header value "version-traceid-parentid-flags".
+func parseTraceparent(s string) (traceID, parentSpanID, flags string, ok bool) {
+	s = strings.TrimSpace(s)
+	// version 00 has exactly 55 characters, the future versions may append fields after a '-'
+	if len(s) < 55 || (len(s) > 55 && s[55] != '-') {
+		return "", "", "", false
+	}
+	if s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return "", "", "", false
+	}
+	version, traceID, parentSpanID, flags := s[:2], s[3:35], s[36:52], s[53:55]
+	if !isLowerHex(version) || version == "ff" || (version == "00" && len(s) != 55) {
+		return "", "", "", false
+	}
+	if !isLowerHex(traceID) || traceID == strings.Repeat("0", 32) {
+		return "", "", "", false
+	}
+	if !isLowerHex(parentSpanID) || parentSpanID == strings.Repeat("0", 16) {
+		return "", "", "", false
+	}
+	if !isLowerHex(flags) {
+		return "", "", "", false
+	}
+	return traceID, parentSpanID, flags, true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if b := s[i]; !('0' <= b && b <= '9' || 'a' <= b && b <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newTraceHexID generates a random non-zero ID of n bytes in lower hex.
+func newTraceHexID(n int) string {
+	b := make([]byte, n)
+	for {
+		rand.Read(b)
+		for _, x := range b {
+			if x != 0 {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+}
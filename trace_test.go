@@ -0,0 +1,70 @@
+package lessgo
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traceID, parent, flags, ok := parseTraceparent(valid)
+	if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parent != "00f067aa0ba902b7" || flags != "01" {
+		t.Fatalf("valid: got %q %q %q %v", traceID, parent, flags, ok)
+	}
+	// a future version may append fields
+	if _, _, _, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); !ok {
+		t.Error("future version with extra fields was rejected")
+	}
+
+	for _, s := range []string{
+		"",
+		"garbage",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",      // missing flags
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x", // version 00 with extra fields
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",   // forbidden version
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",   // zero trace id
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",   // zero parent id
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",   // upper case
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",   // not hex
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",   // wrong separators
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01x",  // future version without '-'
+	} {
+		if _, _, _, ok := parseTraceparent(s); ok {
+			t.Errorf("%q: malformed traceparent was accepted", s)
+		}
+	}
+}
+
+func TestContextTrace(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(HeaderTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(HeaderTracestate, "congo=t61rcWkgMzE")
+	c := app.newContext(new(Response), req)
+	c.init(httptest.NewRecorder(), req)
+	if c.TraceID() != "4bf92f3577b34da6a3ce929d0e0e4736" || c.ParentSpanID() != "00f067aa0ba902b7" {
+		t.Errorf("got trace %q parent %q", c.TraceID(), c.ParentSpanID())
+	}
+	if len(c.SpanID()) != 16 || c.SpanID() == c.ParentSpanID() {
+		t.Errorf("bad span id %q", c.SpanID())
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + c.SpanID() + "-01"; c.Traceparent() != want {
+		t.Errorf("got traceparent %q, want %q", c.Traceparent(), want)
+	}
+	if c.Tracestate() != "congo=t61rcWkgMzE" {
+		t.Errorf("got tracestate %q", c.Tracestate())
+	}
+	c.free()
+
+	// a malformed traceparent starts a new trace and drops the tracestate
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(HeaderTraceparent, "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	req.Header.Set(HeaderTracestate, "congo=t61rcWkgMzE")
+	c.init(httptest.NewRecorder(), req)
+	if c.TraceID() == strings.Repeat("0", 32) || len(c.TraceID()) != 32 || c.ParentSpanID() != "" || c.Tracestate() != "" {
+		t.Errorf("malformed: got trace %q parent %q state %q", c.TraceID(), c.ParentSpanID(), c.Tracestate())
+	}
+	if _, _, _, ok := parseTraceparent(c.Traceparent()); !ok {
+		t.Errorf("generated traceparent %q is invalid", c.Traceparent())
+	}
+}
@@ -46,6 +46,7 @@ type node struct {
 	indices   string
 	children  []*node
 	handle    HandlerFunc
+	route     string // the registered path of the handle
 	priority  uint32
 }
 
@@ -109,6 +110,7 @@ func (n *node) addRoute(path string, handle HandlerFunc) {
 					indices:   n.indices,
 					children:  n.children,
 					handle:    n.handle,
+					route:     n.route,
 					priority:  n.priority - 1,
 				}
 
@@ -124,6 +126,7 @@ func (n *node) addRoute(path string, handle HandlerFunc) {
 				n.indices = utils.Bytes2String([]byte{n.path[i]})
 				n.path = path[:i]
 				n.handle = nil
+				n.route = ""
 				n.wildChild = false
 			}
 
@@ -191,6 +194,7 @@ func (n *node) addRoute(path string, handle HandlerFunc) {
 					panic("a handle is already registered for path '" + fullPath + "'")
 				}
 				n.handle = handle
+				n.route = fullPath
 			}
 			return
 		}
@@ -300,6 +304,7 @@ func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handle
 				nType:     catchAll,
 				maxParams: 1,
 				handle:    handle,
+				route:     fullPath,
 				priority:  1,
 			}
 			n.children = []*node{child}
@@ -311,6 +316,7 @@ func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handle
 	// insert remaining path part and handle to the leaf
 	n.path = path[offset:]
 	n.handle = handle
+	n.route = fullPath
 }
 
 // Returns the handle registered with the given path (key). The values of
@@ -319,9 +325,18 @@ func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handle
 // made if a handle exists with an extra (without the) trailing slash for the
 // given path.
 func (n *node) getValue(path string, pkeys, pvalues []string) (HandlerFunc, []string, []string, bool) {
+	leaf, pkeys, pvalues, tsr := n.getLeaf(path, pkeys, pvalues)
+	if leaf == nil {
+		return nil, pkeys, pvalues, tsr
+	}
+	return leaf.handle, pkeys, pvalues, tsr
+}
+
+// getLeaf is like getValue, but returns the node holding the handle.
+func (n *node) getLeaf(path string, pkeys, pvalues []string) (*node, []string, []string, bool) {
 	var (
-		handle HandlerFunc
-		tsr    bool
+		leaf *node
+		tsr  bool
 	)
 	// save param value
 	if pkeys == nil {
@@ -353,7 +368,7 @@ walk: // outer loop for walking the tree
 					// We can recommend to redirect to the same URL without a
 					// trailing slash if a leaf exists for that path.
 					tsr = (path == "/" && n.handle != nil)
-					return handle, pkeys, pvalues, tsr
+					return leaf, pkeys, pvalues, tsr
 				}
 
 				// handle wildcard child
@@ -387,18 +402,18 @@ walk: // outer loop for walking the tree
 
 						// ... but we can't
 						tsr = (len(path) == end+1)
-						return handle, pkeys, pvalues, tsr
+						return leaf, pkeys, pvalues, tsr
 					}
 
-					if handle = n.handle; handle != nil {
-						return handle, pkeys, pvalues, tsr
+					if n.handle != nil {
+						return n, pkeys, pvalues, tsr
 					} else if len(n.children) == 1 {
 						// No handle found. Check if a handle for this path + a
 						// trailing slash exists for TSR recommendation
 						n = n.children[0]
 						tsr = (n.path == "/" && n.handle != nil)
 					}
-					return handle, pkeys, pvalues, tsr
+					return leaf, pkeys, pvalues, tsr
 
 				case catchAll:
 					i := len(pkeys)
@@ -412,8 +427,10 @@ walk: // outer loop for walking the tree
 						pvalues = append(pvalues, path)
 					}
 
-					handle = n.handle
-					return handle, pkeys, pvalues, tsr
+					if n.handle != nil {
+						leaf = n
+					}
+					return leaf, pkeys, pvalues, tsr
 
 				default:
 					panic("invalid node type")
@@ -422,13 +439,13 @@ walk: // outer loop for walking the tree
 		} else if path == n.path {
 			// We should have reached the node containing the handle.
 			// Check if this node has a handle registered.
-			if handle = n.handle; handle != nil {
-				return handle, pkeys, pvalues, tsr
+			if n.handle != nil {
+				return n, pkeys, pvalues, tsr
 			}
 
 			if path == "/" && n.wildChild && n.nType != root {
 				tsr = true
-				return handle, pkeys, pvalues, tsr
+				return leaf, pkeys, pvalues, tsr
 			}
 
 			// No handle found. Check if a handle for this path + a
@@ -438,11 +455,11 @@ walk: // outer loop for walking the tree
 					n = n.children[i]
 					tsr = (len(n.path) == 1 && n.handle != nil) ||
 						(n.nType == catchAll && n.children[0].handle != nil)
-					return handle, pkeys, pvalues, tsr
+					return leaf, pkeys, pvalues, tsr
 				}
 			}
 
-			return handle, pkeys, pvalues, tsr
+			return leaf, pkeys, pvalues, tsr
 		}
 
 		// Nothing found. We can recommend to redirect to the same URL with an
@@ -450,7 +467,7 @@ walk: // outer loop for walking the tree
 		tsr = (path == "/") ||
 			(len(n.path) == len(path)+1 && n.path[len(path)] == '/' &&
 				path == n.path[:len(n.path)-1] && n.handle != nil)
-		return handle, pkeys, pvalues, tsr
+		return leaf, pkeys, pvalues, tsr
 	}
 }
 
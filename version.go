@@ -0,0 +1,122 @@
+package lessgo
+
+import (
+	"mime"
+	"strings"
+)
+
+type (
+	// apiVersion holds the API version requested by the client.
+	apiVersion struct {
+		version string
+		format  string
+		inited  bool
+	}
+)
+
+// APIVersion returns the API version requested by the client, e.g. "v2".
+// It is taken from the `X-API-Version` header, where a bare number like "2" is normalized to "v2",
+// or else from a vendor media type in the `Accept` header like `application/vnd.myapi.v2+json`
+// or `application/vnd.myapi+json; version=2`. It returns empty if the client sent none.
+func (c *Context) APIVersion() string {
+	c.initAPIVersion()
+	return c.apiVersion.version
+}
+
+// APIFormat returns the structured syntax suffix of the vendor media type in the `Accept` header,
+// e.g. "json" for `application/vnd.myapi.v2+json`, or empty if there is none.
+func (c *Context) APIFormat() string {
+	c.initAPIVersion()
+	return c.apiVersion.format
+}
+
+// SetAPIVersion overrides the API version of the request, e.g. to apply a default version in a middleware.
+func (c *Context) SetAPIVersion(version string) {
+	c.initAPIVersion()
+	c.apiVersion.version = version
+}
+
+func (c *Context) initAPIVersion() {
+	if c.apiVersion.inited {
+		return
+	}
+	c.apiVersion.inited = true
+	for _, accept := range strings.Split(c.request.Header.Get(HeaderAccept), ",") {
+		if _, version, format, ok := parseVendorMediaType(accept); ok {
+			c.apiVersion.version, c.apiVersion.format = version, format
+			break
+		}
+	}
+	if v := strings.TrimSpace(c.request.Header.Get(HeaderXAPIVersion)); v != "" {
+		c.apiVersion.version = normalizeAPIVersion(v)
+	}
+}
+
+// parseVendorMediaType parses a vendor media type like `application/vnd.myapi.v2+json`
+// or `application/vnd.myapi+json; version=2` into the vendor "myapi",
+// the version "v2" and the suffix format "json".
+// The version may be empty if the media type carries none.
+func parseVendorMediaType(s string) (vendor, version, format string, ok bool) {
+	mediatype, params, err := mime.ParseMediaType(strings.TrimSpace(s))
+	if err != nil {
+		return "", "", "", false
+	}
+	i := strings.IndexByte(mediatype, '/')
+	if i < 0 || !strings.HasPrefix(mediatype[i+1:], "vnd.") {
+		return "", "", "", false
+	}
+	subtype := mediatype[i+1+len("vnd."):]
+	if j := strings.LastIndexByte(subtype, '+'); j >= 0 {
+		subtype, format = subtype[:j], subtype[j+1:]
+	}
+	parts := strings.Split(subtype, ".")
+	for k, part := range parts {
+		if k > 0 && isVersionSegment(part) {
+			// the minor versions like "v2.1" follow as numeric segments
+			end := k + 1
+			for end < len(parts) && isDigits(parts[end]) {
+				end++
+			}
+			vendor = strings.Join(parts[:k], ".")
+			version = strings.Join(parts[k:end], ".")
+			break
+		}
+	}
+	if vendor == "" {
+		vendor = subtype
+	}
+	if vendor == "" {
+		return "", "", "", false
+	}
+	if v := params["version"]; v != "" && version == "" {
+		version = normalizeAPIVersion(v)
+	}
+	return vendor, version, format, true
+}
+
+// isVersionSegment reports whether s looks like "v2".
+func isVersionSegment(s string) bool {
+	return len(s) > 1 && s[0] == 'v' && isDigits(s[1:])
+}
+
+// normalizeAPIVersion prefixes the numeric versions like "2" or "2.1" with "v".
+func normalizeAPIVersion(v string) string {
+	for _, part := range strings.Split(v, ".") {
+		if !isDigits(part) {
+			return v
+		}
+	}
+	return "v" + v
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
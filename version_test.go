@@ -0,0 +1,63 @@
+package lessgo
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseVendorMediaType(t *testing.T) {
+	for _, tc := range []struct {
+		in                      string
+		vendor, version, format string
+		ok                      bool
+	}{
+		{"application/vnd.myapi.v2+json", "myapi", "v2", "json", true},
+		{"application/vnd.github.v3.raw+json", "github", "v3", "json", true},
+		{"application/vnd.myapi.v2.1+xml", "myapi", "v2.1", "xml", true},
+		{"application/vnd.my.api.v10", "my.api", "v10", "", true},
+		{"application/vnd.myapi+json; version=2", "myapi", "v2", "json", true},
+		{"application/vnd.myapi+json;q=0.9", "myapi", "", "json", true},
+		{"application/json", "", "", "", false},
+		{"application/vnd.", "", "", "", false},
+		{"garbage", "", "", "", false},
+	} {
+		vendor, version, format, ok := parseVendorMediaType(tc.in)
+		if vendor != tc.vendor || version != tc.version || format != tc.format || ok != tc.ok {
+			t.Errorf("%q: got %q %q %q %v", tc.in, vendor, version, format, ok)
+		}
+	}
+}
+
+func TestContextAPIVersion(t *testing.T) {
+	for _, tc := range []struct {
+		accept, header  string
+		version, format string
+	}{
+		{"", "", "", ""},
+		{"text/html, application/vnd.myapi.v2+json;q=0.9", "", "v2", "json"},
+		{"application/vnd.myapi.v2+json", "3", "v3", "json"},
+		{"", "v1", "v1", ""},
+		{"", "2024-01-01", "2024-01-01", ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.accept != "" {
+			req.Header.Set(HeaderAccept, tc.accept)
+		}
+		if tc.header != "" {
+			req.Header.Set(HeaderXAPIVersion, tc.header)
+		}
+		c := app.newContext(new(Response), req)
+		c.init(httptest.NewRecorder(), req)
+		if v, f := c.APIVersion(), c.APIFormat(); v != tc.version || f != tc.format {
+			t.Errorf("Accept %q, X-API-Version %q: got %q %q", tc.accept, tc.header, v, f)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	c := app.newContext(new(Response), req)
+	c.init(httptest.NewRecorder(), req)
+	c.SetAPIVersion("v1")
+	if v := c.APIVersion(); v != "v1" {
+		t.Errorf("SetAPIVersion: got %q", v)
+	}
+}